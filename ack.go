@@ -0,0 +1,141 @@
+package pipelines
+
+import (
+	"context"
+	"sync"
+)
+
+// AckSource is a queue source that wants to know when an item it produced is fully processed, such as a message queue
+// that deletes messages once they are handled or a reader that commits file offsets. Ack is called once every copy of
+// the item finished its final stage or was filtered out, Nack is called the first time a stage fails on the item.
+type AckSource[T any] interface {
+	Next(ctx context.Context) (T, error)
+	Ack(item T)
+	Nack(item T, err error)
+}
+
+// Tracked carries an item through the pipeline along with the acknowledgement state of the source item it came from.
+// Stage functions are lifted with AckStage, AckFilterStage and AckDequeue so they can stay unaware of it.
+type Tracked[T any] struct {
+	Item    T
+	tracker *ackTracker
+}
+
+// ackTracker counts the copies of a source item that are still in the pipeline
+type ackTracker struct {
+	mu      sync.Mutex
+	pending int
+	settled bool
+	ack     func()
+	nack    func(error)
+}
+
+// add registers n more copies of the item, used when an item is fanned out
+func (at *ackTracker) add(n int) {
+	at.mu.Lock()
+	at.pending += n
+	at.mu.Unlock()
+}
+
+// done marks one copy as finished and acknowledges the source item once no copies are left
+func (at *ackTracker) done() {
+	at.mu.Lock()
+	at.pending--
+	ack := at.pending <= 0 && !at.settled
+	if ack {
+		at.settled = true
+	}
+	at.mu.Unlock()
+	if ack {
+		at.ack()
+	}
+}
+
+// fail negatively acknowledges the source item, only the first failure is reported
+func (at *ackTracker) fail(err error) {
+	at.mu.Lock()
+	nack := !at.settled
+	at.settled = true
+	at.mu.Unlock()
+	if nack {
+		at.nack(err)
+	}
+}
+
+// AckQueue is the same as Queue but pulls from an AckSource and tracks every item so that the source is acknowledged
+// once the item is done
+func AckQueue[T any](ctx context.Context, src AckSource[T], bufferSize int, workers int) (<-chan Tracked[T], <-chan error) {
+	return Queue(ctx, func(ctx context.Context) (Tracked[T], error) {
+		item, err := src.Next(ctx)
+		if err != nil {
+			return Tracked[T]{}, err
+		}
+		return Tracked[T]{
+			Item: item,
+			tracker: &ackTracker{
+				pending: 1,
+				ack:     func() { src.Ack(item) },
+				nack:    func(err error) { src.Nack(item, err) },
+			},
+		}, nil
+	}, bufferSize, workers)
+}
+
+// AckStage lifts a worker function so that it can be used with WorkerPool on tracked items. If the function returns an
+// error the source item is negatively acknowledged and the error is still returned for the error channel.
+func AckStage[T1, T2 any](f func(T1) (T2, error)) func(Tracked[T1]) (Tracked[T2], error) {
+	return func(t Tracked[T1]) (Tracked[T2], error) {
+		res, err := f(t.Item)
+		if err != nil {
+			t.tracker.fail(err)
+			return Tracked[T2]{}, err
+		}
+		return Tracked[T2]{Item: res, tracker: t.tracker}, nil
+	}
+}
+
+// AckFilterStage lifts a worker function so that it can be used with WorkerPoolWithZeroValueFilter on tracked items.
+// A zero value result counts as the item being done, so it is acknowledged before it is dropped.
+func AckFilterStage[T1 any, T2 comparable](f func(T1) (T2, error)) func(Tracked[T1]) (Tracked[T2], error) {
+	return func(t Tracked[T1]) (Tracked[T2], error) {
+		var zero T2
+		res, err := f(t.Item)
+		if err != nil {
+			t.tracker.fail(err)
+			return Tracked[T2]{}, err
+		}
+		if res == zero {
+			t.tracker.done()
+			return Tracked[T2]{}, nil
+		}
+		return Tracked[T2]{Item: res, tracker: t.tracker}, nil
+	}
+}
+
+// AckBroadcast is the same as Broadcast but counts every copy sent to the subscribers, the source item is only
+// acknowledged once all of them are done
+func AckBroadcast[T any](cs <-chan Tracked[T], subscribers ...chan<- Tracked[T]) {
+	for v := range cs {
+		if len(subscribers) == 0 {
+			v.tracker.done()
+			continue
+		}
+		v.tracker.add(len(subscribers) - 1)
+		for _, s := range subscribers {
+			s <- v
+		}
+	}
+}
+
+// AckDequeue lifts a dequeue function so that it can be used with Dequeue on tracked items, the item is done once the
+// function succeeds and the source item is negatively acknowledged if it fails
+func AckDequeue[T any](f func(T) error) func(Tracked[T]) error {
+	return func(t Tracked[T]) error {
+		if err := f(t.Item); err != nil {
+			t.tracker.fail(err)
+			return err
+		}
+		t.tracker.done()
+		return nil
+	}
+}
@@ -0,0 +1,114 @@
+package pipelines
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+type mockAckSource struct {
+	mu     sync.Mutex
+	items  []int
+	acked  []int
+	nacked []int
+}
+
+func (m *mockAckSource) Next(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.items) == 0 {
+		return 0, ErrQueueEmpty
+	}
+	v := m.items[0]
+	m.items = m.items[1:]
+	return v, nil
+}
+
+func (m *mockAckSource) Ack(item int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.acked = append(m.acked, item)
+}
+
+func (m *mockAckSource) Nack(item int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nacked = append(m.nacked, item)
+}
+
+func TestAckPipeline(t *testing.T) {
+	ctx := context.Background()
+	src := &mockAckSource{items: []int{1, 2, 3, 4, 5, 6}}
+
+	// Items divisible by 3 are filtered, 5 fails in the worker and 4 fails in the dequeue
+	filter := func(n int) (int, error) {
+		if n%3 == 0 {
+			return 0, nil
+		}
+		if n == 5 {
+			return 0, fmt.Errorf("cannot work on 5")
+		}
+		return n, nil
+	}
+	store := func(n int) error {
+		if n == 4 {
+			return fmt.Errorf("cannot store 4")
+		}
+		return nil
+	}
+
+	queueC, queueErrC := AckQueue[int](ctx, src, 1, 1)
+	filteredC, filterErrC := WorkerPoolWithZeroValueFilter(queueC, AckFilterStage(filter), 1, 2)
+	dequeueErrC := Dequeue(filteredC, AckDequeue(store), 1, 2)
+
+	errorCount := 0
+	for range Merge(queueErrC, filterErrC, dequeueErrC) {
+		errorCount++
+	}
+	if errorCount != 2 {
+		t.Errorf("expected 2 errors, got: %d", errorCount)
+	}
+
+	sort.Ints(src.acked)
+	sort.Ints(src.nacked)
+	if !reflect.DeepEqual(src.acked, []int{1, 2, 3, 6}) {
+		t.Errorf("expected [1 2 3 6] to be acked, got: %v", src.acked)
+	}
+	if !reflect.DeepEqual(src.nacked, []int{4, 5}) {
+		t.Errorf("expected [4 5] to be nacked, got: %v", src.nacked)
+	}
+}
+
+func TestAckBroadcast(t *testing.T) {
+	ctx := context.Background()
+	src := &mockAckSource{items: []int{1, 2}}
+
+	queueC, queueErrC := AckQueue[int](ctx, src, 2, 1)
+	sub1 := make(chan Tracked[int], 2)
+	sub2 := make(chan Tracked[int], 2)
+	AckBroadcast(queueC, sub1, sub2)
+	close(sub1)
+	close(sub2)
+	for range queueErrC {
+		t.Error("expected no errors")
+	}
+
+	// Test that the source item is only acked once every copy is done
+	done := AckDequeue(func(int) error { return nil })
+	for v := range sub1 {
+		_ = done(v)
+	}
+	if len(src.acked) != 0 {
+		t.Errorf("expected no acks before all copies are done, got: %v", src.acked)
+	}
+	for v := range sub2 {
+		_ = done(v)
+	}
+	sort.Ints(src.acked)
+	if !reflect.DeepEqual(src.acked, []int{1, 2}) {
+		t.Errorf("expected [1 2] to be acked, got: %v", src.acked)
+	}
+}
@@ -0,0 +1,203 @@
+package pipelines
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// AdminHandler is an opt-in http.Handler for inspecting and controlling registered pipelines. It is meant to be
+// mounted under a prefix with http.StripPrefix and serves:
+//
+//   - GET / : an HTML page that renders the pipeline graphs with live numbers
+//   - GET /pipelines : a JSON array with the PipelineSnapshot of every registered pipeline
+//   - POST /pipelines/{name}/pause, /resume and /drain : controls a pipeline
+//   - POST /pipelines/{name}/stages/{stage}/pause and /resume : controls a single stage of a pipeline
+type AdminHandler struct {
+	mu        sync.Mutex
+	pipelines []*Pipeline
+}
+
+// NewAdminHandler creates an AdminHandler for the given pipelines, more can be added with Register
+func NewAdminHandler(pipelines ...*Pipeline) *AdminHandler {
+	return &AdminHandler{pipelines: pipelines}
+}
+
+// Register adds a pipeline to the handler, a pipeline with the same name is replaced
+func (h *AdminHandler) Register(p *Pipeline) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, existing := range h.pipelines {
+		if existing.Name() == p.Name() {
+			h.pipelines[i] = p
+			return
+		}
+	}
+	h.pipelines = append(h.pipelines, p)
+}
+
+func (h *AdminHandler) lookup(name string) *Pipeline {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, p := range h.pipelines {
+		if p.Name() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "" || path == "index.html":
+		if r.Method != http.MethodGet {
+			writeAdminJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "only GET is allowed"})
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(adminPage))
+
+	case path == "pipelines":
+		if r.Method != http.MethodGet {
+			writeAdminJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "only GET is allowed"})
+			return
+		}
+		h.mu.Lock()
+		pipelines := append([]*Pipeline(nil), h.pipelines...)
+		h.mu.Unlock()
+		snaps := make([]PipelineSnapshot, 0, len(pipelines))
+		for _, p := range pipelines {
+			snaps = append(snaps, p.Snapshot())
+		}
+		writeAdminJSON(w, http.StatusOK, snaps)
+
+	case strings.HasPrefix(path, "pipelines/"):
+		parts := strings.Split(strings.TrimPrefix(path, "pipelines/"), "/")
+		if len(parts) != 2 && (len(parts) != 4 || parts[1] != "stages") {
+			writeAdminJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeAdminJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "only POST is allowed"})
+			return
+		}
+		p := h.lookup(parts[0])
+		if p == nil {
+			writeAdminJSON(w, http.StatusNotFound, map[string]string{"error": "unknown pipeline " + parts[0]})
+			return
+		}
+		if len(parts) == 4 {
+			var err error
+			switch parts[3] {
+			case "pause":
+				err = p.PauseStage(parts[2])
+			case "resume":
+				err = p.ResumeStage(parts[2])
+			default:
+				writeAdminJSON(w, http.StatusNotFound, map[string]string{"error": "unknown action " + parts[3]})
+				return
+			}
+			if err != nil {
+				writeAdminJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+				return
+			}
+			writeAdminJSON(w, http.StatusOK, p.Snapshot())
+			return
+		}
+		switch parts[1] {
+		case "pause":
+			p.Pause()
+		case "resume":
+			p.Resume()
+		case "drain":
+			p.Drain()
+		default:
+			writeAdminJSON(w, http.StatusNotFound, map[string]string{"error": "unknown action " + parts[1]})
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, p.Snapshot())
+
+	default:
+		writeAdminJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+	}
+}
+
+const adminPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Pipelines</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+.pipeline { margin-bottom: 2em; }
+.graph { display: flex; flex-wrap: wrap; align-items: center; gap: 0.5em; }
+.stage { border: 1px solid #888; border-radius: 6px; padding: 0.5em 0.8em; min-width: 12em; font-size: 0.9em; }
+.stage.done { opacity: 0.5; }
+.stage.paused { border-style: dashed; }
+.stage.errors { border-color: #c33; }
+.arrow { font-size: 1.5em; color: #888; }
+.error { color: #c33; }
+.state { font-size: 0.8em; color: #666; }
+button { margin-right: 0.5em; }
+</style>
+</head>
+<body>
+<h1>Pipelines</h1>
+<div id="pipelines">Loading...</div>
+<script>
+function esc(s) {
+  return String(s).replace(/[&<>"']/g, c => ({"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;"}[c]));
+}
+function chan(label, c) {
+  return c ? "<div>" + label + ": " + c.len + " / " + c.cap + "</div>" : "";
+}
+function stage(p, s) {
+  let cls = "stage" + (s.done ? " done" : "") + (s.paused ? " paused" : "") + (s.errorCount > 0 ? " errors" : "");
+  let html = "<div class='" + cls + "'><b>" + esc(s.name) + "</b> <span class='state'>" + esc(s.kind) + (s.paused ? ", paused" : "") + "</span>";
+  if (s.inputs && s.inputs.length) html += "<div class='state'>from " + s.inputs.map(esc).join(", ") + "</div>";
+  html += "<div>workers: " + s.busy + " busy, " + s.idle + " idle</div>";
+  html += "<div class='state'>" + s.workers.map(esc).join(" ") + "</div>";
+  html += chan("in", s.input) + chan("out", s.output) + chan("errc", s.errors);
+  html += "<div>processed: " + s.processed + " (" + s.throughput.toFixed(1) + "/s)</div>";
+  html += "<div>errors: " + s.errorCount + "</div>";
+  if (s.lastError) html += "<div class='error'>" + esc(s.lastError) + "</div>";
+  if (!s.done) {
+    const args = esc(JSON.stringify(p.name)) + ", " + esc(JSON.stringify(s.name));
+    html += "<div><button onclick='controlStage(" + args + ", \"" + (s.paused ? "resume" : "pause") + "\")'>" + (s.paused ? "Resume" : "Pause") + "</button></div>";
+  }
+  return html + "</div>";
+}
+function control(name, action) {
+  fetch("pipelines/" + encodeURIComponent(name) + "/" + action, {method: "POST"}).then(refresh);
+}
+function controlStage(name, stage, action) {
+  fetch("pipelines/" + encodeURIComponent(name) + "/stages/" + encodeURIComponent(stage) + "/" + action, {method: "POST"}).then(refresh);
+}
+function refresh() {
+  fetch("pipelines").then(r => r.json()).then(pipelines => {
+    let html = "";
+    for (const p of pipelines) {
+      html += "<div class='pipeline'><h2>" + esc(p.name) + " <span class='state'>" + esc(p.status) + "</span></h2>";
+      const n = esc(JSON.stringify(p.name));
+      html += "<div><button onclick='control(" + n + ", \"pause\")'>Pause</button>";
+      html += "<button onclick='control(" + n + ", \"resume\")'>Resume</button>";
+      html += "<button onclick='control(" + n + ", \"drain\")'>Drain</button></div><br>";
+      html += "<div class='graph'>" + (p.stages || []).map(s => stage(p, s)).join("<span class='arrow'>&rarr;</span>") + "</div></div>";
+    }
+    document.getElementById("pipelines").innerHTML = html || "No pipelines registered";
+  });
+}
+refresh();
+setInterval(refresh, 1000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,85 @@
+package pipelines
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminHandler(t *testing.T) {
+	p := NewPipeline("ingest", PipelineOptions{})
+	queue, qErrs := PipelineQueue(context.Background(), func(ctx context.Context) (int, error) {
+		return 1, nil
+	}, 2, 1, p, "source")
+	dErrs := PipelineDequeue(queue, func(v int) error { return nil }, 0, 1, p, "sink")
+
+	h := NewAdminHandler()
+	h.Register(p)
+	server := httptest.NewServer(http.StripPrefix("/admin", h))
+	defer server.Close()
+
+	// Test that the HTML page is served
+	resp, err := http.Get(server.URL + "/admin/")
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("expected the html page, got: %v, %v", resp, err)
+	}
+	resp.Body.Close()
+
+	// Test that the snapshot of every pipeline is served as JSON
+	resp, err = http.Get(server.URL + "/admin/pipelines")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	var snaps []PipelineSnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snaps); err != nil {
+		t.Fatalf("expected valid json, got: %v", err)
+	}
+	resp.Body.Close()
+	if len(snaps) != 1 || snaps[0].Name != "ingest" || len(snaps[0].Stages) != 2 || snaps[0].Stages[1].Inputs[0] != "source" {
+		t.Errorf("expected the ingest pipeline, got: %+v", snaps)
+	}
+
+	post := func(path string) int {
+		resp, err := http.Post(server.URL+path, "", nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Test the controls
+	if status := post("/admin/pipelines/ingest/pause"); status != http.StatusOK || !p.Paused() {
+		t.Errorf("expected the pipeline to be paused, got: %d", status)
+	}
+	if status := post("/admin/pipelines/ingest/resume"); status != http.StatusOK || p.Paused() {
+		t.Errorf("expected the pipeline to be resumed, got: %d", status)
+	}
+	if status := post("/admin/pipelines/ingest/stages/sink/pause"); status != http.StatusOK || !p.Snapshot().Stages[1].Paused {
+		t.Errorf("expected the sink to be paused, got: %d", status)
+	}
+	if status := post("/admin/pipelines/ingest/stages/sink/resume"); status != http.StatusOK || p.Snapshot().Stages[1].Paused {
+		t.Errorf("expected the sink to be resumed, got: %d", status)
+	}
+	if status := post("/admin/pipelines/ingest/stages/unknown/pause"); status != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown stage, got: %d", status)
+	}
+	if status := post("/admin/pipelines/unknown/pause"); status != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown pipeline, got: %d", status)
+	}
+	if status := post("/admin/pipelines/ingest/explode"); status != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown action, got: %d", status)
+	}
+	if status := post("/admin/pipelines"); status != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got: %d", status)
+	}
+	if status := post("/admin/pipelines/ingest/drain"); status != http.StatusOK {
+		t.Errorf("expected the pipeline to drain, got: %d", status)
+	}
+	for range Merge(qErrs, dErrs) {
+	}
+	waitFor(t, "the pipeline to be done", p.Done)
+}
@@ -0,0 +1,299 @@
+package pipelines
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CheckpointSource is a queue source that can report and restore its position, for example the page token of a
+// paginated API. The position has to describe everything returned by Next so far.
+type CheckpointSource[T any] interface {
+	Next(ctx context.Context) (T, error)
+	Position() ([]byte, error)
+	Restore(position []byte) error
+}
+
+// StageState is implemented by stateful stage functions that should be part of a checkpoint
+type StageState interface {
+	Snapshot() ([]byte, error)
+	Restore(state []byte) error
+}
+
+// Checkpoint is a consistent snapshot of the source position and the state of every registered stage
+type Checkpoint struct {
+	ID       uint64            `json:"id"`
+	Time     time.Time         `json:"time"`
+	Position []byte            `json:"position"`
+	Stages   map[string][]byte `json:"stages"`
+}
+
+// CheckpointStore persists checkpoints, Load returns false if no checkpoint has been saved yet
+type CheckpointStore interface {
+	Save(ctx context.Context, cp Checkpoint) error
+	Load(ctx context.Context) (Checkpoint, bool, error)
+}
+
+// CheckpointOptions decides how often the CheckpointCoordinator takes a checkpoint, if both are set a checkpoint is
+// taken when either is reached. If neither is set checkpoints are only taken by calling Checkpoint.
+type CheckpointOptions struct {
+	// Interval is the time between checkpoints
+	Interval time.Duration
+	// EveryN takes a checkpoint after this many items were emitted by the source
+	EveryN int
+}
+
+// CheckpointCoordinator wraps a CheckpointSource and takes checkpoints that match what was actually emitted. It is an
+// AckSource, so it is queued with AckQueue and the stages are lifted with AckStage, AckFilterStage and AckDequeue.
+//
+// When a checkpoint is due the coordinator acts as a barrier: it stops emitting, waits until every item emitted so far
+// has been acknowledged or failed, and only then records the source position and the registered stage states. Failed
+// items are not replayed after a restore. If the source itself implements AckSource acknowledgements are forwarded.
+type CheckpointCoordinator[T any] struct {
+	src   CheckpointSource[T]
+	store CheckpointStore
+	opts  CheckpointOptions
+
+	stagesMu sync.Mutex
+	stages   map[string]StageState
+
+	// emitMu is held while emitting or checkpointing so that no item is emitted during a checkpoint
+	emitMu    sync.Mutex
+	lastID    uint64
+	lastTime  time.Time
+	sinceLast int
+
+	mu       sync.Mutex
+	inFlight int
+	// drained is closed and replaced every time inFlight drops to zero
+	drained chan struct{}
+}
+
+// NewCheckpointCoordinator creates a CheckpointCoordinator, stages are added with Register and a previous checkpoint is
+// applied with Restore before the pipeline is started
+func NewCheckpointCoordinator[T any](src CheckpointSource[T], store CheckpointStore, opts CheckpointOptions) *CheckpointCoordinator[T] {
+	return &CheckpointCoordinator[T]{
+		src:      src,
+		store:    store,
+		opts:     opts,
+		stages:   make(map[string]StageState),
+		lastTime: time.Now(),
+		drained:  make(chan struct{}),
+	}
+}
+
+// Register adds a stateful stage to the checkpoints under the given name, the name has to be stable across restarts
+func (c *CheckpointCoordinator[T]) Register(name string, s StageState) {
+	c.stagesMu.Lock()
+	defer c.stagesMu.Unlock()
+	c.stages[name] = s
+}
+
+// Restore loads the latest checkpoint from the store and restores the source and every registered stage. It returns
+// false if there was no checkpoint to restore.
+func (c *CheckpointCoordinator[T]) Restore(ctx context.Context) (bool, error) {
+	cp, ok, err := c.store.Load(ctx)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := c.src.Restore(cp.Position); err != nil {
+		return false, err
+	}
+
+	c.stagesMu.Lock()
+	defer c.stagesMu.Unlock()
+	for name, s := range c.stages {
+		state, ok := cp.Stages[name]
+		if !ok {
+			continue
+		}
+		if err := s.Restore(state); err != nil {
+			return false, err
+		}
+	}
+	c.lastID = cp.ID
+	return true, nil
+}
+
+// Next emits the next item of the source, taking a checkpoint first if one is due
+func (c *CheckpointCoordinator[T]) Next(ctx context.Context) (T, error) {
+	c.emitMu.Lock()
+	defer c.emitMu.Unlock()
+
+	if c.due() {
+		if err := c.checkpoint(ctx); err != nil {
+			var zero T
+			return zero, err
+		}
+	}
+
+	item, err := c.src.Next(ctx)
+	if err != nil {
+		return item, err
+	}
+	c.sinceLast++
+	c.mu.Lock()
+	c.inFlight++
+	c.mu.Unlock()
+	return item, nil
+}
+
+func (c *CheckpointCoordinator[T]) due() bool {
+	if c.opts.EveryN > 0 && c.sinceLast >= c.opts.EveryN {
+		return true
+	}
+	return c.opts.Interval > 0 && c.sinceLast > 0 && time.Since(c.lastTime) >= c.opts.Interval
+}
+
+// Ack marks an emitted item as done
+func (c *CheckpointCoordinator[T]) Ack(item T) {
+	if as, ok := c.src.(AckSource[T]); ok {
+		as.Ack(item)
+	}
+	c.finish()
+}
+
+// Nack marks an emitted item as failed, it still counts as done for the checkpoint
+func (c *CheckpointCoordinator[T]) Nack(item T, err error) {
+	if as, ok := c.src.(AckSource[T]); ok {
+		as.Nack(item, err)
+	}
+	c.finish()
+}
+
+func (c *CheckpointCoordinator[T]) finish() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight--
+	if c.inFlight <= 0 {
+		close(c.drained)
+		c.drained = make(chan struct{})
+	}
+}
+
+// Checkpoint waits for every emitted item to be done and saves a checkpoint, it blocks the source while doing so
+func (c *CheckpointCoordinator[T]) Checkpoint(ctx context.Context) error {
+	c.emitMu.Lock()
+	defer c.emitMu.Unlock()
+	return c.checkpoint(ctx)
+}
+
+// checkpoint must be called while holding emitMu
+func (c *CheckpointCoordinator[T]) checkpoint(ctx context.Context) error {
+	// Wait for the items before the barrier to drain
+	for {
+		c.mu.Lock()
+		inFlight, drained := c.inFlight, c.drained
+		c.mu.Unlock()
+		if inFlight <= 0 {
+			break
+		}
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	position, err := c.src.Position()
+	if err != nil {
+		return err
+	}
+	cp := Checkpoint{
+		ID:       c.lastID + 1,
+		Time:     time.Now(),
+		Position: position,
+		Stages:   make(map[string][]byte),
+	}
+
+	c.stagesMu.Lock()
+	for name, s := range c.stages {
+		state, err := s.Snapshot()
+		if err != nil {
+			c.stagesMu.Unlock()
+			return err
+		}
+		cp.Stages[name] = state
+	}
+	c.stagesMu.Unlock()
+
+	if err := c.store.Save(ctx, cp); err != nil {
+		return err
+	}
+	c.lastID = cp.ID
+	c.lastTime = cp.Time
+	c.sinceLast = 0
+	return nil
+}
+
+// MemoryCheckpointStore keeps the latest checkpoint in memory, it is meant for tests
+type MemoryCheckpointStore struct {
+	mu  sync.Mutex
+	cp  Checkpoint
+	set bool
+}
+
+func (s *MemoryCheckpointStore) Save(ctx context.Context, cp Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cp = cp
+	s.set = true
+	return nil
+}
+
+func (s *MemoryCheckpointStore) Load(ctx context.Context) (Checkpoint, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cp, s.set, nil
+}
+
+// FileCheckpointStore keeps the latest checkpoint as JSON in a file, it is replaced atomically with a rename so a crash
+// during Save leaves the previous checkpoint in place
+type FileCheckpointStore struct {
+	Path string
+}
+
+func (s FileCheckpointStore) Save(ctx context.Context, cp Checkpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.Path)
+}
+
+func (s FileCheckpointStore) Load(ctx context.Context) (Checkpoint, bool, error) {
+	b, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Checkpoint{}, false, nil
+	}
+	if err != nil {
+		return Checkpoint{}, false, err
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return Checkpoint{}, false, err
+	}
+	return cp, true, nil
+}
@@ -0,0 +1,121 @@
+package pipelines
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// countingSource emits the numbers from its position up to limit
+type countingSource struct {
+	mu    sync.Mutex
+	next  int
+	limit int
+}
+
+func (s *countingSource) Next(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.next >= s.limit {
+		return 0, ErrQueueEmpty
+	}
+	s.next++
+	return s.next, nil
+}
+
+func (s *countingSource) Position() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return []byte(strconv.Itoa(s.next)), nil
+}
+
+func (s *countingSource) Restore(position []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, err := strconv.Atoi(string(position))
+	s.next = n
+	return err
+}
+
+// summingStage keeps a running total of the items it has seen
+type summingStage struct {
+	mu  sync.Mutex
+	sum int
+}
+
+func (s *summingStage) Add(n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sum += n
+	return nil
+}
+
+func (s *summingStage) Snapshot() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return []byte(strconv.Itoa(s.sum)), nil
+}
+
+func (s *summingStage) Restore(state []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, err := strconv.Atoi(string(state))
+	s.sum = n
+	return err
+}
+
+func TestCheckpointCoordinator(t *testing.T) {
+	ctx := context.Background()
+	store := FileCheckpointStore{Path: filepath.Join(t.TempDir(), "checkpoint.json")}
+
+	src := &countingSource{limit: 10}
+	sum := &summingStage{}
+	coord := NewCheckpointCoordinator[int](src, store, CheckpointOptions{EveryN: 4})
+	coord.Register("sum", sum)
+	if ok, err := coord.Restore(ctx); ok || err != nil {
+		t.Fatalf("expected nothing to restore, got: %t, %v", ok, err)
+	}
+
+	queueC, queueErrC := AckQueue[int](ctx, coord, 2, 2)
+	doubledC, doubleErrC := WorkerPool(queueC, AckStage(func(n int) (int, error) { return n, nil }), 2, 2)
+	dequeueErrC := Dequeue(doubledC, AckDequeue(sum.Add), 1, 2)
+	for err := range Merge(queueErrC, doubleErrC, dequeueErrC) {
+		t.Errorf("expected no errors, got: %v", err)
+	}
+
+	// Test that the last checkpoint was taken after 8 items and the stage state matches the position
+	cp, ok, err := store.Load(ctx)
+	if !ok || err != nil {
+		t.Fatalf("expected a checkpoint, got: %t, %v", ok, err)
+	}
+	if cp.ID != 2 || string(cp.Position) != "8" {
+		t.Errorf("expected checkpoint 2 at position 8, got: %d at %s", cp.ID, cp.Position)
+	}
+	if string(cp.Stages["sum"]) != "36" {
+		t.Errorf("expected sum 36 in checkpoint, got: %s", cp.Stages["sum"])
+	}
+
+	// Test that a new coordinator restores the source and stage
+	restoredSrc := &countingSource{limit: 10}
+	restoredSum := &summingStage{}
+	coord = NewCheckpointCoordinator[int](restoredSrc, store, CheckpointOptions{})
+	coord.Register("sum", restoredSum)
+	if ok, err := coord.Restore(ctx); !ok || err != nil {
+		t.Fatalf("expected a restore, got: %t, %v", ok, err)
+	}
+	if restoredSrc.next != 8 || restoredSum.sum != 36 {
+		t.Errorf("expected position 8 and sum 36, got: %d and %d", restoredSrc.next, restoredSum.sum)
+	}
+
+	// Test that a manual checkpoint works with the in memory store
+	mem := &MemoryCheckpointStore{}
+	coord = NewCheckpointCoordinator[int](restoredSrc, mem, CheckpointOptions{})
+	if err := coord.Checkpoint(ctx); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cp, ok, _ := mem.Load(ctx); !ok || string(cp.Position) != "8" {
+		t.Errorf("expected in memory checkpoint at position 8, got: %s", cp.Position)
+	}
+}
@@ -0,0 +1,20 @@
+package pipelines
+
+import "time"
+
+// Clock is the source of time for the stages that are scheduled, it can be replaced in tests to control time
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// RealClock is the Clock backed by the time package
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
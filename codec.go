@@ -0,0 +1,64 @@
+package pipelines
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// Encoder converts an item to bytes
+type Encoder[T any] interface {
+	Encode(T) ([]byte, error)
+}
+
+// Decoder converts bytes to an item
+type Decoder[T any] interface {
+	Decode([]byte) (T, error)
+}
+
+// Codec converts items to and from bytes, it is used wherever items leave the process such as the DurableQueue
+type Codec[T any] interface {
+	Encoder[T]
+	Decoder[T]
+}
+
+// JSONCodec encodes items with encoding/json
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Decode(b []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(b, &v)
+	return v, err
+}
+
+// StringCodec passes lines through as strings without any decoding
+type StringCodec struct{}
+
+func (StringCodec) Encode(v string) ([]byte, error) {
+	return []byte(v), nil
+}
+
+func (StringCodec) Decode(b []byte) (string, error) {
+	return string(b), nil
+}
+
+// GobCodec encodes items with encoding/gob, each item is encoded on its own so it carries its own type information
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec[T]) Decode(b []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v)
+	return v, err
+}
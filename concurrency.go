@@ -2,7 +2,6 @@ package pipelines
 
 import (
 	"context"
-	"errors"
 	"sync"
 )
 
@@ -14,54 +13,7 @@ import (
 // In order to orchestrate the closing of the passed in channels sync.WaitGroup is used to wait for the worker
 // goroutines to be finished.
 func Queue[T any](ctx context.Context, queueFunc func(context.Context) (T, error), bufferSize int, workers int) (<-chan T, <-chan error) {
-	// Sanity check for bufSize if it is too low we will set it as an unbuffered channel
-	if bufferSize < 0 {
-		bufferSize = 0
-	}
-
-	// Sanity check for workers we require at least one
-	if workers < 1 {
-		workers = 1
-	}
-
-	var wg sync.WaitGroup
-	queueChan := make(chan T, bufferSize)
-	errorChan := make(chan error, bufferSize)
-
-	wg.Add(workers)
-
-	// Start as many workers as requested
-	for i := 0; i < workers; i++ {
-		go func() {
-			defer wg.Done() // Remove one from wg as this exits
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					// Default: call the queueFunc for the next results and publish them to the queue or err channel
-					res, err := queueFunc(ctx)
-					if err != nil {
-						if errors.Is(err, ErrQueueEmpty) {
-							return
-						}
-						errorChan <- err
-						continue
-					}
-					queueChan <- res
-				}
-			}
-		}()
-	}
-
-	// Create a go routine that is waiting for all workers, so it can shut down it's channels
-	go func() {
-		wg.Wait()
-		close(queueChan)
-		close(errorChan)
-	}()
-
-	return queueChan, errorChan
+	return QueueWithOptions(ctx, queueFunc, StageOptions{BufferSize: bufferSize, Workers: workers})
 }
 
 // Merge function converts a list of channels to a single channel by starting a goroutine for each inbound channel
@@ -84,6 +36,7 @@ func Merge[T any](cs ...<-chan T) chan T {
 	}
 
 	wg.Add(len(cs))
+	logInfo("Merge", "started", "inputs", len(cs))
 	for _, c := range cs {
 		go output(c)
 	}
@@ -92,6 +45,7 @@ func Merge[T any](cs ...<-chan T) chan T {
 	go func() {
 		wg.Wait()
 		close(out)
+		logInfo("Merge", "channel closed")
 	}()
 
 	return out
@@ -100,17 +54,27 @@ func Merge[T any](cs ...<-chan T) chan T {
 // Broadcast takes results from one channel and sends it on multiple channels, note that if the subscriber channels meet
 // capacity this will be a blocking call
 func Broadcast[T any](cs <-chan T, subscribers ...chan<- T) {
+	logInfo("Broadcast", "started", "subscribers", len(subscribers))
 	for v := range cs {
 		for _, s := range subscribers {
 			s <- v
 		}
 	}
+	logInfo("Broadcast", "input drained")
 }
 
 // WorkerPool takes in a channel of work and runs a work function over it and sends the results to channels. The resulting
 // channels will be buffered based on the passed in buffer size and the amount of routines that are used for this
 // will be equal to the amount of workers passed in.
 func WorkerPool[T1, T2 any](queue <-chan T1, workFunc func(T1) (T2, error), bufferSize int, workers int) (<-chan T2, <-chan error) {
+	return WorkerPoolWithOptions(queue, workFunc, StageOptions{BufferSize: bufferSize, Workers: workers})
+}
+
+// WorkerPoolWithZeroValueFilter takes in a channel of work and runs a work function over it and sends the results to
+// channels. The resulting channels will be buffered based on the passed in buffer size and the amount of routines that
+// are used for this will be equal to the amount of workers passed in. The main differentiation from WorkerPool is that
+// any zero values that are returned from the workFunc are not passed forward as a result but instead dropped.
+func WorkerPoolWithZeroValueFilter[T1 any, T2 comparable](queue <-chan T1, workFunc func(T1) (T2, error), bufferSize int, workers int) (<-chan T2, <-chan error) {
 	// Sanity check to make sure buffer size and workers are at minimum values
 	if bufferSize < 0 {
 		bufferSize = 0
@@ -125,19 +89,25 @@ func WorkerPool[T1, T2 any](queue <-chan T1, workFunc func(T1) (T2, error), buff
 	errc := make(chan error, bufferSize)
 
 	wg.Add(workers)
+	logInfo("WorkerPoolWithZeroValueFilter", "started", "workers", workers)
 	// Create workers that will call the workFunc
 	for i := 0; i < workers; i++ {
-		go func() {
+		go func(worker int) {
+			var zeroValOfT2 T2
 			defer wg.Done()
 			for work := range queue {
 				res, err := workFunc(work)
 				if err != nil {
+					logError("WorkerPoolWithZeroValueFilter", "work function failed", err, "worker", worker)
 					errc <- err
 					continue
 				}
-				out <- res
+				if res != zeroValOfT2 {
+					out <- res
+				}
 			}
-		}()
+			logInfo("WorkerPoolWithZeroValueFilter", "worker exited", "worker", worker, "reason", "input drained")
+		}(i)
 	}
 
 	// Spin up another goroutine to wait until workers are done until closing the channels
@@ -145,16 +115,17 @@ func WorkerPool[T1, T2 any](queue <-chan T1, workFunc func(T1) (T2, error), buff
 		wg.Wait()
 		close(out)
 		close(errc)
+		logInfo("WorkerPoolWithZeroValueFilter", "channels closed")
 	}()
 
 	return out, errc
 }
 
-// WorkerPoolWithZeroValueFilter takes in a channel of work and runs a work function over it and sends the results to
-// channels. The resulting channels will be buffered based on the passed in buffer size and the amount of routines that
-// are used for this will be equal to the amount of workers passed in. The main differentiation from WorkerPool is that
-// any zero values that are returned from the workFunc are not passed forward as a result but instead dropped.
-func WorkerPoolWithZeroValueFilter[T1 any, T2 comparable](queue <-chan T1, workFunc func(T1) (T2, error), bufferSize int, workers int) (<-chan T2, <-chan error) {
+// FlatMap takes in a channel of work and runs a work function over it that can produce any number of results for each
+// item, every result is sent on the resulting channel on its own. The resulting channels will be buffered based on the
+// passed in buffer size and the amount of routines that are used for this will be equal to the amount of workers passed
+// in.
+func FlatMap[T1, T2 any](queue <-chan T1, workFunc func(T1) ([]T2, error), bufferSize int, workers int) (<-chan T2, <-chan error) {
 	// Sanity check to make sure buffer size and workers are at minimum values
 	if bufferSize < 0 {
 		bufferSize = 0
@@ -169,22 +140,24 @@ func WorkerPoolWithZeroValueFilter[T1 any, T2 comparable](queue <-chan T1, workF
 	errc := make(chan error, bufferSize)
 
 	wg.Add(workers)
+	logInfo("FlatMap", "started", "workers", workers)
 	// Create workers that will call the workFunc
 	for i := 0; i < workers; i++ {
-		go func() {
-			var zeroValOfT2 T2
+		go func(worker int) {
 			defer wg.Done()
 			for work := range queue {
 				res, err := workFunc(work)
 				if err != nil {
+					logError("FlatMap", "work function failed", err, "worker", worker)
 					errc <- err
 					continue
 				}
-				if res != zeroValOfT2 {
-					out <- res
+				for _, v := range res {
+					out <- v
 				}
 			}
-		}()
+			logInfo("FlatMap", "worker exited", "worker", worker, "reason", "input drained")
+		}(i)
 	}
 
 	// Spin up another goroutine to wait until workers are done until closing the channels
@@ -192,6 +165,7 @@ func WorkerPoolWithZeroValueFilter[T1 any, T2 comparable](queue <-chan T1, workF
 		wg.Wait()
 		close(out)
 		close(errc)
+		logInfo("FlatMap", "channels closed")
 	}()
 
 	return out, errc
@@ -200,32 +174,5 @@ func WorkerPoolWithZeroValueFilter[T1 any, T2 comparable](queue <-chan T1, workF
 // Dequeue is/are termination worker(s) that end the pipeline. Examples of this may be printing results, storing
 // data to an external source, etc.
 func Dequeue[T any](queue <-chan T, dequeueFunc func(T) error, bufferSize int, workers int) <-chan error {
-	// Sanity check for workers
-	if workers < 1 {
-		workers = 1
-	}
-
-	var wg sync.WaitGroup
-	errChan := make(chan error, bufferSize)
-	wg.Add(workers)
-
-	for i := 0; i < workers; i++ {
-		// Spin up the workers
-		go func() {
-			defer wg.Done()
-			for val := range queue {
-				if err := dequeueFunc(val); err != nil {
-					errChan <- err
-				}
-			}
-		}()
-	}
-
-	// Wait till all workers are done before we close the errChan
-	go func() {
-		wg.Wait()
-		close(errChan)
-	}()
-
-	return errChan
+	return DequeueWithOptions(queue, dequeueFunc, StageOptions{BufferSize: bufferSize, Workers: workers})
 }
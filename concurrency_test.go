@@ -269,6 +269,61 @@ func TestWorkerPoolWithZeroValueFilter(t *testing.T) {
 	}
 }
 
+func TestFlatMap(t *testing.T) {
+	bufferSize := 5
+	workers := 3
+
+	// Test with a workFunc that returns a varying amount of results
+	work := make(chan int, 4)
+	for i := 0; i <= 3; i++ {
+		work <- i
+	}
+	close(work)
+
+	workFunc := func(n int) ([]int, error) {
+		res := make([]int, n)
+		for i := range res {
+			res[i] = n
+		}
+		return res, nil
+	}
+	resultChan, errorChan := FlatMap(work, workFunc, bufferSize, workers)
+	result := make([]int, 0)
+	for v := range resultChan {
+		result = append(result, v)
+	}
+	for range errorChan {
+		t.Error("expected no errors")
+	}
+	sort.Ints(result)
+	expected := []int{1, 2, 2, 3, 3, 3}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %v, got: %v", expected, result)
+	}
+
+	// Test with a workFunc that returns an error
+	work = make(chan int, 5)
+	for i := 1; i <= 5; i++ {
+		work <- i
+	}
+	close(work)
+
+	workFuncErr := func(n int) ([]int, error) {
+		return nil, fmt.Errorf("error occurred")
+	}
+	resultChan, errorChan = FlatMap(work, workFuncErr, bufferSize, workers)
+	if _, ok := <-resultChan; ok {
+		t.Error("expected resultChan to be closed")
+	}
+	errorCount := 0
+	for range errorChan {
+		errorCount++
+	}
+	if errorCount != 5 {
+		t.Errorf("expected 5 errors, got: %d", errorCount)
+	}
+}
+
 func TestDequeue(t *testing.T) {
 	bufferSize := 5
 	workers := 3
@@ -0,0 +1,271 @@
+package pipelines
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"time"
+)
+
+// DedupOptions configures the Dedup stage. The zero value keeps every key forever in an unbounded in memory set, so
+// most callers will want to set at least TTL or MaxKeys.
+type DedupOptions struct {
+	// TTL is how long a key is remembered after it was first seen, a TTL <= 0 means keys never expire
+	TTL time.Duration
+	// MaxKeys caps the amount of keys that are remembered, once reached the least recently seen key is evicted, or the
+	// one seen first if a TTL is set. A value <= 0 means there is no cap. This is ignored in Bloom filter mode.
+	MaxKeys int
+	// BloomFilter switches the stage to use a pair of rotating Bloom filters instead of an exact set. Memory stays
+	// fixed no matter the size of the key space at the cost of occasionally dropping an item that was not a duplicate.
+	// The filters rotate every TTL, or every ExpectedKeys new keys if there is no TTL.
+	BloomFilter bool
+	// ExpectedKeys is the amount of distinct keys expected within one TTL window, used to size the Bloom filter.
+	// Without a TTL it is the amount of most recent keys that are always remembered.
+	ExpectedKeys int
+	// FalsePositiveRate is the acceptable rate of unique items that are wrongly dropped in Bloom filter mode
+	FalsePositiveRate float64
+	// Service, Stage and MetricsHandler are used to report the duplicate count, see DuplicateMetricsHandler
+	Service        string
+	Stage          string
+	MetricsHandler MetricsHandler
+
+	// now allows tests to control time, defaults to time.Now
+	now func() time.Time
+}
+
+// Dedup takes in a channel of work and only passes forward the items whose key, as returned by keyFunc, has not been
+// seen within the configured TTL. Every dropped item is reported to the MetricsHandler if it implements
+// DuplicateMetricsHandler. The deduplication state is shared, so only a single goroutine is used for this stage.
+func Dedup[T any, K comparable](queue <-chan T, keyFunc func(T) K, bufferSize int, opts DedupOptions) <-chan T {
+	// Sanity check for bufSize if it is too low we will set it as an unbuffered channel
+	if bufferSize < 0 {
+		bufferSize = 0
+	}
+	if opts.now == nil {
+		opts.now = time.Now
+	}
+
+	var seen dedupSet[K]
+	if opts.BloomFilter {
+		seen = newBloomDedupSet[K](opts.ExpectedKeys, opts.FalsePositiveRate, opts.TTL)
+	} else {
+		seen = newLRUDedupSet[K](opts.MaxKeys, opts.TTL)
+	}
+
+	// Only report duplicates if the handler supports it
+	dmh, _ := opts.MetricsHandler.(DuplicateMetricsHandler)
+
+	out := make(chan T, bufferSize)
+	go func() {
+		defer close(out)
+		for v := range queue {
+			if seen.Seen(keyFunc(v), opts.now()) {
+				if dmh != nil {
+					dmh.IncrementDuplicateCount(opts.Service, opts.Stage)
+				}
+				continue
+			}
+			out <- v
+		}
+	}()
+
+	return out
+}
+
+// dedupSet records keys and reports if a key has already been recorded at the given time
+type dedupSet[K comparable] interface {
+	Seen(key K, now time.Time) bool
+}
+
+type lruEntry[K comparable] struct {
+	key       K
+	firstSeen time.Time
+}
+
+// lruDedupSet is an exact set of keys that expires keys after ttl and evicts the least recently seen key once it
+// holds more than maxKeys. With a ttl the keys are kept in the order they were first seen instead, which is the order
+// they expire in, so expired keys are dropped from the back on every call.
+type lruDedupSet[K comparable] struct {
+	maxKeys int
+	ttl     time.Duration
+	order   *list.List
+	entries map[K]*list.Element
+}
+
+func newLRUDedupSet[K comparable](maxKeys int, ttl time.Duration) *lruDedupSet[K] {
+	return &lruDedupSet[K]{
+		maxKeys: maxKeys,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[K]*list.Element),
+	}
+}
+
+func (s *lruDedupSet[K]) Seen(key K, now time.Time) bool {
+	if s.ttl > 0 {
+		for oldest := s.order.Back(); oldest != nil; oldest = s.order.Back() {
+			if now.Sub(oldest.Value.(*lruEntry[K]).firstSeen) < s.ttl {
+				break
+			}
+			s.remove(oldest)
+		}
+	}
+
+	if el, ok := s.entries[key]; ok {
+		// Every expired key was removed above, so this is a duplicate
+		if s.ttl <= 0 {
+			s.order.MoveToFront(el)
+		}
+		return true
+	}
+
+	s.entries[key] = s.order.PushFront(&lruEntry[K]{key: key, firstSeen: now})
+	if s.maxKeys > 0 && s.order.Len() > s.maxKeys {
+		s.remove(s.order.Back())
+	}
+	return false
+}
+
+func (s *lruDedupSet[K]) remove(el *list.Element) {
+	s.order.Remove(el)
+	delete(s.entries, el.Value.(*lruEntry[K]).key)
+}
+
+// bloomDedupSet approximates a set of keys with two Bloom filters. New keys are added to current, and every ttl the
+// filters rotate so keys are remembered for at least one and at most two ttl periods. Without a ttl they rotate once
+// current holds expectedKeys keys, so the filters never fill up past the size they were made for.
+type bloomDedupSet[K comparable] struct {
+	ttl          time.Duration
+	expectedKeys int
+	rotatedAt    time.Time
+	added        int
+	current      *bloomFilter
+	previous     *bloomFilter
+	// buf is reused to encode the keys
+	buf []byte
+}
+
+func newBloomDedupSet[K comparable](expectedKeys int, falsePositiveRate float64, ttl time.Duration) *bloomDedupSet[K] {
+	if expectedKeys < 1 {
+		expectedKeys = 1000
+	}
+	return &bloomDedupSet[K]{
+		ttl:          ttl,
+		expectedKeys: expectedKeys,
+		current:      newBloomFilter(expectedKeys, falsePositiveRate),
+		previous:     newBloomFilter(expectedKeys, falsePositiveRate),
+	}
+}
+
+func (s *bloomDedupSet[K]) Seen(key K, now time.Time) bool {
+	if s.rotatedAt.IsZero() {
+		s.rotatedAt = now
+	}
+	if (s.ttl > 0 && now.Sub(s.rotatedAt) >= s.ttl) || (s.ttl <= 0 && s.added >= s.expectedKeys) {
+		s.previous, s.current = s.current, s.previous
+		s.current.reset()
+		s.rotatedAt = now
+		s.added = 0
+	}
+
+	s.buf = appendKey(s.buf[:0], key)
+	if s.current.contains(s.buf) || s.previous.contains(s.buf) {
+		return true
+	}
+	s.current.add(s.buf)
+	s.added++
+	return false
+}
+
+// appendKey appends a binary encoding of key to b. Strings and integers are encoded directly, every other type falls
+// back to its type and Go syntax representation. The first byte tells the types apart so keys of different types never
+// collide.
+func appendKey(b []byte, key any) []byte {
+	switch k := key.(type) {
+	case string:
+		return append(append(b, 's'), k...)
+	case int:
+		return binary.BigEndian.AppendUint64(append(b, 'i'), uint64(k))
+	case int64:
+		return binary.BigEndian.AppendUint64(append(b, 'l'), uint64(k))
+	case int32:
+		return binary.BigEndian.AppendUint32(append(b, 'j'), uint32(k))
+	case uint:
+		return binary.BigEndian.AppendUint64(append(b, 'u'), uint64(k))
+	case uint64:
+		return binary.BigEndian.AppendUint64(append(b, 'U'), k)
+	case uint32:
+		return binary.BigEndian.AppendUint32(append(b, 'w'), k)
+	default:
+		return fmt.Appendf(append(b, 'v'), "%T %#v", key, key)
+	}
+}
+
+// bloomFilter is a fixed size Bloom filter using double hashing to derive its hash functions
+type bloomFilter struct {
+	bits   []uint64
+	m      uint64
+	hashes uint64
+}
+
+// newBloomFilter sizes a filter for n keys at a false positive rate of p
+func newBloomFilter(n int, p float64) *bloomFilter {
+	// Sanity check the inputs so the filter is always usable
+	if n < 1 {
+		n = 1000
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+
+	return &bloomFilter{
+		bits:   make([]uint64, (m+63)/64),
+		m:      m,
+		hashes: k,
+	}
+}
+
+func (bf *bloomFilter) locations(b []byte) (uint64, uint64) {
+	h1 := fnv.New64a()
+	_, _ = h1.Write(b)
+	h2 := fnv.New64()
+	_, _ = h2.Write(b)
+	// Force the second hash to be odd so it never collapses all locations onto one bit
+	return h1.Sum64(), h2.Sum64() | 1
+}
+
+func (bf *bloomFilter) add(b []byte) {
+	h1, h2 := bf.locations(b)
+	for i := uint64(0); i < bf.hashes; i++ {
+		bit := (h1 + i*h2) % bf.m
+		bf.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (bf *bloomFilter) contains(b []byte) bool {
+	h1, h2 := bf.locations(b)
+	for i := uint64(0); i < bf.hashes; i++ {
+		bit := (h1 + i*h2) % bf.m
+		if bf.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (bf *bloomFilter) reset() {
+	for i := range bf.bits {
+		bf.bits[i] = 0
+	}
+}
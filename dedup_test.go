@@ -0,0 +1,169 @@
+package pipelines
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type mockDuplicateMetricHandler struct {
+	mockMetricHandler
+	duplicateCount int
+}
+
+func (mmh *mockDuplicateMetricHandler) IncrementDuplicateCount(service string, stage string) {
+	mmh.duplicateCount++
+}
+
+func TestDedup(t *testing.T) {
+	// Test that repeated keys are dropped and reported to the metrics handler
+	mh := &mockDuplicateMetricHandler{}
+	queue := ConvertSliceToClosedChannel([]int{1, 2, 1, 3, 2, 4})
+	out := Dedup(queue, func(v int) int { return v }, 1, DedupOptions{
+		Service:        "service",
+		Stage:          "dedup",
+		MetricsHandler: mh,
+	})
+	result := make([]int, 0)
+	for v := range out {
+		result = append(result, v)
+	}
+	expected := []int{1, 2, 3, 4}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %v, got: %v", expected, result)
+	}
+	if mh.duplicateCount != 2 {
+		t.Errorf("expected 2 duplicates, got: %d", mh.duplicateCount)
+	}
+
+	// Test that a plain MetricsHandler without duplicate support is accepted
+	queue = ConvertSliceToClosedChannel([]int{1, 1})
+	out = Dedup(queue, func(v int) int { return v }, 0, DedupOptions{MetricsHandler: &mockMetricHandler{}})
+	count := 0
+	for range out {
+		count++
+	}
+	if count != 1 {
+		t.Errorf("expected 1 item, got: %d", count)
+	}
+
+	// Test that keys expire after the TTL
+	now := time.Unix(0, 0)
+	times := []time.Time{now, now.Add(time.Second), now.Add(3 * time.Second)}
+	calls := 0
+	strQueue := ConvertSliceToClosedChannel([]string{"a", "a", "a"})
+	strOut := Dedup(strQueue, func(v string) string { return v }, 0, DedupOptions{
+		TTL: 2 * time.Second,
+		now: func() time.Time {
+			t := times[calls]
+			calls++
+			return t
+		},
+	})
+	count = 0
+	for range strOut {
+		count++
+	}
+	if count != 2 {
+		t.Errorf("expected 2 items after expiry, got: %d", count)
+	}
+}
+
+func TestLRUDedupSet(t *testing.T) {
+	now := time.Now()
+	s := newLRUDedupSet[string](2, 0)
+
+	s.Seen("a", now)
+	s.Seen("b", now)
+	// Touch a so that b is the least recently seen
+	if !s.Seen("a", now) {
+		t.Error("expected a to be seen")
+	}
+	s.Seen("c", now)
+	if len(s.entries) != 2 {
+		t.Errorf("expected 2 entries, got: %d", len(s.entries))
+	}
+	if s.Seen("b", now) {
+		t.Error("expected b to have been evicted")
+	}
+
+	// Test that expired keys are evicted without being seen again
+	s = newLRUDedupSet[string](0, time.Second)
+	for i := 0; i < 100; i++ {
+		s.Seen(fmt.Sprint(i), now)
+	}
+	if !s.Seen("0", now.Add(time.Second/2)) {
+		t.Error("expected 0 to be seen within the ttl")
+	}
+	s.Seen("new", now.Add(time.Second))
+	if len(s.entries) != 1 || s.order.Len() != 1 {
+		t.Errorf("expected the expired keys to be evicted, got: %d entries", len(s.entries))
+	}
+	if s.Seen("0", now.Add(time.Second)) {
+		t.Error("expected 0 to have expired")
+	}
+}
+
+func TestBloomDedupSet(t *testing.T) {
+	now := time.Now()
+	s := newBloomDedupSet[int](1000, 0.01, time.Minute)
+
+	for i := 0; i < 1000; i++ {
+		s.Seen(i, now)
+	}
+	for i := 0; i < 1000; i++ {
+		if !s.Seen(i, now) {
+			t.Fatalf("expected %d to be seen", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 1000; i < 11000; i++ {
+		if s.current.contains(appendKey(nil, i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / 10000; rate > 0.03 {
+		t.Errorf("expected false positive rate near 0.01, got: %f", rate)
+	}
+
+	// After two rotations every key is forgotten
+	s.Seen(-1, now.Add(time.Minute))
+	s.Seen(-2, now.Add(2*time.Minute))
+	if s.Seen(1, now.Add(2*time.Minute)) {
+		t.Error("expected 1 to be forgotten after two ttl periods")
+	}
+
+	// Test that without a TTL the filters rotate before they are saturated
+	s = newBloomDedupSet[int](100, 0.01, 0)
+	var added []int
+	for i := 0; i < 100000; i++ {
+		if !s.Seen(i, now) {
+			added = append(added, i)
+		}
+	}
+	for _, i := range added[len(added)-100:] {
+		if !s.Seen(i, now) {
+			t.Fatalf("expected the recently added key %d to be seen", i)
+		}
+	}
+	falsePositives = 0
+	for i := 200000; i < 210000; i++ {
+		if s.Seen(i, now) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / 10000; rate > 0.1 {
+		t.Errorf("expected the filters not to saturate, got a false positive rate of: %f", rate)
+	}
+
+	// Test that keys of different types do not collide
+	mixed := newBloomDedupSet[any](1000, 0.01, 0)
+	mixed.Seen(1, now)
+	if mixed.Seen("1", now) || mixed.Seen(uint(1), now) || mixed.Seen(1.0, now) || mixed.Seen(int64(1), now) ||
+		mixed.Seen(uint64(1), now) || mixed.Seen(int32(1), now) || mixed.Seen(uint32(1), now) || mixed.Seen(int8(1), now) ||
+		mixed.Seen(int16(1), now) {
+		t.Error("expected keys of different types to be distinct")
+	}
+}
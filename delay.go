@@ -0,0 +1,483 @@
+package pipelines
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var ErrDelayQueueFull = fmt.Errorf("delay queue is full")
+
+var ErrDelayQueueClosed = fmt.Errorf("delay queue is closed")
+
+var ErrCorruptDelayLog = fmt.Errorf("delay queue log is corrupt")
+
+const (
+	delayLogFile = "delay.log"
+	// delayCompactMin is the amount of records the log needs before it is compacted
+	delayCompactMin = 1024
+)
+
+// DelayQueueOptions configures a DelayQueue
+type DelayQueueOptions struct {
+	// Capacity is the most items that can be scheduled or released but not acknowledged at once, defaults to 10000
+	Capacity int
+	// Clock is the source of time, defaults to RealClock
+	Clock Clock
+}
+
+// DelayedItem is an item held by a DelayQueue until NotBefore
+type DelayedItem[T any] struct {
+	// ID is used to acknowledge the item once it is released
+	ID        uint64
+	Item      T
+	NotBefore time.Time
+	// Attempt is 1 for an item that was scheduled and goes up every time it is rescheduled
+	Attempt int
+	// Err is the error the item was scheduled with. A PipelineErr keeps its service, stage and envelope ID when the
+	// queue is persisted, other errors keep their message.
+	Err error
+}
+
+// delayRecord is written to the log when an item is scheduled or acknowledged
+type delayRecord struct {
+	ID         uint64    `json:"id"`
+	Acked      bool      `json:"acked,omitempty"`
+	NotBefore  time.Time `json:"notBefore,omitempty"`
+	Attempt    int       `json:"attempt,omitempty"`
+	Item       []byte    `json:"item,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Service    string    `json:"service,omitempty"`
+	Stage      string    `json:"stage,omitempty"`
+	EnvelopeID string    `json:"envelopeId,omitempty"`
+}
+
+type delayHeap[T any] []DelayedItem[T]
+
+func (h delayHeap[T]) Len() int { return len(h) }
+func (h delayHeap[T]) Less(i, j int) bool {
+	if !h[i].NotBefore.Equal(h[j].NotBefore) {
+		return h[i].NotBefore.Before(h[j].NotBefore)
+	}
+	return h[i].ID < h[j].ID
+}
+func (h delayHeap[T]) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *delayHeap[T]) Push(x any)   { *h = append(*h, x.(DelayedItem[T])) }
+func (h *delayHeap[T]) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// DelayQueue holds items until their not before time and then releases them, for example to retry failed items minutes
+// later without blocking a worker. Items are kept in a heap ordered by their not before time and the queue is bounded,
+// Schedule returns ErrDelayQueueFull once Capacity items are held.
+//
+// Next releases the next due item and has the signature of a queue function so it can be used with Queue. A released
+// item still counts towards the capacity until it is acknowledged with Ack or rescheduled with Reschedule. When the
+// queue is opened with OpenDelayQueue every change is appended to a log on disk, items that were scheduled or released
+// but not acknowledged before a restart are scheduled again.
+//
+//	q, err := OpenDelayQueue[Order](dir, JSONCodec[Order]{}, DelayQueueOptions{})
+//	storeErrC := Dequeue(ordersC, q.ScheduleOnError(store, time.Minute), 1, 4)
+//	retryC, retryQueueErrC := Queue(ctx, q.Next, 1, 1)
+//	retryErrC := Dequeue(retryC, q.RetryDequeue(store, func(int) time.Duration { return 5 * time.Minute }, 5), 1, 1)
+type DelayQueue[T any] struct {
+	codec Codec[T]
+	opts  DelayQueueOptions
+	path  string
+
+	mu       sync.Mutex
+	pending  delayHeap[T]
+	released map[uint64]DelayedItem[T]
+	nextID   uint64
+	closed   bool
+	// notify is closed and replaced every time an item is scheduled or the queue is closed
+	notify chan struct{}
+
+	log     *os.File
+	records int
+}
+
+// NewDelayQueue creates a DelayQueue that is only kept in memory
+func NewDelayQueue[T any](opts DelayQueueOptions) *DelayQueue[T] {
+	if opts.Capacity <= 0 {
+		opts.Capacity = 10000
+	}
+	if opts.Clock == nil {
+		opts.Clock = RealClock{}
+	}
+	return &DelayQueue[T]{
+		opts:     opts,
+		released: make(map[uint64]DelayedItem[T]),
+		notify:   make(chan struct{}),
+	}
+}
+
+// OpenDelayQueue opens or creates a DelayQueue persisted in dir. A torn record at the end of the log is dropped, a
+// corrupt record anywhere else returns ErrCorruptDelayLog.
+func OpenDelayQueue[T any](dir string, codec Codec[T], opts DelayQueueOptions) (*DelayQueue[T], error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	q := NewDelayQueue[T](opts)
+	q.codec = codec
+	q.path = filepath.Join(dir, delayLogFile)
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	// Rewriting the log right away drops the acknowledged items and any torn record at the end
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// load replays the log, the items that were not acknowledged are scheduled again
+func (q *DelayQueue[T]) load() error {
+	f, err := os.Open(q.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	items := make(map[uint64]DelayedItem[T])
+	r := bufio.NewReader(f)
+	for {
+		payload, err := readRecord(r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// Only the last record can be torn as records are only ever appended
+			if _, next := readRecord(r); !errors.Is(next, io.EOF) {
+				return fmt.Errorf("%w: %s: %v", ErrCorruptDelayLog, q.path, err)
+			}
+			break
+		}
+		var rec delayRecord
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrCorruptDelayLog, q.path, err)
+		}
+		if rec.ID >= q.nextID {
+			q.nextID = rec.ID + 1
+		}
+		if rec.Acked {
+			delete(items, rec.ID)
+			continue
+		}
+		item, err := q.codec.Decode(rec.Item)
+		if err != nil {
+			return err
+		}
+		items[rec.ID] = DelayedItem[T]{ID: rec.ID, Item: item, NotBefore: rec.NotBefore, Attempt: rec.Attempt, Err: rec.err()}
+	}
+	for _, d := range items {
+		heap.Push(&q.pending, d)
+	}
+	return nil
+}
+
+// err restores the error of a record, keeping the PipelineErr context
+func (rec delayRecord) err() error {
+	if rec.Error == "" {
+		return nil
+	}
+	err := errors.New(rec.Error)
+	if rec.Service == "" && rec.Stage == "" && rec.EnvelopeID == "" {
+		return err
+	}
+	pErr := NewPipelineErr(err, rec.Service, rec.Stage)
+	pErr.envelopeID = rec.EnvelopeID
+	return pErr
+}
+
+// newDelayRecord encodes a scheduled item, the PipelineErr context of its error is kept
+func (q *DelayQueue[T]) newDelayRecord(d DelayedItem[T]) (delayRecord, error) {
+	payload, err := q.codec.Encode(d.Item)
+	if err != nil {
+		return delayRecord{}, err
+	}
+	rec := delayRecord{ID: d.ID, NotBefore: d.NotBefore, Attempt: d.Attempt, Item: payload}
+	if d.Err != nil {
+		rec.Error = d.Err.Error()
+		var pErr PipelineErr
+		if errors.As(d.Err, &pErr) {
+			rec.Error, rec.Service, rec.Stage, rec.EnvelopeID = pErr.err.Error(), pErr.service, pErr.stage, pErr.envelopeID
+		} else if ep, ok := d.Err.(ErrPipeline); ok {
+			rec.Service, rec.Stage = ep.Service(), ep.Stage()
+		}
+	}
+	return rec, nil
+}
+
+// append writes records to the log, must be called while holding mu. The records are written before the change is made
+// in memory, so a change that could not be written is not made.
+func (q *DelayQueue[T]) append(recs ...delayRecord) error {
+	if q.log == nil {
+		return nil
+	}
+	var buf []byte
+	for _, rec := range recs {
+		payload, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, encodeRecord(payload)...)
+	}
+	if _, err := q.log.Write(buf); err != nil {
+		return err
+	}
+	q.records += len(recs)
+	return q.log.Sync()
+}
+
+// maybeCompact compacts the log once most of its records are of acknowledged items, it is called after a change was
+// made in memory as compact writes what is in memory. Must be called while holding mu.
+func (q *DelayQueue[T]) maybeCompact() error {
+	if live := len(q.pending) + len(q.released); q.log != nil && q.records >= delayCompactMin && q.records > 2*live {
+		return q.compact()
+	}
+	return nil
+}
+
+// compact rewrites the log with only the items that are not acknowledged, by writing a temp file and renaming it
+func (q *DelayQueue[T]) compact() error {
+	tmp := q.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	records := 0
+	write := func(d DelayedItem[T]) error {
+		rec, err := q.newDelayRecord(d)
+		if err != nil {
+			return err
+		}
+		payload, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		records++
+		_, err = w.Write(encodeRecord(payload))
+		return err
+	}
+	for _, d := range q.pending {
+		if err := write(d); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	for _, d := range q.released {
+		if err := write(d); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		return err
+	}
+
+	if q.log != nil {
+		q.log.Close()
+	}
+	q.log, err = os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	q.records = records
+	return nil
+}
+
+// wake notifies any reader waiting in Next, must be called while holding mu
+func (q *DelayQueue[T]) wake() {
+	close(q.notify)
+	q.notify = make(chan struct{})
+}
+
+// add schedules an item and acknowledges the one it replaces if any, must be called while holding mu
+func (q *DelayQueue[T]) add(d DelayedItem[T], replaces *uint64) error {
+	if q.closed {
+		return ErrDelayQueueClosed
+	}
+	held := len(q.pending) + len(q.released)
+	if replaces != nil {
+		if _, ok := q.released[*replaces]; ok {
+			held--
+		}
+	}
+	if held >= q.opts.Capacity {
+		return ErrDelayQueueFull
+	}
+
+	d.ID = q.nextID
+	var recs []delayRecord
+	if q.log != nil {
+		rec, err := q.newDelayRecord(d)
+		if err != nil {
+			return err
+		}
+		recs = append(recs, rec)
+	}
+	if replaces != nil {
+		recs = append(recs, delayRecord{ID: *replaces, Acked: true})
+	}
+	if err := q.append(recs...); err != nil {
+		return err
+	}
+	q.nextID++
+	heap.Push(&q.pending, d)
+	if replaces != nil {
+		delete(q.released, *replaces)
+	}
+	q.wake()
+	return q.maybeCompact()
+}
+
+// Schedule holds the item until notBefore, err is the error the item failed with and may be nil
+func (q *DelayQueue[T]) Schedule(item T, notBefore time.Time, err error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.add(DelayedItem[T]{Item: item, NotBefore: notBefore, Attempt: 1, Err: err}, nil)
+}
+
+// Reschedule acknowledges a released item and holds it again until notBefore with the next attempt
+func (q *DelayQueue[T]) Reschedule(d DelayedItem[T], notBefore time.Time, err error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	id := d.ID
+	return q.add(DelayedItem[T]{Item: d.Item, NotBefore: notBefore, Attempt: d.Attempt + 1, Err: err}, &id)
+}
+
+// Next blocks until the earliest item is due and releases it, it has the signature of a queue function so it can be
+// used with Queue. Once the queue is closed it returns ErrQueueEmpty.
+func (q *DelayQueue[T]) Next(ctx context.Context) (DelayedItem[T], error) {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return DelayedItem[T]{}, ErrQueueEmpty
+		}
+		notify := q.notify
+		var due <-chan time.Time
+		if len(q.pending) > 0 {
+			now := q.opts.Clock.Now()
+			if next := q.pending[0]; !next.NotBefore.After(now) {
+				heap.Pop(&q.pending)
+				q.released[next.ID] = next
+				q.mu.Unlock()
+				return next, nil
+			}
+			due = q.opts.Clock.After(q.pending[0].NotBefore.Sub(now))
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-due:
+		case <-notify:
+		case <-ctx.Done():
+			return DelayedItem[T]{}, ctx.Err()
+		}
+	}
+}
+
+// Ack marks a released item as done so it is not scheduled again after a restart, it returns ErrDelayQueueClosed once
+// the queue is closed
+func (q *DelayQueue[T]) Ack(id uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrDelayQueueClosed
+	}
+	if _, ok := q.released[id]; !ok {
+		return nil
+	}
+	if err := q.append(delayRecord{ID: id, Acked: true}); err != nil {
+		return err
+	}
+	delete(q.released, id)
+	return q.maybeCompact()
+}
+
+// ScheduleOnError wraps a dequeue function so an item it fails on is scheduled to be retried after the delay. The error
+// is still returned so it is reported, along with ErrDelayQueueFull if the item could not be scheduled.
+func (q *DelayQueue[T]) ScheduleOnError(f func(T) error, delay time.Duration) func(T) error {
+	return func(v T) error {
+		err := f(v)
+		if err == nil {
+			return nil
+		}
+		if serr := q.Schedule(v, q.opts.Clock.Now().Add(delay), err); serr != nil {
+			return errors.Join(err, serr)
+		}
+		return err
+	}
+}
+
+// RetryDequeue wraps a dequeue function that takes released items. The item is acknowledged once the function
+// succeeds, and rescheduled after backoff(attempt) when it fails until maxAttempts is reached. The error is returned
+// either way so it is reported.
+func (q *DelayQueue[T]) RetryDequeue(f func(T) error, backoff func(attempt int) time.Duration, maxAttempts int) func(DelayedItem[T]) error {
+	return func(d DelayedItem[T]) error {
+		err := f(d.Item)
+		if err == nil {
+			return q.Ack(d.ID)
+		}
+		if d.Attempt >= maxAttempts {
+			return errors.Join(err, q.Ack(d.ID))
+		}
+		if serr := q.Reschedule(d, q.opts.Clock.Now().Add(backoff(d.Attempt)), err); serr != nil {
+			return errors.Join(err, serr)
+		}
+		return err
+	}
+}
+
+// Len returns the amount of items that are scheduled or released but not acknowledged
+func (q *DelayQueue[T]) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending) + len(q.released)
+}
+
+// Close stops the queue, Next returns ErrQueueEmpty, Schedule, Reschedule and Ack return ErrDelayQueueClosed and the
+// items that are held stay in the log
+func (q *DelayQueue[T]) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	q.wake()
+	if q.log == nil {
+		return nil
+	}
+	err := q.log.Close()
+	q.log = nil
+	return err
+}
@@ -0,0 +1,208 @@
+package pipelines
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// nextDelayed releases the next item of the queue, advancing the clock until it is due
+func nextDelayed[T any](t *testing.T, q *DelayQueue[T], clock *fakeClock, advance time.Duration) DelayedItem[T] {
+	t.Helper()
+	result := make(chan DelayedItem[T], 1)
+	go func() {
+		d, err := q.Next(context.Background())
+		if err != nil {
+			t.Errorf("expected no error, got: %v", err)
+		}
+		result <- d
+	}()
+	if advance > 0 {
+		clock.waitForWaiters()
+		clock.Advance(advance)
+	}
+	select {
+	case d := <-result:
+		return d
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for an item")
+		return DelayedItem[T]{}
+	}
+}
+
+func TestDelayQueue(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := newFakeClock(start)
+	q := NewDelayQueue[string](DelayQueueOptions{Capacity: 3, Clock: clock})
+
+	// Test that items are released in the order they are due, not the order they were scheduled in
+	for i, name := range []string{"b", "a", "c"} {
+		if err := q.Schedule(name, start.Add(time.Duration([]int{2, 1, 3}[i])*time.Minute), nil); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	if err := q.Schedule("d", start, nil); !errors.Is(err, ErrDelayQueueFull) {
+		t.Errorf("expected the queue to be full, got: %v", err)
+	}
+	first := nextDelayed(t, q, clock, time.Minute)
+	if first.Item != "a" || first.Attempt != 1 {
+		t.Errorf("expected a to be released first, got: %+v", first)
+	}
+
+	// Test that released items hold their place until they are acknowledged
+	if err := q.Schedule("d", start, nil); !errors.Is(err, ErrDelayQueueFull) {
+		t.Errorf("expected the queue to be full, got: %v", err)
+	}
+	_ = q.Ack(first.ID)
+	if err := q.Schedule("d", start, nil); err != nil || q.Len() != 3 {
+		t.Errorf("expected room after the ack, got: %v, %d", err, q.Len())
+	}
+
+	// Test that an item that is already due is released right away
+	if d := nextDelayed(t, q, clock, 0); d.Item != "d" {
+		t.Errorf("expected d, got: %+v", d)
+	}
+	b := nextDelayed(t, q, clock, time.Minute)
+	if b.Item != "b" {
+		t.Errorf("expected b, got: %+v", b)
+	}
+
+	// Test that a scheduled item wakes a waiting reader and a closed queue is empty
+	result := make(chan string, 1)
+	go func() {
+		d, _ := q.Next(context.Background())
+		result <- d.Item
+	}()
+	clock.waitForWaiters()
+	_ = q.Ack(b.ID)
+	_ = q.Schedule("e", start, nil)
+	if item := <-result; item != "e" {
+		t.Errorf("expected e to be released, got: %s", item)
+	}
+	_ = q.Close()
+	if _, err := q.Next(context.Background()); !errors.Is(err, ErrQueueEmpty) {
+		t.Errorf("expected ErrQueueEmpty, got: %v", err)
+	}
+	if err := q.Schedule("f", start, nil); !errors.Is(err, ErrDelayQueueClosed) {
+		t.Errorf("expected ErrDelayQueueClosed, got: %v", err)
+	}
+}
+
+func TestDelayQueuePersistence(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := newFakeClock(start)
+	q, err := OpenDelayQueue[int](dir, JSONCodec[int]{}, DelayQueueOptions{Clock: clock})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// Test that a failed item keeps its service and stage when it is scheduled through the wrappers
+	store := DequeueFunctionErrWrapper(func(v int) error { return fmt.Errorf("store %d failed", v) }, "service", "store")
+	if err := q.ScheduleOnError(store, time.Minute)(1); err == nil {
+		t.Errorf("expected the error to be returned")
+	}
+	_ = q.Schedule(2, start.Add(time.Hour), fmt.Errorf("plain"))
+	released := nextDelayed(t, q, clock, time.Minute)
+	if released.Item != 1 {
+		t.Fatalf("expected 1 to be released, got: %+v", released)
+	}
+	_ = q.Close()
+
+	// Test that items that were not acknowledged survive a restart with their error context, a torn write is dropped
+	f, _ := os.OpenFile(filepath.Join(dir, delayLogFile), os.O_WRONLY|os.O_APPEND, 0o644)
+	_, _ = f.Write([]byte{0, 0, 0, 9, 1})
+	f.Close()
+	q, err = OpenDelayQueue[int](dir, JSONCodec[int]{}, DelayQueueOptions{Clock: clock})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if q.Len() != 2 {
+		t.Fatalf("expected 2 items, got: %d", q.Len())
+	}
+	d := nextDelayed(t, q, clock, 0)
+	var ep ErrPipeline
+	if d.Item != 1 || !errors.As(d.Err, &ep) || ep.Service() != "service" || ep.Stage() != "store" || d.Err.Error() != "store 1 failed" {
+		t.Errorf("expected the item with its PipelineErr, got: %+v", d)
+	}
+
+	// Test that a failing retry is rescheduled until it runs out of attempts
+	retry := q.RetryDequeue(store, func(attempt int) time.Duration { return time.Duration(attempt) * time.Minute }, 2)
+	if err := retry(d); err == nil || q.Len() != 2 {
+		t.Errorf("expected the item to be rescheduled, got: %v, %d", err, q.Len())
+	}
+	d = nextDelayed(t, q, clock, time.Minute)
+	if d.Item != 1 || d.Attempt != 2 {
+		t.Errorf("expected the second attempt, got: %+v", d)
+	}
+	if err := retry(d); err == nil || q.Len() != 1 {
+		t.Errorf("expected the item to be dropped, got: %v, %d", err, q.Len())
+	}
+	_ = q.Close()
+
+	// Test that acknowledged items are gone after a restart
+	q, err = OpenDelayQueue[int](dir, JSONCodec[int]{}, DelayQueueOptions{Clock: clock})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer q.Close()
+	if q.Len() != 1 {
+		t.Errorf("expected a single item, got: %d", q.Len())
+	}
+	if d := nextDelayed(t, q, clock, time.Hour); d.Item != 2 || d.Err.Error() != "plain" {
+		t.Errorf("expected the plain error to be kept, got: %+v", d)
+	}
+}
+
+func TestDelayQueueWriteFailures(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := newFakeClock(start)
+	q, err := OpenDelayQueue[int](dir, JSONCodec[int]{}, DelayQueueOptions{Clock: clock})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	_ = q.Schedule(1, start, nil)
+	d := nextDelayed(t, q, clock, 0)
+
+	// Test that a change that could not be written to the log is not made in memory
+	q.mu.Lock()
+	_ = q.log.Close()
+	q.mu.Unlock()
+	if err := q.Reschedule(d, start, fmt.Errorf("failed")); err == nil {
+		t.Error("expected the reschedule to fail")
+	}
+	if err := q.Schedule(2, start, nil); err == nil {
+		t.Error("expected the schedule to fail")
+	}
+	if err := q.Ack(d.ID); err == nil {
+		t.Error("expected the ack to fail")
+	}
+	if _, ok := q.released[d.ID]; !ok || len(q.pending) != 0 || q.Len() != 1 {
+		t.Errorf("expected the released item to be kept, got: %d pending, %v", len(q.pending), q.released)
+	}
+
+	// Test that a closed queue rejects acks and keeps its items
+	_ = q.Close()
+	if err := q.Ack(d.ID); !errors.Is(err, ErrDelayQueueClosed) {
+		t.Errorf("expected ErrDelayQueueClosed, got: %v", err)
+	}
+	if err := q.Reschedule(d, start, nil); !errors.Is(err, ErrDelayQueueClosed) {
+		t.Errorf("expected ErrDelayQueueClosed, got: %v", err)
+	}
+	if q.log != nil || q.Len() != 1 {
+		t.Errorf("expected the log to be released and the item kept, got: %d", q.Len())
+	}
+	q, err = OpenDelayQueue[int](dir, JSONCodec[int]{}, DelayQueueOptions{Clock: clock})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer q.Close()
+	if d := nextDelayed(t, q, clock, 0); d.Item != 1 || d.Attempt != 1 {
+		t.Errorf("expected the first attempt of 1 after a restart, got: %+v", d)
+	}
+}
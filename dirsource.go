@@ -0,0 +1,282 @@
+package pipelines
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DirSourceOptions configures a DirSource
+type DirSourceOptions struct {
+	// Pattern is the glob the file names have to match, see filepath.Match. Defaults to "*".
+	Pattern string
+	// Watch keeps polling the directory for new files instead of returning ErrQueueEmpty once every file is emitted
+	Watch bool
+	// PollInterval is the time between listing the directory in watch mode, defaults to one second
+	PollInterval time.Duration
+	// MinAge skips files that were modified more recently than this, so files that are still being written are not
+	// picked up too early
+	MinAge time.Duration
+	// DoneDir is where files are moved once they are acknowledged, they stay in place if it is empty
+	DoneDir string
+	// ErrorDir is where files are moved once they are negatively acknowledged, they stay in place if it is empty
+	ErrorDir string
+	// StateFile records the finished files that are not moved out of the directory, so they are not emitted again
+	// after a restart
+	StateFile string
+}
+
+// DirSource emits the files in a directory that match a glob, each file is emitted once. It is an AckSource over the
+// file paths so it can be queued with AckQueue: once a file is acknowledged it is moved to DoneDir and once it fails it
+// is moved to ErrorDir. Next and NextFile can also be used directly as queue functions, in which case Ack and Nack are
+// called by the user.
+type DirSource struct {
+	dir  string
+	opts DirSourceOptions
+
+	mu       sync.Mutex
+	pending  []string
+	emitted  map[string]struct{}
+	finished map[string]struct{}
+	state    *os.File
+
+	// now allows tests to control time, defaults to time.Now
+	now func() time.Time
+	// rename allows tests to fail moves, defaults to os.Rename
+	rename func(oldpath string, newpath string) error
+}
+
+// NewDirSource creates a DirSource for dir and loads the finished files from the state file if one is configured
+func NewDirSource(dir string, opts DirSourceOptions) (*DirSource, error) {
+	if opts.Pattern == "" {
+		opts.Pattern = "*"
+	}
+	if _, err := filepath.Match(opts.Pattern, ""); err != nil {
+		return nil, err
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = time.Second
+	}
+	for _, d := range []string{opts.DoneDir, opts.ErrorDir} {
+		if d == "" {
+			continue
+		}
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &DirSource{
+		dir:      dir,
+		opts:     opts,
+		emitted:  make(map[string]struct{}),
+		finished: make(map[string]struct{}),
+		now:      time.Now,
+		rename:   os.Rename,
+	}
+	if opts.StateFile != "" {
+		if err := s.loadState(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *DirSource) loadState() error {
+	f, err := os.OpenFile(s.opts.StateFile, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		s.finished[scanner.Text()] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return err
+	}
+	s.state = f
+	return nil
+}
+
+// scan lists the directory and queues the files that have not been emitted or finished, must be called while holding mu
+func (s *DirSource) scan() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	found := make([]string, 0)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if ok, _ := filepath.Match(s.opts.Pattern, e.Name()); !ok {
+			continue
+		}
+		path := filepath.Join(s.dir, e.Name())
+		if _, ok := s.emitted[path]; ok {
+			continue
+		}
+		if _, ok := s.finished[path]; ok {
+			continue
+		}
+		if s.opts.MinAge > 0 {
+			info, err := e.Info()
+			if err != nil || s.now().Sub(info.ModTime()) < s.opts.MinAge {
+				continue
+			}
+		}
+		found = append(found, path)
+	}
+	sort.Strings(found)
+	s.pending = append(s.pending, found...)
+	return nil
+}
+
+// Next returns the path of the next file. Without watch mode it returns ErrQueueEmpty once every file has been emitted,
+// in watch mode it waits for new files until the context is done.
+func (s *DirSource) Next(ctx context.Context) (string, error) {
+	for {
+		s.mu.Lock()
+		if len(s.pending) == 0 {
+			if err := s.scan(); err != nil {
+				s.mu.Unlock()
+				return "", err
+			}
+		}
+		if len(s.pending) > 0 {
+			path := s.pending[0]
+			s.pending = s.pending[1:]
+			s.emitted[path] = struct{}{}
+			s.mu.Unlock()
+			return path, nil
+		}
+		s.mu.Unlock()
+
+		if !s.opts.Watch {
+			return "", ErrQueueEmpty
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(s.opts.PollInterval):
+		}
+	}
+}
+
+// NextFile is the same as Next but opens the file, the file has to be closed by the caller before it is acknowledged
+// with its name
+func (s *DirSource) NextFile(ctx context.Context) (*os.File, error) {
+	path, err := s.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Ack marks the file as successfully processed and moves it to DoneDir, an error moving the file is logged
+func (s *DirSource) Ack(path string) {
+	if err := s.Done(path); err != nil {
+		logError("DirSource", "finishing file failed", err, "path", path)
+	}
+}
+
+// Nack marks the file as failed and moves it to ErrorDir, the error it failed with and any error moving the file are
+// logged
+func (s *DirSource) Nack(path string, err error) {
+	logError("DirSource", "file failed", err, "path", path)
+	if moveErr := s.Failed(path); moveErr != nil {
+		logError("DirSource", "finishing file failed", moveErr, "path", path)
+	}
+}
+
+// Done is the same as Ack but returns any error from moving the file or recording its state
+func (s *DirSource) Done(path string) error {
+	return s.finish(path, s.opts.DoneDir)
+}
+
+// Failed is the same as Nack but returns any error from moving the file or recording its state
+func (s *DirSource) Failed(path string) error {
+	return s.finish(path, s.opts.ErrorDir)
+}
+
+// finish moves the file out of the directory, or records it as finished if there is nowhere to move it to. A file that
+// can not be moved is recorded as finished as well so it is not emitted again.
+func (s *DirSource) finish(path string, moveTo string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.emitted, path)
+
+	var moveErr error
+	if moveTo != "" {
+		moveErr = s.move(path, filepath.Join(moveTo, filepath.Base(path)))
+		if moveErr == nil {
+			return nil
+		}
+	}
+	s.finished[path] = struct{}{}
+	if s.state == nil {
+		return moveErr
+	}
+	if _, err := fmt.Fprintln(s.state, path); err != nil {
+		return errors.Join(moveErr, err)
+	}
+	return errors.Join(moveErr, s.state.Sync())
+}
+
+// move renames the file and falls back to copying and removing it when the target is on another file system
+func (s *DirSource) move(from string, to string) error {
+	err := s.rename(from, to)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := to + ".tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, to); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(from)
+}
+
+// Close closes the state file
+func (s *DirSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == nil {
+		return nil
+	}
+	err := s.state.Close()
+	s.state = nil
+	return err
+}
@@ -0,0 +1,201 @@
+package pipelines
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func writeTestFiles(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+}
+
+func listDir(dir string) []string {
+	entries, _ := os.ReadDir(dir)
+	names := make([]string, 0)
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDirSource(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	spool := filepath.Join(root, "spool")
+	done := filepath.Join(root, "done")
+	failed := filepath.Join(root, "failed")
+	_ = os.Mkdir(spool, 0o755)
+	writeTestFiles(t, spool, "a.csv", "b.csv", "bad.csv", "ignored.txt")
+
+	src, err := NewDirSource(spool, DirSourceOptions{Pattern: "*.csv", DoneDir: done, ErrorDir: failed})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer src.Close()
+	rl := &recordingLogger{}
+	SetLogger(rl)
+	defer SetLogger(nil)
+
+	// Test that the files are moved depending on the outcome of the pipeline
+	queueC, queueErrC := AckQueue[string](ctx, src, 1, 1)
+	dequeueErrC := Dequeue(queueC, AckDequeue(func(path string) error {
+		if filepath.Base(path) == "bad.csv" {
+			return fmt.Errorf("cannot process %s", path)
+		}
+		return nil
+	}), 1, 2)
+	errorCount := 0
+	for range Merge(queueErrC, dequeueErrC) {
+		errorCount++
+	}
+	if errorCount != 1 {
+		t.Errorf("expected 1 error, got: %d", errorCount)
+	}
+	if names := listDir(spool); !reflect.DeepEqual(names, []string{"ignored.txt"}) {
+		t.Errorf("expected only ignored.txt in the spool, got: %v", names)
+	}
+	if names := listDir(done); !reflect.DeepEqual(names, []string{"a.csv", "b.csv"}) {
+		t.Errorf("expected a.csv and b.csv to be done, got: %v", names)
+	}
+	if names := listDir(failed); !reflect.DeepEqual(names, []string{"bad.csv"}) {
+		t.Errorf("expected bad.csv to have failed, got: %v", names)
+	}
+
+	// Test that the reason a file failed is logged
+	if rl.count("DirSource", "file failed") != 1 {
+		t.Fatalf("expected the failed file to be logged, got: %+v", rl.entries)
+	}
+	for _, e := range rl.entries {
+		if err, _ := e.keyvals["error"].(error); e.msg == "file failed" && (err == nil || !strings.Contains(err.Error(), "cannot process")) {
+			t.Errorf("expected the reason to be logged, got: %+v", e)
+		}
+	}
+}
+
+func TestDirSourceWatchAndState(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	state := filepath.Join(t.TempDir(), "state")
+	writeTestFiles(t, dir, "1.log")
+
+	src, err := NewDirSource(dir, DirSourceOptions{Watch: true, PollInterval: time.Millisecond, StateFile: state})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	first, err := src.Next(ctx)
+	if err != nil || filepath.Base(first) != "1.log" {
+		t.Fatalf("expected 1.log, got: %s, %v", first, err)
+	}
+	if err := src.Done(first); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// Test that watch mode picks up a file that is added later
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		writeTestFiles(t, dir, "2.log")
+	}()
+	f, err := src.NextFile(ctx)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	f.Close()
+	if filepath.Base(f.Name()) != "2.log" {
+		t.Errorf("expected 2.log, got: %s", f.Name())
+	}
+	src.Close()
+
+	// Test that a restart skips the finished file but emits the unfinished one again
+	src, err = NewDirSource(dir, DirSourceOptions{StateFile: state})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer src.Close()
+	path, err := src.Next(ctx)
+	if err != nil || filepath.Base(path) != "2.log" {
+		t.Errorf("expected 2.log, got: %s, %v", path, err)
+	}
+	if _, err := src.Next(ctx); !errors.Is(err, ErrQueueEmpty) {
+		t.Errorf("expected ErrQueueEmpty, got: %v", err)
+	}
+}
+
+func TestDirSourceMinAge(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	writeTestFiles(t, dir, "new.log")
+
+	src, err := NewDirSource(dir, DirSourceOptions{MinAge: time.Minute})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// Test that a file that was just written is skipped until it is old enough
+	if _, err := src.Next(ctx); !errors.Is(err, ErrQueueEmpty) {
+		t.Errorf("expected ErrQueueEmpty, got: %v", err)
+	}
+	src.now = func() time.Time { return time.Now().Add(time.Hour) }
+	if path, err := src.Next(ctx); err != nil || filepath.Base(path) != "new.log" {
+		t.Errorf("expected new.log, got: %s, %v", path, err)
+	}
+}
+
+func TestDirSourceMoveFailures(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	spool := filepath.Join(root, "spool")
+	done := filepath.Join(root, "done")
+	_ = os.Mkdir(spool, 0o755)
+	writeTestFiles(t, spool, "a.csv", "b.csv")
+
+	src, err := NewDirSource(spool, DirSourceOptions{Watch: true, PollInterval: time.Millisecond, DoneDir: done})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer src.Close()
+
+	// Test that a move across file systems falls back to copying the file
+	src.rename = func(oldpath string, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	path, _ := src.Next(ctx)
+	if err := src.Done(path); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if names := listDir(done); !reflect.DeepEqual(names, []string{"a.csv"}) {
+		t.Errorf("expected a.csv to be copied, got: %v", names)
+	}
+
+	// Test that a file that can not be moved is reported and not emitted again
+	errMove := fmt.Errorf("permission denied")
+	src.rename = func(string, string) error { return errMove }
+	path, _ = src.Next(ctx)
+	if err := src.Done(path); !errors.Is(err, errMove) {
+		t.Errorf("expected the move error, got: %v", err)
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if path, err := src.Next(timeoutCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected no file to be emitted again, got: %s, %v", path, err)
+	}
+	if names := listDir(spool); !reflect.DeepEqual(names, []string{"b.csv"}) {
+		t.Errorf("expected only b.csv to be left, got: %v", names)
+	}
+}
@@ -0,0 +1,660 @@
+package pipelines
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrDurableQueueClosed = fmt.Errorf("durable queue is closed")
+
+var ErrCorruptSegment = fmt.Errorf("durable queue segment is corrupt")
+
+// FsyncPolicy decides when the DurableQueue flushes its writes to disk
+type FsyncPolicy int
+
+const (
+	// FsyncAlways syncs after every write and acknowledgement, nothing acknowledged is lost on a crash
+	FsyncAlways FsyncPolicy = iota
+	// FsyncInterval syncs on a fixed interval, a crash loses at most one interval of writes
+	FsyncInterval
+	// FsyncNever leaves flushing to the operating system
+	FsyncNever
+)
+
+const (
+	segmentExt        = ".wal"
+	consumerFile      = "consumer.offset"
+	recordHeaderSize  = 8
+	maxRecordSize     = 1 << 30
+	defaultSegmentLen = 64 << 20
+)
+
+// DurableQueueOptions configures a DurableQueue
+type DurableQueueOptions struct {
+	// SegmentSize is the size in bytes after which a new segment file is started, defaults to 64MB
+	SegmentSize int64
+	// FsyncPolicy decides when writes are synced to disk, FsyncAlways by default
+	FsyncPolicy FsyncPolicy
+	// FsyncInterval is the interval used with FsyncInterval, defaults to one second
+	FsyncInterval time.Duration
+	// DeadLetter is called with the encoded record of every item that is nacked or can not be decoded before the item
+	// is acknowledged, so it can be kept somewhere else for inspection. If it returns an error the item is not
+	// acknowledged and is delivered again after a restart. It is optional, without it such items are dropped.
+	DeadLetter func(payload []byte, err error) error
+}
+
+// DurableItem is an item read from a DurableQueue along with the offset that has to be acknowledged once it is done
+type DurableItem[T any] struct {
+	Offset uint64
+	Item   T
+}
+
+type segment struct {
+	base  uint64
+	count uint64
+	size  int64
+	path  string
+}
+
+// DurableQueue is an append only log on local disk that can replace the in memory channel between two stages so that
+// buffered items survive a crash or redeploy. The log is split into segment files, each record is stored with its
+// length and a checksum so a torn write at the end of the log is dropped on recovery.
+//
+// Items are written with Enqueue, which can be used directly as a dequeue function, and read with Next, which can be
+// used directly as a queue function. Reading starts from the last acknowledged offset, so any item that was read but not
+// acknowledged before a restart is delivered again. Segments that are fully acknowledged are deleted.
+//
+//	q, err := OpenDurableQueue[Order](dir, JSONCodec[Order]{}, DurableQueueOptions{})
+//	writeErrC := Dequeue(ordersC, q.Enqueue, 1, 1)
+//	durableC, readErrC := Queue(ctx, q.Next, 1, 1)
+//	storeErrC := Dequeue(durableC, q.AckDequeue(store), 1, 4)
+type DurableQueue[T any] struct {
+	dir   string
+	codec Codec[T]
+	opts  DurableQueueOptions
+
+	mu         sync.Mutex
+	segments   []*segment
+	active     *os.File
+	nextOffset uint64
+	dirty      bool
+	closed     bool
+	writerDone bool
+	// failed is set once a corrupt record is read, nothing after it can be read
+	failed error
+	// notify is closed and replaced every time a record is appended or the writer is closed
+	notify chan struct{}
+
+	// Read position
+	readOffset uint64
+	readSeg    int
+	readPos    int64
+	reader     *os.File
+
+	// Acknowledgements above committed that are waiting on a gap to be filled
+	committed uint64
+	acked     map[uint64]struct{}
+
+	stopSync chan struct{}
+	syncDone chan struct{}
+}
+
+// OpenDurableQueue opens or creates the queue stored in dir and recovers its state. A torn record at the end of the last
+// segment is truncated, a corrupt record anywhere else returns ErrCorruptSegment.
+func OpenDurableQueue[T any](dir string, codec Codec[T], opts DurableQueueOptions) (*DurableQueue[T], error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultSegmentLen
+	}
+	if opts.FsyncInterval <= 0 {
+		opts.FsyncInterval = time.Second
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	q := &DurableQueue[T]{
+		dir:    dir,
+		codec:  codec,
+		opts:   opts,
+		notify: make(chan struct{}),
+		acked:  make(map[uint64]struct{}),
+	}
+	if err := q.recover(); err != nil {
+		return nil, err
+	}
+
+	if opts.FsyncPolicy == FsyncInterval {
+		q.stopSync = make(chan struct{})
+		q.syncDone = make(chan struct{})
+		go q.syncLoop()
+	}
+	return q, nil
+}
+
+func (q *DurableQueue[T]) recover() error {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), segmentExt) {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, &segment{base: base, path: filepath.Join(q.dir, e.Name())})
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i].base < q.segments[j].base })
+
+	// Count the valid records of every segment, only the last one is allowed to end in a torn record
+	for i, seg := range q.segments {
+		count, size, err := scanSegment(seg.path)
+		if err != nil {
+			if i != len(q.segments)-1 {
+				return fmt.Errorf("%w: %s: %v", ErrCorruptSegment, seg.path, err)
+			}
+			if err := os.Truncate(seg.path, size); err != nil {
+				return err
+			}
+		}
+		seg.count = count
+		seg.size = size
+	}
+
+	if n := len(q.segments); n > 0 {
+		last := q.segments[n-1]
+		q.nextOffset = last.base + last.count
+	}
+
+	committed, err := q.readCommitted()
+	if err != nil {
+		return err
+	}
+	if len(q.segments) > 0 && committed < q.segments[0].base {
+		committed = q.segments[0].base
+	}
+	if committed > q.nextOffset {
+		committed = q.nextOffset
+	}
+	q.committed = committed
+	q.readOffset = committed
+
+	if len(q.segments) == 0 {
+		if err := q.roll(q.nextOffset); err != nil {
+			return err
+		}
+	} else {
+		last := q.segments[len(q.segments)-1]
+		f, err := os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		q.active = f
+	}
+
+	return q.seekRead(committed)
+}
+
+// scanSegment returns the amount of valid records and the size in bytes they take up. An error is returned along with
+// the valid prefix if the segment ends in a torn or corrupt record.
+func scanSegment(path string) (uint64, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var count uint64
+	var size int64
+	for {
+		payload, err := readRecord(r)
+		if errors.Is(err, io.EOF) {
+			return count, size, nil
+		}
+		if err != nil {
+			return count, size, err
+		}
+		count++
+		size += recordHeaderSize + int64(len(payload))
+	}
+}
+
+// encodeRecord frames the payload as a record that can be read back with readRecord
+func encodeRecord(payload []byte) []byte {
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[recordHeaderSize:], payload)
+	return record
+}
+
+// readRecord reads a single record made of a 4 byte length, a 4 byte crc32 checksum and the payload
+func readRecord(r io.Reader) ([]byte, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("torn record header")
+		}
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	// A length this large can only come from a corrupt header, refuse it instead of allocating it
+	if length > maxRecordSize {
+		return nil, fmt.Errorf("record length %d exceeds the maximum", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("torn record payload")
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return nil, fmt.Errorf("record checksum mismatch")
+	}
+	return payload, nil
+}
+
+func (q *DurableQueue[T]) readCommitted() (uint64, error) {
+	b, err := os.ReadFile(filepath.Join(q.dir, consumerFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// writeCommitted stores the committed offset by writing a temp file and renaming it so it is never half written
+func (q *DurableQueue[T]) writeCommitted() error {
+	path := filepath.Join(q.dir, consumerFile)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(strconv.FormatUint(q.committed, 10)); err != nil {
+		f.Close()
+		return err
+	}
+	if q.opts.FsyncPolicy == FsyncAlways {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// roll closes the active segment and starts a new one at the given base offset
+func (q *DurableQueue[T]) roll(base uint64) error {
+	if q.active != nil {
+		if q.opts.FsyncPolicy != FsyncNever {
+			if err := q.active.Sync(); err != nil {
+				return err
+			}
+		}
+		if err := q.active.Close(); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(q.dir, fmt.Sprintf("%020d%s", base, segmentExt))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	q.active = f
+	q.segments = append(q.segments, &segment{base: base, path: path})
+	return nil
+}
+
+// seekRead positions the reader on the record at the given offset
+func (q *DurableQueue[T]) seekRead(offset uint64) error {
+	for i, seg := range q.segments {
+		if offset >= seg.base+seg.count && i != len(q.segments)-1 {
+			continue
+		}
+		f, err := os.Open(seg.path)
+		if err != nil {
+			return err
+		}
+		// Skip over the records before the offset
+		r := bufio.NewReader(f)
+		var pos int64
+		for skip := offset - seg.base; skip > 0; skip-- {
+			payload, err := readRecord(r)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			pos += recordHeaderSize + int64(len(payload))
+		}
+		if q.reader != nil {
+			q.reader.Close()
+		}
+		q.reader = f
+		q.readSeg = i
+		q.readPos = pos
+		q.readOffset = offset
+		return nil
+	}
+	return nil
+}
+
+// Enqueue appends the item to the log, it has the signature of a dequeue function so it can be used with Dequeue
+func (q *DurableQueue[T]) Enqueue(item T) error {
+	payload, err := q.codec.Encode(item)
+	if err != nil {
+		return err
+	}
+	record := encodeRecord(payload)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || q.writerDone {
+		return ErrDurableQueueClosed
+	}
+
+	seg := q.segments[len(q.segments)-1]
+	if seg.size > 0 && seg.size+int64(len(record)) > q.opts.SegmentSize {
+		if err := q.roll(q.nextOffset); err != nil {
+			return err
+		}
+		seg = q.segments[len(q.segments)-1]
+	}
+	if _, err := q.active.Write(record); err != nil {
+		return err
+	}
+	if q.opts.FsyncPolicy == FsyncAlways {
+		if err := q.active.Sync(); err != nil {
+			return err
+		}
+	} else {
+		q.dirty = true
+	}
+	seg.size += int64(len(record))
+	seg.count++
+	q.nextOffset++
+	q.wake()
+	return nil
+}
+
+// wake notifies any reader waiting in Next, must be called while holding mu
+func (q *DurableQueue[T]) wake() {
+	close(q.notify)
+	q.notify = make(chan struct{})
+}
+
+// Next blocks until the next item is available and returns it, it has the signature of a queue function so it can be
+// used with Queue. Once CloseWriter has been called and every item has been read, or once the queue is closed, it
+// returns ErrQueueEmpty.
+//
+// An item that can not be decoded is passed to the DeadLetter option and acknowledged, Next returns the decode error
+// and moves on to the next item. A corrupt record returns a fatal error wrapping ErrCorruptSegment once, as the records
+// after it can not be found Next returns ErrQueueEmpty from then on.
+func (q *DurableQueue[T]) Next(ctx context.Context) (DurableItem[T], error) {
+	offset, payload, err := q.read(ctx)
+	if err != nil {
+		return DurableItem[T]{}, err
+	}
+	item := DurableItem[T]{Offset: offset}
+	item.Item, err = q.codec.Decode(payload)
+	if err != nil {
+		err = fmt.Errorf("durable queue offset %d: %w", offset, err)
+		if dlErr := q.deadLetter(offset, payload, err); dlErr != nil {
+			return DurableItem[T]{}, errors.Join(err, dlErr)
+		}
+		return DurableItem[T]{}, err
+	}
+	return item, nil
+}
+
+// read blocks until the next record is available and returns its offset and payload
+func (q *DurableQueue[T]) read(ctx context.Context) (uint64, []byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if q.closed || q.failed != nil {
+			return 0, nil, ErrQueueEmpty
+		}
+		if q.readOffset < q.nextOffset {
+			break
+		}
+		if q.writerDone {
+			return 0, nil, ErrQueueEmpty
+		}
+		notify := q.notify
+		q.mu.Unlock()
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			q.mu.Lock()
+			return 0, nil, ctx.Err()
+		}
+		q.mu.Lock()
+	}
+
+	// Move on to the next segment once every record of the current one has been read
+	seg := q.segments[q.readSeg]
+	if q.readOffset >= seg.base+seg.count {
+		if err := q.seekRead(q.readOffset); err != nil {
+			return 0, nil, err
+		}
+		seg = q.segments[q.readSeg]
+	}
+
+	payload, err := readRecord(io.NewSectionReader(q.reader, q.readPos, seg.size-q.readPos))
+	if err != nil {
+		q.failed = &corruptSegmentError{path: seg.path, offset: q.readOffset, err: err}
+		return 0, nil, q.failed
+	}
+	offset := q.readOffset
+	q.readPos += recordHeaderSize + int64(len(payload))
+	q.readOffset++
+	return offset, payload, nil
+}
+
+// corruptSegmentError is returned by Next for a record that fails its checksum, it is fatal as the queue can not read
+// past it
+type corruptSegmentError struct {
+	path   string
+	offset uint64
+	err    error
+}
+
+func (e *corruptSegmentError) Error() string {
+	return fmt.Sprintf("%v: %s: offset %d: %v", ErrCorruptSegment, e.path, e.offset, e.err)
+}
+
+func (e *corruptSegmentError) Fatal() string {
+	return e.Error()
+}
+
+func (e *corruptSegmentError) Unwrap() error {
+	return ErrCorruptSegment
+}
+
+// Ack marks the item at the offset as done. The committed offset only moves forward once every item before it is also
+// acknowledged, so acknowledgements from concurrent workers may arrive in any order.
+func (q *DurableQueue[T]) Ack(offset uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrDurableQueueClosed
+	}
+	if offset < q.committed {
+		return nil
+	}
+	q.acked[offset] = struct{}{}
+
+	moved := false
+	for {
+		if _, ok := q.acked[q.committed]; !ok {
+			break
+		}
+		delete(q.acked, q.committed)
+		q.committed++
+		moved = true
+	}
+	if !moved {
+		return nil
+	}
+	if err := q.writeCommitted(); err != nil {
+		return err
+	}
+	return q.compact()
+}
+
+// compact deletes the segments whose records have all been acknowledged, the active segment is always kept
+func (q *DurableQueue[T]) compact() error {
+	for len(q.segments) > 1 {
+		seg := q.segments[0]
+		if seg.base+seg.count > q.committed || q.readSeg == 0 {
+			break
+		}
+		if err := os.Remove(seg.path); err != nil {
+			return err
+		}
+		q.segments = q.segments[1:]
+		q.readSeg--
+	}
+	return nil
+}
+
+// Nack marks the item at the offset as failed, it is passed to the DeadLetter option and then acknowledged so that
+// the committed offset keeps moving and the item is not delivered again after a restart
+func (q *DurableQueue[T]) Nack(item DurableItem[T], err error) error {
+	payload, encErr := q.codec.Encode(item.Item)
+	if encErr != nil {
+		return encErr
+	}
+	return q.deadLetter(item.Offset, payload, err)
+}
+
+func (q *DurableQueue[T]) deadLetter(offset uint64, payload []byte, err error) error {
+	if q.opts.DeadLetter != nil {
+		if dlErr := q.opts.DeadLetter(payload, err); dlErr != nil {
+			return dlErr
+		}
+	}
+	return q.Ack(offset)
+}
+
+// AckWorker wraps a worker function that takes items read from the queue, the item is acknowledged once the function
+// succeeds and nacked when it fails. An ErrFatal leaves the item unacknowledged so it is delivered again after a
+// restart.
+func (q *DurableQueue[T]) AckWorker(f func(T) (T, error)) func(DurableItem[T]) (T, error) {
+	return func(v DurableItem[T]) (T, error) {
+		res, err := f(v.Item)
+		if err != nil {
+			return res, q.settleFailed(v, err)
+		}
+		return res, q.Ack(v.Offset)
+	}
+}
+
+// AckDequeue wraps a dequeue function that takes items read from the queue, the item is acknowledged once the function
+// succeeds and nacked when it fails. An ErrFatal leaves the item unacknowledged so it is delivered again after a
+// restart.
+func (q *DurableQueue[T]) AckDequeue(f func(T) error) func(DurableItem[T]) error {
+	return func(v DurableItem[T]) error {
+		if err := f(v.Item); err != nil {
+			return q.settleFailed(v, err)
+		}
+		return q.Ack(v.Offset)
+	}
+}
+
+// settleFailed nacks an item the function failed on unless the error is fatal and returns the error of the function
+func (q *DurableQueue[T]) settleFailed(v DurableItem[T], err error) error {
+	if _, ok := err.(ErrFatal); ok {
+		return err
+	}
+	if nackErr := q.Nack(v, err); nackErr != nil {
+		return errors.Join(err, nackErr)
+	}
+	return err
+}
+
+// Len returns the amount of items that have been written but not yet acknowledged
+func (q *DurableQueue[T]) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return int(q.nextOffset - q.committed)
+}
+
+// CloseWriter signals that no more items will be enqueued, Next returns ErrQueueEmpty once the remaining items are read
+func (q *DurableQueue[T]) CloseWriter() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.writerDone {
+		return
+	}
+	q.writerDone = true
+	q.wake()
+}
+
+func (q *DurableQueue[T]) syncLoop() {
+	defer close(q.syncDone)
+	ticker := time.NewTicker(q.opts.FsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.stopSync:
+			return
+		case <-ticker.C:
+			q.mu.Lock()
+			if q.dirty && q.active != nil {
+				_ = q.active.Sync()
+				q.dirty = false
+			}
+			q.mu.Unlock()
+		}
+	}
+}
+
+// Close syncs and closes the segment files, any item that was not acknowledged is delivered again once reopened
+func (q *DurableQueue[T]) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	q.wake()
+	q.mu.Unlock()
+
+	if q.stopSync != nil {
+		close(q.stopSync)
+		<-q.syncDone
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var errs []error
+	if q.opts.FsyncPolicy != FsyncNever {
+		errs = append(errs, q.active.Sync())
+	}
+	errs = append(errs, q.active.Close())
+	if q.reader != nil {
+		errs = append(errs, q.reader.Close())
+	}
+	return errors.Join(errs...)
+}
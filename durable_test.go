@@ -0,0 +1,242 @@
+package pipelines
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestDurableQueue(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	q, err := OpenDurableQueue[string](dir, JSONCodec[string]{}, DurableQueueOptions{SegmentSize: 64})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	for _, v := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		if err := q.Enqueue(v); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+
+	// Test that items are read in order and acknowledgements out of order only commit contiguous offsets
+	items := make([]DurableItem[string], 0)
+	for i := 0; i < 5; i++ {
+		item, err := q.Next(ctx)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		items = append(items, item)
+	}
+	if items[0].Item != "a" || items[4].Item != "e" {
+		t.Errorf("expected items a to e, got: %v", items)
+	}
+	for _, i := range []int{1, 0, 3} {
+		if err := q.Ack(items[i].Offset); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	if q.Len() != 6 {
+		t.Errorf("expected 6 unacknowledged items, got: %d", q.Len())
+	}
+	if err := q.Close(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// Test that reopening resumes from the first unacknowledged item
+	q, err = OpenDurableQueue[string](dir, JSONCodec[string]{}, DurableQueueOptions{SegmentSize: 64})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	q.CloseWriter()
+	resumed := make([]string, 0)
+	for {
+		item, err := q.Next(ctx)
+		if errors.Is(err, ErrQueueEmpty) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		resumed = append(resumed, item.Item)
+		if err := q.Ack(item.Offset); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	if len(resumed) != 6 || resumed[0] != "c" || resumed[5] != "h" {
+		t.Errorf("expected items c to h, got: %v", resumed)
+	}
+
+	// Test that fully acknowledged segments are compacted away
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(segments) != 1 {
+		t.Errorf("expected 1 segment after compaction, got: %d", len(segments))
+	}
+	if err := q.Close(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+}
+
+func TestDurableQueueRecovery(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	q, err := OpenDurableQueue[int](dir, GobCodec[int]{}, DurableQueueOptions{FsyncPolicy: FsyncNever})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := q.Enqueue(i); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	if err := q.Close(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// Simulate a crash in the middle of a write by appending half a record
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	f, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	_, _ = f.Write([]byte{0, 0, 0, 9, 1, 2})
+	f.Close()
+
+	q, err = OpenDurableQueue[int](dir, GobCodec[int]{}, DurableQueueOptions{FsyncPolicy: FsyncNever})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer q.Close()
+	if q.Len() != 3 {
+		t.Errorf("expected 3 items after recovery, got: %d", q.Len())
+	}
+
+	// New writes after recovery are readable after the recovered ones
+	if err := q.Enqueue(4); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	q.CloseWriter()
+	queueC, errC := Queue(ctx, q.Next, 1, 1)
+	dequeueErrC := Dequeue(queueC, q.AckDequeue(func(int) error { return nil }), 1, 1)
+	for err := range Merge(errC, dequeueErrC) {
+		t.Errorf("expected no errors, got: %v", err)
+	}
+	if q.Len() != 0 {
+		t.Errorf("expected every item to be acknowledged, got: %d", q.Len())
+	}
+}
+
+func TestDurableQueueNack(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	q, err := OpenDurableQueue[string](dir, JSONCodec[string]{}, DurableQueueOptions{})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	for _, v := range []string{"1", "x", "3", "4"} {
+		if err := q.Enqueue(v); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+	if err := q.Close(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// Test that items that fail to decode or fail in the function are dead lettered and acknowledged
+	dead := make([]string, 0)
+	opts := DurableQueueOptions{DeadLetter: func(payload []byte, err error) error {
+		dead = append(dead, string(payload))
+		return nil
+	}}
+	q2, err := OpenDurableQueue[int](dir, intStringCodec{}, opts)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	q2.CloseWriter()
+	queueC, errC := Queue(ctx, q2.Next, 0, 1)
+	dequeueErrC := Dequeue(queueC, q2.AckDequeue(func(v int) error {
+		if v == 3 {
+			return fmt.Errorf("failed")
+		}
+		return nil
+	}), 0, 1)
+	errs := 0
+	for range Merge(errC, dequeueErrC) {
+		errs++
+	}
+	if errs != 2 || len(dead) != 2 || dead[0] != `"x"` || dead[1] != `"3"` {
+		t.Errorf("expected 2 errors and dead letters, got: %d, %v", errs, dead)
+	}
+	if q2.Len() != 0 {
+		t.Errorf("expected every item to be acknowledged, got: %d", q2.Len())
+	}
+	if err := q2.Close(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+}
+
+func TestDurableQueueClosedAndCorrupt(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	q, err := OpenDurableQueue[string](dir, JSONCodec[string]{}, DurableQueueOptions{})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	for _, v := range []string{"a", "b", "c"} {
+		if err := q.Enqueue(v); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+
+	// Test that a closed queue is empty even with unread items
+	if err := q.Close(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := q.Next(ctx); !errors.Is(err, ErrQueueEmpty) {
+		t.Errorf("expected ErrQueueEmpty, got: %v", err)
+	}
+
+	// Test that a corrupt record is reported once as a fatal error
+	q, err = OpenDurableQueue[string](dir, JSONCodec[string]{}, DurableQueueOptions{})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer q.Close()
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	f, err := os.OpenFile(segments[0], os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	_, _ = f.WriteAt([]byte{'z'}, recordHeaderSize+1)
+	f.Close()
+	_, err = q.Next(ctx)
+	if _, ok := err.(ErrFatal); !ok || !errors.Is(err, ErrCorruptSegment) {
+		t.Errorf("expected a fatal ErrCorruptSegment, got: %v", err)
+	}
+	if _, err := q.Next(ctx); !errors.Is(err, ErrQueueEmpty) {
+		t.Errorf("expected ErrQueueEmpty after the corrupt record, got: %v", err)
+	}
+}
+
+// intStringCodec decodes JSON strings holding a number into an int
+type intStringCodec struct{}
+
+func (intStringCodec) Encode(v int) ([]byte, error) {
+	return []byte(strconv.Quote(strconv.Itoa(v))), nil
+}
+
+func (intStringCodec) Decode(b []byte) (int, error) {
+	s, err := strconv.Unquote(string(b))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(s)
+}
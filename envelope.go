@@ -0,0 +1,147 @@
+package pipelines
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Envelope carries an item through the pipeline along with metadata such as a trace ID, a source offset or a tenant,
+// without adding them to the item type. Stage functions are lifted with EnvelopeStage, EnvelopeFlatMapStage and
+// EnvelopeDequeue so they can stay unaware of it, or take the Envelope directly and use WithItem to keep the metadata.
+//
+// Every envelope has a unique ID. An item derived from a single item keeps its envelope ID, while the items produced
+// from one item by FlatMap or combined from several get a new ID and record the IDs they came from in ParentIDs.
+type Envelope[T any] struct {
+	ID        string
+	ParentIDs []string
+	Headers   map[string]string
+	// CreatedAt is when the first envelope in the lineage was created, usually the time the item was ingested
+	CreatedAt time.Time
+	// UpdatedAt is the last time a stage produced the item
+	UpdatedAt time.Time
+	Item      T
+
+	// sentAt is when a traced stage started sending the envelope, it is used for the queue wait of the next traced stage
+	sentAt time.Time
+}
+
+// NewEnvelope wraps an item in an envelope with a new ID
+func NewEnvelope[T any](item T) Envelope[T] {
+	now := time.Now()
+	return Envelope[T]{
+		ID:        newEnvelopeID(),
+		Headers:   make(map[string]string),
+		CreatedAt: now,
+		UpdatedAt: now,
+		Item:      item,
+	}
+}
+
+// WithItem returns an envelope with the same ID and metadata as e carrying item instead, the headers are copied so they
+// can be changed without affecting e
+func WithItem[T1, T2 any](e Envelope[T1], item T2) Envelope[T2] {
+	return Envelope[T2]{
+		ID:        e.ID,
+		ParentIDs: e.ParentIDs,
+		Headers:   copyHeaders(e.Headers),
+		CreatedAt: e.CreatedAt,
+		UpdatedAt: time.Now(),
+		Item:      item,
+	}
+}
+
+// ChildEnvelope returns an envelope with a new ID for an item derived from the parents. It records the IDs of the
+// parents, inherits their headers, where later parents take precedence, and the earliest creation time.
+func ChildEnvelope[T1, T2 any](item T2, parents ...Envelope[T1]) Envelope[T2] {
+	child := NewEnvelope(item)
+	for i, p := range parents {
+		child.ParentIDs = append(child.ParentIDs, p.ID)
+		for k, v := range p.Headers {
+			child.Headers[k] = v
+		}
+		if i == 0 || p.CreatedAt.Before(child.CreatedAt) {
+			child.CreatedAt = p.CreatedAt
+		}
+	}
+	return child
+}
+
+// envelopeID is implemented by Envelope so that the error wrappers can find the ID of any envelope type
+func (e Envelope[T]) envelopeID() string {
+	return e.ID
+}
+
+type enveloped interface {
+	envelopeID() string
+}
+
+// traceFields is implemented by *Envelope so that the stage loops can trace envelopes of any item type
+func (e *Envelope[T]) traceFields() (string, *map[string]string, *time.Time) {
+	return e.ID, &e.Headers, &e.sentAt
+}
+
+type traced interface {
+	traceFields() (id string, headers *map[string]string, sentAt *time.Time)
+}
+
+func newEnvelopeID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func copyHeaders(h map[string]string) map[string]string {
+	c := make(map[string]string, len(h))
+	for k, v := range h {
+		c[k] = v
+	}
+	return c
+}
+
+// EnvelopeQueue lifts a queue function so that every item it produces is wrapped in a new envelope
+func EnvelopeQueue[T any](f func(context.Context) (T, error)) func(context.Context) (Envelope[T], error) {
+	return func(ctx context.Context) (Envelope[T], error) {
+		res, err := f(ctx)
+		if err != nil {
+			return Envelope[T]{}, err
+		}
+		return NewEnvelope(res), nil
+	}
+}
+
+// EnvelopeStage lifts a worker function so that it can be used with WorkerPool on envelopes, the result keeps the
+// envelope ID and metadata of the item
+func EnvelopeStage[T1, T2 any](f func(T1) (T2, error)) func(Envelope[T1]) (Envelope[T2], error) {
+	return func(e Envelope[T1]) (Envelope[T2], error) {
+		res, err := f(e.Item)
+		if err != nil {
+			return Envelope[T2]{}, err
+		}
+		return WithItem(e, res), nil
+	}
+}
+
+// EnvelopeFlatMapStage lifts a worker function so that it can be used with FlatMap on envelopes, every result gets a
+// child envelope of the item, see ChildEnvelope
+func EnvelopeFlatMapStage[T1, T2 any](f func(T1) ([]T2, error)) func(Envelope[T1]) ([]Envelope[T2], error) {
+	return func(e Envelope[T1]) ([]Envelope[T2], error) {
+		res, err := f(e.Item)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]Envelope[T2], len(res))
+		for i, v := range res {
+			out[i] = ChildEnvelope(v, e)
+		}
+		return out, nil
+	}
+}
+
+// EnvelopeDequeue lifts a dequeue function so that it can be used with Dequeue on envelopes
+func EnvelopeDequeue[T any](f func(T) error) func(Envelope[T]) error {
+	return func(e Envelope[T]) error {
+		return f(e.Item)
+	}
+}
@@ -0,0 +1,117 @@
+package pipelines
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvelopeStage(t *testing.T) {
+	items := []string{"a b", "c"}
+	i := 0
+	queueFunc := func(ctx context.Context) (string, error) {
+		if i >= len(items) {
+			return "", ErrQueueEmpty
+		}
+		i++
+		return items[i-1], nil
+	}
+
+	// Test that metadata is carried through WorkerPool and FlatMap outputs inherit lineage
+	queue, _ := Queue(context.Background(), EnvelopeQueue(queueFunc), 2, 1)
+	tagged, _ := WorkerPool(queue, func(e Envelope[string]) (Envelope[string], error) {
+		e.Headers["tenant"] = "t-" + e.Item
+		return e, nil
+	}, 2, 1)
+	upper, _ := WorkerPool(tagged, EnvelopeStage(func(s string) (string, error) {
+		return strings.ToUpper(s), nil
+	}), 2, 1)
+	upperIDs := make(map[string]string)
+	collected := make(chan Envelope[string])
+	go func() {
+		defer close(collected)
+		for e := range upper {
+			if e.Item == "A B" && e.Headers["tenant"] != "t-a b" {
+				t.Errorf("expected the header to be carried, got: %v", e.Headers)
+			}
+			upperIDs[e.Item] = e.ID
+			collected <- e
+		}
+	}()
+	words, _ := FlatMap(collected, EnvelopeFlatMapStage(func(s string) ([]string, error) {
+		return strings.Fields(s), nil
+	}), 2, 1)
+
+	var results []Envelope[string]
+	for e := range words {
+		results = append(results, e)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Item < results[j].Item })
+	if len(results) != 3 {
+		t.Fatalf("expected 3 words, got: %v", results)
+	}
+	a, b, c := results[0], results[1], results[2]
+	if a.ID == b.ID || a.ID == upperIDs["A B"] {
+		t.Errorf("expected every child to get a new ID, got: %s, %s", a.ID, b.ID)
+	}
+	if len(a.ParentIDs) != 1 || a.ParentIDs[0] != upperIDs["A B"] || b.ParentIDs[0] != upperIDs["A B"] {
+		t.Errorf("expected the parent ID %s, got: %v, %v", upperIDs["A B"], a.ParentIDs, b.ParentIDs)
+	}
+	if c.ParentIDs[0] != upperIDs["C"] || c.Headers["tenant"] != "t-c" {
+		t.Errorf("expected the lineage and headers of C, got: %v, %v", c.ParentIDs, c.Headers)
+	}
+	if a.CreatedAt.IsZero() || a.UpdatedAt.Before(a.CreatedAt) {
+		t.Errorf("expected timestamps, got: %v, %v", a.CreatedAt, a.UpdatedAt)
+	}
+}
+
+func TestEnvelopeHeaders(t *testing.T) {
+	// Test that derived envelopes do not share headers
+	e := NewEnvelope(1)
+	e.Headers["k"] = "v"
+	d := WithItem(e, "1")
+	d.Headers["k"] = "changed"
+	if e.Headers["k"] != "v" || d.ID != e.ID {
+		t.Errorf("expected the original headers and the same ID, got: %v, %s", e.Headers, d.ID)
+	}
+
+	// Test that a child of several parents records all of them and the earliest creation time
+	p1, p2 := NewEnvelope(1), NewEnvelope(2)
+	p1.CreatedAt = p1.CreatedAt.Add(-time.Hour)
+	p1.Headers["k"], p2.Headers["k"] = "1", "2"
+	child := ChildEnvelope(3, p1, p2)
+	if len(child.ParentIDs) != 2 || child.ParentIDs[1] != p2.ID || child.Headers["k"] != "2" {
+		t.Errorf("expected both parents with the later headers, got: %v, %v", child.ParentIDs, child.Headers)
+	}
+	if !child.CreatedAt.Equal(p1.CreatedAt) {
+		t.Errorf("expected the earliest creation time, got: %v", child.CreatedAt)
+	}
+}
+
+func TestEnvelopeErrWrapper(t *testing.T) {
+	e := NewEnvelope(1)
+	failing := func(n int) (int, error) {
+		return 0, fmt.Errorf("failed")
+	}
+
+	// Test that the error wrappers include the envelope ID
+	_, err := WorkerFunctionErrWrapper(EnvelopeStage(failing), "service", "stage")(e)
+	var pErr PipelineErr
+	if !errors.As(err, &pErr) || pErr.EnvelopeID() != e.ID || err.Error() != "envelope "+e.ID+": failed" {
+		t.Errorf("expected an error with the envelope ID, got: %v", err)
+	}
+	err = DequeueFunctionErrWrapper(EnvelopeDequeue(func(n int) error { return fmt.Errorf("failed") }), "service", "stage")(e)
+	if !errors.As(err, &pErr) || pErr.EnvelopeID() != e.ID {
+		t.Errorf("expected an error with the envelope ID, got: %v", err)
+	}
+
+	// Test that errors for bare items are unchanged
+	_, err = WorkerFunctionErrWrapper(failing, "service", "stage")(1)
+	if !errors.As(err, &pErr) || pErr.EnvelopeID() != "" || err.Error() != "failed" {
+		t.Errorf("expected an error without an envelope ID, got: %v", err)
+	}
+}
@@ -19,9 +19,10 @@ type ErrPipeline interface {
 var ErrQueueEmpty = fmt.Errorf("no additional values can be added to the queue")
 
 type PipelineErr struct {
-	err     error
-	service string
-	stage   string
+	err        error
+	service    string
+	stage      string
+	envelopeID string
 }
 
 func NewPipelineErr(err error, service string, stage string) PipelineErr {
@@ -33,6 +34,9 @@ func NewPipelineErr(err error, service string, stage string) PipelineErr {
 }
 
 func (e PipelineErr) Error() string {
+	if e.envelopeID != "" {
+		return fmt.Sprintf("envelope %s: %s", e.envelopeID, e.err.Error())
+	}
 	return e.err.Error()
 }
 
@@ -44,8 +48,23 @@ func (e PipelineErr) Stage() string {
 	return e.stage
 }
 
+// EnvelopeID returns the ID of the envelope that was being worked on, or an empty string if the item was not an
+// Envelope
+func (e PipelineErr) EnvelopeID() string {
+	return e.envelopeID
+}
+
+// newItemPipelineErr creates a PipelineErr that records the envelope ID if the item is an Envelope
+func newItemPipelineErr(err error, service string, stage string, v any) PipelineErr {
+	pErr := NewPipelineErr(err, service, stage)
+	if e, ok := v.(enveloped); ok {
+		pErr.envelopeID = e.envelopeID()
+	}
+	return pErr
+}
+
 // WorkerFunctionErrWrapper will wrap a given pipeline function and return the same function but will change the
-// error into a PipelineErr if it is not a ErrFatal error
+// error into a PipelineErr if it is not a ErrFatal error. If the item is an Envelope the error includes its ID.
 func WorkerFunctionErrWrapper[T1, T2 any](f func(T1) (T2, error), service string, stage string) func(T1) (T2, error) {
 	return func(v T1) (T2, error) {
 		res, err := f(v)
@@ -54,7 +73,7 @@ func WorkerFunctionErrWrapper[T1, T2 any](f func(T1) (T2, error), service string
 			case ErrFatal:
 				return res, e
 			}
-			return res, NewPipelineErr(err, service, stage)
+			return res, newItemPipelineErr(err, service, stage, v)
 		}
 		return res, nil
 	}
@@ -77,7 +96,7 @@ func QueueFunctionErrWrapper[T any](f func(ctx context.Context) (T, error), serv
 }
 
 // DequeueFunctionErrWrapper will wrap a give pipeline queue function and return the same function but will change the
-// error into a PipelineErr if it is not a ErrFatal error
+// error into a PipelineErr if it is not a ErrFatal error. If the item is an Envelope the error includes its ID.
 func DequeueFunctionErrWrapper[T any](f func(T) error, service string, stage string) func(T) error {
 	return func(v T) error {
 		if err := f(v); err != nil {
@@ -85,7 +104,7 @@ func DequeueFunctionErrWrapper[T any](f func(T) error, service string, stage str
 			case ErrFatal:
 				return e
 			}
-			return NewPipelineErr(err, service, stage)
+			return newItemPipelineErr(err, service, stage, v)
 		}
 		return nil
 	}
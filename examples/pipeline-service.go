@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/cmargol/pipelines"
+	"time"
 )
 
 /*
@@ -88,3 +89,15 @@ func (s Service) TagPipeline(ctx context.Context) error {
 
 	return <-shutdownErr
 }
+
+// Run runs the TagPipeline under a supervisor so it is restarted when it returns on a fatal error, an error is only
+// returned once it keeps failing.
+func (s Service) Run(ctx context.Context) error {
+	supervisor := pipelines.NewSupervisor(ServiceName, pipelines.SupervisorOptions{
+		MaxRestarts: 5,
+		Period:      time.Minute,
+		Backoff:     time.Second,
+		MaxBackoff:  30 * time.Second,
+	}, pipelines.ChildSpec{Name: "TagPipeline", Run: s.TagPipeline})
+	return supervisor.Run(ctx)
+}
@@ -0,0 +1,312 @@
+package pipelines
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Framing decides how items are delimited on the stdin and stdout of an ExecStage process
+type Framing int
+
+const (
+	// FrameNewline writes each item followed by a new line and reads one line per result, the encoded items must not
+	// contain new lines
+	FrameNewline Framing = iota
+	// FrameLengthPrefix writes and reads each item after its length as a 4 byte big endian unsigned integer
+	FrameLengthPrefix
+)
+
+// ExecOptions configures ExecStage
+type ExecOptions struct {
+	// Framing is FrameNewline by default
+	Framing Framing
+	// Timeout is how long a process may take to respond to an item before it is killed and restarted, a value <= 0
+	// means no timeout
+	Timeout time.Duration
+	// ShutdownTimeout is how long a process has to exit once its stdin is closed before it is killed, defaults to five
+	// seconds
+	ShutdownTimeout time.Duration
+	// MaxFrameSize is the largest result in bytes that is read from a process, defaults to 10MB
+	MaxFrameSize int
+	// Dir is the working directory of the processes, the current one if empty
+	Dir string
+	// Env is the environment of the processes, the current one if nil
+	Env []string
+
+	// Service and Stage are set on the PipelineErrs created from the lines the processes write to stderr
+	Service string
+	Stage   string
+}
+
+// ExecStage takes in a channel of work and pipes each item through an external process, the same way WorkerPool runs a
+// work function. Every worker runs its own long lived process of the command, which is started with the first item and
+// restarted with the next item if it crashes or times out. Each item is encoded and written to the stdin of the process,
+// after which exactly one result is read from its stdout and decoded.
+//
+// Every line a process writes to stderr is sent on the error channel as a PipelineErr. Once the queue is drained the
+// stdin of every process is closed and the channels are closed after the processes exit. The processes are killed if
+// ctx is done.
+func ExecStage[T1, T2 any](ctx context.Context, queue <-chan T1, name string, args []string, enc Encoder[T1], dec Decoder[T2], bufferSize int, workers int, opts ExecOptions) (<-chan T2, <-chan error) {
+	// Sanity check for bufSize and workers as channels are created here as well
+	if bufferSize < 0 {
+		bufferSize = 0
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if opts.ShutdownTimeout <= 0 {
+		opts.ShutdownTimeout = 5 * time.Second
+	}
+	if opts.MaxFrameSize <= 0 {
+		opts.MaxFrameSize = 10 << 20
+	}
+
+	errc := make(chan error, bufferSize)
+	var stderrWg sync.WaitGroup
+	start := func() (*execProcess, error) {
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Dir = opts.Dir
+		cmd.Env = opts.Env
+		return startExecProcess(cmd, opts, errc, &stderrWg)
+	}
+
+	// Each worker takes a process out of the pool for the item it is working on, they are started lazily
+	pool := make(chan *execProcess, workers)
+	for i := 0; i < workers; i++ {
+		pool <- nil
+	}
+	work := func(v T1) (T2, error) {
+		var zero T2
+		b, err := enc.Encode(v)
+		if err != nil {
+			return zero, err
+		}
+		// The item is framed before a process is taken, so an item that can not be written never starts one
+		frame, err := encodeFrame(opts.Framing, b)
+		if err != nil {
+			return zero, err
+		}
+
+		p := <-pool
+		defer func() { pool <- p }()
+		if p != nil {
+			// The process may have exited while it was idle, in which case it is replaced before the item is written
+			select {
+			case <-p.done:
+				p.kill()
+				p = nil
+			default:
+			}
+		}
+		if p == nil {
+			if p, err = start(); err != nil {
+				return zero, err
+			}
+		}
+		res, err := p.roundTrip(ctx, frame, opts.Timeout)
+		if err != nil {
+			// The process is in an unknown state so it is replaced for the next item
+			p.kill()
+			p = nil
+			return zero, err
+		}
+		return dec.Decode(res)
+	}
+
+	out, workErrc := WorkerPool(queue, work, bufferSize, workers)
+	go func() {
+		defer close(errc)
+		for err := range workErrc {
+			errc <- err
+		}
+		// The workers are done so every process is back in the pool
+		for i := 0; i < workers; i++ {
+			if p := <-pool; p != nil {
+				p.shutdown(opts.ShutdownTimeout)
+			}
+		}
+		stderrWg.Wait()
+	}()
+	return out, errc
+}
+
+type execProcess struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	opts   ExecOptions
+
+	// done is closed once the process exited, waitErr is set before
+	done    chan struct{}
+	waitErr error
+}
+
+func startExecProcess(cmd *exec.Cmd, opts ExecOptions, errc chan<- error, stderrWg *sync.WaitGroup) (*execProcess, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p := &execProcess{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+		opts:   opts,
+		done:   make(chan struct{}),
+	}
+	stderrWg.Add(1)
+	go func() {
+		defer stderrWg.Done()
+		// Wait closes the pipes so stderr has to be read to the end first
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			errc <- NewPipelineErr(errors.New(scanner.Text()), opts.Service, opts.Stage)
+		}
+		p.waitErr = cmd.Wait()
+		close(p.done)
+	}()
+	return p, nil
+}
+
+// roundTrip writes a framed item to the process and reads its result
+func (p *execProcess) roundTrip(ctx context.Context, frame []byte, timeout time.Duration) ([]byte, error) {
+	type result struct {
+		b   []byte
+		err error
+	}
+	// Buffered so the goroutine can always finish once the process is killed
+	resc := make(chan result, 1)
+	go func() {
+		if _, err := p.stdin.Write(frame); err != nil {
+			resc <- result{err: err}
+			return
+		}
+		res, err := p.readFrame()
+		resc <- result{b: res, err: err}
+	}()
+
+	var timer <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+	select {
+	case res := <-resc:
+		if res.err != nil {
+			return nil, p.exitErr(ctx, res.err)
+		}
+		return res.b, nil
+	case <-timer:
+		return nil, fmt.Errorf("%s timed out after %v", p.cmd.Path, timeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// exitErr adds the exit status to an error from the pipes. A closed pipe is caused by the process exiting, so
+// it waits for the exit for up to the ShutdownTimeout, any other error is returned as is.
+func (p *execProcess) exitErr(ctx context.Context, err error) error {
+	if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, syscall.EPIPE) &&
+		!errors.Is(err, os.ErrClosed) {
+		return fmt.Errorf("%s: %w", p.cmd.Path, err)
+	}
+	timer := time.NewTimer(p.opts.ShutdownTimeout)
+	defer timer.Stop()
+	select {
+	case <-p.done:
+		if p.waitErr != nil {
+			return fmt.Errorf("%s exited: %w", p.cmd.Path, p.waitErr)
+		}
+		return fmt.Errorf("%s exited", p.cmd.Path)
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return fmt.Errorf("%s: %w", p.cmd.Path, err)
+}
+
+// encodeFrame delimits an encoded item for the framing
+func encodeFrame(framing Framing, b []byte) ([]byte, error) {
+	switch framing {
+	case FrameLengthPrefix:
+		frame := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(b)), uint32(len(b)))
+		return append(frame, b...), nil
+	default:
+		if bytes.IndexByte(b, '\n') >= 0 {
+			return nil, fmt.Errorf("encoded item contains a new line, which is not supported by FrameNewline")
+		}
+		return append(append(make([]byte, 0, len(b)+1), b...), '\n'), nil
+	}
+}
+
+func (p *execProcess) readFrame() ([]byte, error) {
+	switch p.opts.Framing {
+	case FrameLengthPrefix:
+		var header [4]byte
+		if _, err := io.ReadFull(p.stdout, header[:]); err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint32(header[:])
+		if int64(n) > int64(p.opts.MaxFrameSize) {
+			return nil, fmt.Errorf("result of %d bytes exceeds the max frame size", n)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(p.stdout, b); err != nil {
+			return nil, err
+		}
+		return b, nil
+	default:
+		var line []byte
+		for {
+			chunk, err := p.stdout.ReadSlice('\n')
+			line = append(line, chunk...)
+			if len(line) > p.opts.MaxFrameSize {
+				return nil, fmt.Errorf("result exceeds the max frame size")
+			}
+			if err == nil {
+				return bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r")), nil
+			}
+			if !errors.Is(err, bufio.ErrBufferFull) {
+				return nil, err
+			}
+		}
+	}
+}
+
+// kill stops the process without waiting on it
+func (p *execProcess) kill() {
+	_ = p.stdin.Close()
+	_ = p.cmd.Process.Kill()
+}
+
+// shutdown closes stdin so the process can exit on its own, and kills it if it has not after the timeout
+func (p *execProcess) shutdown(timeout time.Duration) {
+	_ = p.stdin.Close()
+	select {
+	case <-p.done:
+	case <-time.After(timeout):
+		_ = p.cmd.Process.Kill()
+		<-p.done
+	}
+}
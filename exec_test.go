@@ -0,0 +1,166 @@
+package pipelines
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestExecHelperProcess is not a real test, it is the process run by the ExecStage tests
+func TestExecHelperProcess(t *testing.T) {
+	mode := os.Getenv("PIPELINES_EXEC_HELPER")
+	if mode == "" {
+		return
+	}
+	defer os.Exit(0)
+
+	if mode == "length" {
+		for {
+			var header [4]byte
+			if _, err := io.ReadFull(os.Stdin, header[:]); err != nil {
+				return
+			}
+			b := make([]byte, binary.BigEndian.Uint32(header[:]))
+			if _, err := io.ReadFull(os.Stdin, b); err != nil {
+				return
+			}
+			res := []byte(strings.ToUpper(string(b)))
+			_, _ = os.Stdout.Write(binary.BigEndian.AppendUint32(nil, uint32(len(res))))
+			_, _ = os.Stdout.Write(res)
+		}
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		switch line := scanner.Text(); line {
+		case "crash":
+			os.Exit(3)
+		case "sleep":
+			time.Sleep(time.Minute)
+		case "pid":
+			fmt.Println(os.Getpid())
+		case "warn":
+			fmt.Fprintln(os.Stderr, "warning: "+line)
+			fmt.Println(line)
+		default:
+			fmt.Println(strings.ToUpper(line))
+		}
+	}
+}
+
+func execHelperOptions(mode string) ExecOptions {
+	return ExecOptions{
+		Env:     append(os.Environ(), "PIPELINES_EXEC_HELPER="+mode),
+		Timeout: 5 * time.Second,
+		Service: "service",
+		Stage:   "exec",
+	}
+}
+
+func runExecStage(items []string, workers int, opts ExecOptions) ([]string, []error) {
+	args := []string{"-test.run=TestExecHelperProcess"}
+	out, errc := ExecStage[string, string](context.Background(), ConvertSliceToClosedChannel(items), os.Args[0], args,
+		StringCodec{}, StringCodec{}, 0, workers, opts)
+	var errs []error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for err := range errc {
+			errs = append(errs, err)
+		}
+	}()
+	var results []string
+	for v := range out {
+		results = append(results, v)
+	}
+	<-done
+	sort.Strings(results)
+	return results, errs
+}
+
+func TestExecStage(t *testing.T) {
+	// Test that items are piped through the processes of every worker
+	results, errs := runExecStage([]string{"a", "b", "c", "d"}, 2, execHelperOptions("newline"))
+	if len(errs) != 0 || strings.Join(results, "") != "ABCD" {
+		t.Errorf("expected ABCD, got: %v, %v", results, errs)
+	}
+
+	// Test the length prefixed framing, which allows new lines in items
+	opts := execHelperOptions("length")
+	opts.Framing = FrameLengthPrefix
+	results, errs = runExecStage([]string{"a\nb", "c"}, 1, opts)
+	if len(errs) != 0 || strings.Join(results, ",") != "A\nB,C" {
+		t.Errorf("expected A\\nB,C, got: %q, %v", results, errs)
+	}
+
+	// Test that stderr lines are sent as PipelineErrs
+	results, errs = runExecStage([]string{"warn", "e"}, 1, execHelperOptions("newline"))
+	if strings.Join(results, ",") != "E,warn" || len(errs) != 1 {
+		t.Fatalf("expected E,warn and a single error, got: %v, %v", results, errs)
+	}
+	var pErr ErrPipeline
+	if !errors.As(errs[0], &pErr) || pErr.Stage() != "exec" || pErr.Error() != "warning: warn" {
+		t.Errorf("expected a PipelineErr from stderr, got: %v", errs[0])
+	}
+}
+
+func TestExecStageRestart(t *testing.T) {
+	// Test that a crashed process is restarted for the next item
+	results, errs := runExecStage([]string{"a", "crash", "b"}, 1, execHelperOptions("newline"))
+	if strings.Join(results, "") != "AB" || len(errs) != 1 || !strings.Contains(errs[0].Error(), "exit status 3") {
+		t.Errorf("expected AB and an exit error, got: %v, %v", results, errs)
+	}
+
+	// Test that a process that exited while it was idle is restarted for the next item
+	queue := make(chan string)
+	out, errc := ExecStage[string, string](context.Background(), queue, os.Args[0], []string{"-test.run=TestExecHelperProcess"},
+		StringCodec{}, StringCodec{}, 0, 1, execHelperOptions("newline"))
+	queue <- "pid"
+	pid, _ := strconv.Atoi(<-out)
+	proc, _ := os.FindProcess(pid)
+	if err := proc.Kill(); err != nil {
+		t.Fatalf("expected the helper process to be killed, got: %v", err)
+	}
+	// The process can no longer be signalled once it has been waited on
+	waitFor(t, "the helper process to be waited on", func() bool { return proc.Signal(syscall.Signal(0)) != nil })
+	time.Sleep(10 * time.Millisecond)
+	queue <- "b"
+	close(queue)
+	if res := <-out; res != "B" {
+		t.Errorf("expected B from a new process, got: %q", res)
+	}
+	for err := range errc {
+		t.Errorf("expected no errors, got: %v", err)
+	}
+
+	// Test that a process that times out is killed and restarted
+	opts := execHelperOptions("newline")
+	opts.Timeout = 100 * time.Millisecond
+	results, errs = runExecStage([]string{"sleep", "c"}, 1, opts)
+	if strings.Join(results, "") != "C" || len(errs) != 1 || !strings.Contains(errs[0].Error(), "timed out") {
+		t.Errorf("expected C and a timeout error, got: %v, %v", results, errs)
+	}
+
+	// Test that new lines are rejected with FrameNewline before a process is started
+	results, errs = runExecStage([]string{"a\nb"}, 1, execHelperOptions("newline"))
+	if len(results) != 0 || len(errs) != 1 || !strings.Contains(errs[0].Error(), "new line") {
+		t.Errorf("expected a single new line error, got: %v, %v", results, errs)
+	}
+	out, errc = ExecStage[string, string](context.Background(), ConvertSliceToClosedChannel([]string{"a\nb"}),
+		"pipelines-exec-missing-command", nil, StringCodec{}, StringCodec{}, 1, 1, ExecOptions{})
+	if err := <-errc; err == nil || !strings.Contains(err.Error(), "new line") {
+		t.Errorf("expected the item to be rejected without starting the command, got: %v", err)
+	}
+	for range out {
+	}
+}
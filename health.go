@@ -0,0 +1,301 @@
+package pipelines
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthOptions configures a HealthChecker
+type HealthOptions struct {
+	// ProgressTimeout is how long a stage with pending items may go without progress before it is not live, it
+	// defaults to a minute
+	ProgressTimeout time.Duration
+	// MaxErrorRate is the highest share of failed items over the last ten seconds for a stage to be live, it defaults
+	// to 0.5
+	MaxErrorRate float64
+	// MinRecords is the amount of items a stage needs over the last ten seconds before its error rate is checked, it
+	// defaults to 10
+	MinRecords int
+	// CheckTimeout limits the readiness checks, it defaults to 5 seconds
+	CheckTimeout time.Duration
+}
+
+// StageHealth is the health of a registered stage
+type StageHealth struct {
+	Name         string    `json:"name"`
+	Kind         string    `json:"kind"`
+	Live         bool      `json:"live"`
+	Ready        bool      `json:"ready"`
+	Pending      bool      `json:"pending"`
+	LastProgress time.Time `json:"lastProgress"`
+	// Records and Errors are counted from the MetricsHandler calls over the last ten seconds
+	Records   int64   `json:"records"`
+	Errors    int64   `json:"errors"`
+	ErrorRate float64 `json:"errorRate"`
+	// Reasons explain why the stage is not live or not ready
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// PipelineHealth is the health of a pipeline, it is live and ready when every stage is
+type PipelineHealth struct {
+	Name    string        `json:"name"`
+	Status  PipelineState `json:"status"`
+	Live    bool          `json:"live"`
+	Ready   bool          `json:"ready"`
+	Reasons []string      `json:"reasons,omitempty"`
+	Stages  []StageHealth `json:"stages"`
+}
+
+// HealthReport is the health of every pipeline registered with a HealthChecker
+type HealthReport struct {
+	Live      bool             `json:"live"`
+	Ready     bool             `json:"ready"`
+	Pipelines []PipelineHealth `json:"pipelines"`
+}
+
+type healthRates struct {
+	records rateCounter
+	errors  rateCounter
+}
+
+// HealthChecker derives liveness and readiness from the state of registered pipelines and from the MetricsHandler
+// calls it receives, so it is meant to be the MetricsHandler of those pipelines. Every call is forwarded to the next
+// MetricsHandler if one is given.
+//
+// A stage is live unless it has items pending and made no progress for the ProgressTimeout, or more than MaxErrorRate
+// of its items failed. A pipeline is ready while it is not draining or done and the readiness checks of its sources,
+// for example a ping of the connection they read from, pass.
+//
+// HealthChecker is an http.Handler meant to be mounted under a prefix with http.StripPrefix, it serves GET /live,
+// /ready and / for both, with 200 when healthy and 503 when not, and the HealthReport as JSON. /live does not run the
+// readiness checks so a slow dependency can not fail liveness.
+type HealthChecker struct {
+	opts HealthOptions
+	next MetricsHandler
+
+	mu        sync.Mutex
+	pipelines []*Pipeline
+	checks    map[string]map[string]func(context.Context) error
+	rates     map[string]*healthRates
+}
+
+// NewHealthChecker creates a HealthChecker, next may be nil
+func NewHealthChecker(opts HealthOptions, next MetricsHandler) *HealthChecker {
+	if opts.ProgressTimeout <= 0 {
+		opts.ProgressTimeout = time.Minute
+	}
+	if opts.MaxErrorRate <= 0 {
+		opts.MaxErrorRate = 0.5
+	}
+	if opts.MinRecords <= 0 {
+		opts.MinRecords = 10
+	}
+	if opts.CheckTimeout <= 0 {
+		opts.CheckTimeout = 5 * time.Second
+	}
+	return &HealthChecker{
+		opts:   opts,
+		next:   next,
+		checks: make(map[string]map[string]func(context.Context) error),
+		rates:  make(map[string]*healthRates),
+	}
+}
+
+// Register adds a pipeline to the checker, a pipeline with the same name is replaced
+func (h *HealthChecker) Register(p *Pipeline) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, existing := range h.pipelines {
+		if existing.Name() == p.Name() {
+			h.pipelines[i] = p
+			return
+		}
+	}
+	h.pipelines = append(h.pipelines, p)
+}
+
+// AddReadinessCheck adds a check for a stage of a pipeline, usually a source, the stage is not ready while it fails
+func (h *HealthChecker) AddReadinessCheck(pipeline string, stage string, check func(context.Context) error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.checks[pipeline] == nil {
+		h.checks[pipeline] = make(map[string]func(context.Context) error)
+	}
+	h.checks[pipeline][stage] = check
+}
+
+func (h *HealthChecker) stageRates(service string, stage string) *healthRates {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := service + "/" + stage
+	r, ok := h.rates[key]
+	if !ok {
+		r = &healthRates{}
+		h.rates[key] = r
+	}
+	return r
+}
+
+func (h *HealthChecker) RecordLastSuccessfulExecution(service string, stage string) {
+	if h.next != nil {
+		h.next.RecordLastSuccessfulExecution(service, stage)
+	}
+}
+
+func (h *HealthChecker) RecordExecutionTime(t time.Duration, service string, stage string, status string) {
+	if h.next != nil {
+		h.next.RecordExecutionTime(t, service, stage, status)
+	}
+}
+
+func (h *HealthChecker) IncrementRecordCount(service string, stage string) {
+	h.stageRates(service, stage).records.add(time.Now())
+	if h.next != nil {
+		h.next.IncrementRecordCount(service, stage)
+	}
+}
+
+func (h *HealthChecker) IncrementErrorCount(service string, stage string) {
+	h.stageRates(service, stage).errors.add(time.Now())
+	if h.next != nil {
+		h.next.IncrementErrorCount(service, stage)
+	}
+}
+
+// RecordPaused forwards to the next MetricsHandler if it implements PauseMetricsHandler
+func (h *HealthChecker) RecordPaused(service string, stage string, paused bool) {
+	if next, ok := h.next.(PauseMetricsHandler); ok {
+		next.RecordPaused(service, stage, paused)
+	}
+}
+
+// Check returns the health of every registered pipeline, it runs the readiness checks concurrently
+func (h *HealthChecker) Check(ctx context.Context) HealthReport {
+	return h.check(ctx, true)
+}
+
+// check returns the health of every registered pipeline, the readiness checks are only run if readiness is set
+func (h *HealthChecker) check(ctx context.Context, readiness bool) HealthReport {
+	h.mu.Lock()
+	pipelines := append([]*Pipeline(nil), h.pipelines...)
+	h.mu.Unlock()
+
+	report := HealthReport{Live: true, Ready: true, Pipelines: make([]PipelineHealth, 0, len(pipelines))}
+	for _, p := range pipelines {
+		ph := h.checkPipeline(ctx, p, readiness)
+		report.Live = report.Live && ph.Live
+		report.Ready = report.Ready && ph.Ready
+		report.Pipelines = append(report.Pipelines, ph)
+	}
+	return report
+}
+
+// runChecks runs the readiness checks of a pipeline concurrently and returns the error of each stage
+func (h *HealthChecker) runChecks(ctx context.Context, checks map[string]func(context.Context) error) map[string]error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(map[string]error, len(checks))
+	for stage, check := range checks {
+		wg.Add(1)
+		go func(stage string, check func(context.Context) error) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, h.opts.CheckTimeout)
+			defer cancel()
+			err := check(checkCtx)
+			mu.Lock()
+			errs[stage] = err
+			mu.Unlock()
+		}(stage, check)
+	}
+	wg.Wait()
+	return errs
+}
+
+func (h *HealthChecker) checkPipeline(ctx context.Context, p *Pipeline, readiness bool) PipelineHealth {
+	p.mu.Lock()
+	stages := append([]*stageState(nil), p.stages...)
+	p.mu.Unlock()
+	var checkErrs map[string]error
+	if readiness {
+		h.mu.Lock()
+		checks := make(map[string]func(context.Context) error, len(h.checks[p.name]))
+		for stage, check := range h.checks[p.name] {
+			checks[stage] = check
+		}
+		h.mu.Unlock()
+		checkErrs = h.runChecks(ctx, checks)
+	}
+
+	now := time.Now()
+	ph := PipelineHealth{Name: p.name, Status: p.Status(), Live: true, Ready: true, Stages: make([]StageHealth, 0, len(stages))}
+	switch ph.Status {
+	case PipelineDraining, PipelineDone:
+		ph.Ready = false
+		ph.Reasons = append(ph.Reasons, ph.Status.String())
+	}
+	for _, s := range stages {
+		rates := h.stageRates(p.name, s.name)
+		sh := StageHealth{
+			Name:         s.name,
+			Kind:         s.kind,
+			Live:         true,
+			Ready:        true,
+			LastProgress: time.Unix(0, s.lastProgress.Load()),
+			Records:      rates.records.sum(now),
+			Errors:       rates.errors.sum(now),
+		}
+		if sh.Records > 0 {
+			sh.ErrorRate = float64(sh.Errors) / float64(sh.Records)
+		}
+		if !s.done.Load() && !s.paused() {
+			sh.Pending = s.pending()
+			if idle := now.Sub(sh.LastProgress); sh.Pending && idle > h.opts.ProgressTimeout {
+				sh.Live = false
+				sh.Reasons = append(sh.Reasons, fmt.Sprintf("no progress for %s", idle.Round(time.Millisecond)))
+			}
+		}
+		if sh.Records >= int64(h.opts.MinRecords) && sh.ErrorRate > h.opts.MaxErrorRate {
+			sh.Live = false
+			sh.Reasons = append(sh.Reasons, fmt.Sprintf("error rate %.2f above %.2f", sh.ErrorRate, h.opts.MaxErrorRate))
+		}
+		if err := checkErrs[s.name]; err != nil {
+			sh.Ready = false
+			sh.Reasons = append(sh.Reasons, "readiness check failed: "+err.Error())
+		}
+		ph.Live = ph.Live && sh.Live
+		ph.Ready = ph.Ready && sh.Ready
+		ph.Stages = append(ph.Stages, sh)
+	}
+	return ph
+}
+
+func (h *HealthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAdminJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "only GET is allowed"})
+		return
+	}
+	path := strings.Trim(r.URL.Path, "/")
+	if path != "" && path != "live" && path != "ready" {
+		writeAdminJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	report := h.check(r.Context(), path != "live")
+	healthy := false
+	switch path {
+	case "":
+		healthy = report.Live && report.Ready
+	case "live":
+		healthy = report.Live
+	case "ready":
+		healthy = report.Ready
+	}
+	status := http.StatusOK
+	if !healthy {
+		status = http.StatusServiceUnavailable
+	}
+	writeAdminJSON(w, status, report)
+}
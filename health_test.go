@@ -0,0 +1,171 @@
+package pipelines
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthChecker(t *testing.T) {
+	mh := &statusMetricHandler{statuses: make(map[string]int)}
+	h := NewHealthChecker(HealthOptions{}, mh)
+	p := NewPipeline("ingest", PipelineOptions{MetricsHandler: h})
+	h.Register(p)
+	var connected atomic.Bool
+	connected.Store(true)
+	h.AddReadinessCheck("ingest", "source", func(ctx context.Context) error {
+		if !connected.Load() {
+			return fmt.Errorf("connection refused")
+		}
+		return nil
+	})
+
+	var failing atomic.Bool
+	queue, qErrs := PipelineQueue(context.Background(), func(ctx context.Context) (int, error) {
+		time.Sleep(time.Millisecond)
+		return 1, nil
+	}, 0, 1, p, "source")
+	dErrs := PipelineDequeue(queue, func(v int) error {
+		if failing.Load() {
+			return fmt.Errorf("failed")
+		}
+		return nil
+	}, 0, 1, p, "sink")
+	errs := Merge(qErrs, dErrs)
+	go func() {
+		for range errs {
+		}
+	}()
+
+	server := httptest.NewServer(http.StripPrefix("/health", h))
+	defer server.Close()
+	get := func(path string) (int, HealthReport) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		defer resp.Body.Close()
+		var report HealthReport
+		_ = json.NewDecoder(resp.Body).Decode(&report)
+		return resp.StatusCode, report
+	}
+
+	// Test that a running pipeline is live and ready
+	waitFor(t, "items to be recorded", func() bool { return h.Check(context.Background()).Pipelines[0].Stages[1].Records >= 10 })
+	status, report := get("/health/")
+	if status != http.StatusOK || !report.Live || !report.Ready || len(report.Pipelines[0].Stages) != 2 {
+		t.Errorf("expected a healthy pipeline, got: %d, %+v", status, report)
+	}
+	mh.mu.Lock()
+	if mh.statuses["success"] == 0 {
+		t.Errorf("expected the metrics to be forwarded")
+	}
+	mh.mu.Unlock()
+
+	// Test that a failing readiness check only fails readiness
+	connected.Store(false)
+	if status, report := get("/health/ready"); status != http.StatusServiceUnavailable || report.Pipelines[0].Stages[0].Ready {
+		t.Errorf("expected the source not to be ready, got: %d, %+v", status, report)
+	}
+	if status, _ := get("/health/live"); status != http.StatusOK {
+		t.Errorf("expected the pipeline to be live, got: %d", status)
+	}
+	connected.Store(true)
+
+	// Test that a high error rate fails liveness
+	failing.Store(true)
+	waitFor(t, "the error rate to rise", func() bool { return !h.Check(context.Background()).Live })
+	status, report = get("/health/live")
+	sink := report.Pipelines[0].Stages[1]
+	if status != http.StatusServiceUnavailable || sink.Live || sink.ErrorRate <= 0.5 || len(sink.Reasons) != 1 {
+		t.Errorf("expected the sink not to be live, got: %d, %+v", status, sink)
+	}
+	if status, _ := get("/health/ready"); status != http.StatusOK {
+		t.Errorf("expected the pipeline to be ready, got: %d", status)
+	}
+
+	// Test that a draining pipeline is not ready, it may be done already
+	p.Drain()
+	if status, report := get("/health/ready"); status != http.StatusServiceUnavailable || report.Pipelines[0].Reasons[0] == "" {
+		t.Errorf("expected the draining pipeline not to be ready, got: %d, %+v", status, report)
+	}
+	if status, _ := get("/health/unknown"); status != http.StatusNotFound {
+		t.Errorf("expected 404, got: %d", status)
+	}
+	waitFor(t, "the pipeline to be done", p.Done)
+}
+
+func TestHealthCheckerProgress(t *testing.T) {
+	h := NewHealthChecker(HealthOptions{ProgressTimeout: 20 * time.Millisecond}, nil)
+	p := NewPipeline("ingest", PipelineOptions{MetricsHandler: h})
+	h.Register(p)
+	release := make(chan struct{})
+	n := 0
+	queue, qErrs := PipelineQueue(context.Background(), func(ctx context.Context) (int, error) {
+		n++
+		if n > 2 {
+			return 0, ErrQueueEmpty
+		}
+		return n, nil
+	}, 0, 1, p, "source")
+	dErrs := PipelineDequeue(queue, func(v int) error {
+		<-release
+		return nil
+	}, 0, 1, p, "sink")
+
+	// Test that a stage with a pending item and no progress is not live
+	waitFor(t, "the sink to stop progressing", func() bool { return !h.Check(context.Background()).Live })
+	report := h.Check(context.Background())
+	if sink := report.Pipelines[0].Stages[1]; sink.Live || !sink.Pending || !report.Ready {
+		t.Errorf("expected the sink not to be live, got: %+v", report)
+	}
+
+	// Test that a pipeline that is done is live but not ready
+	close(release)
+	for range Merge(qErrs, dErrs) {
+	}
+	waitFor(t, "the pipeline to be done", p.Done)
+	report = h.Check(context.Background())
+	if !report.Live || report.Ready || report.Pipelines[0].Status != PipelineDone {
+		t.Errorf("expected a live pipeline that is not ready, got: %+v", report)
+	}
+}
+
+func TestHealthCheckerLiveness(t *testing.T) {
+	h := NewHealthChecker(HealthOptions{CheckTimeout: time.Second}, nil)
+	p := NewPipeline("ingest", PipelineOptions{MetricsHandler: h})
+	h.Register(p)
+	var calls atomic.Int32
+	slow := func(ctx context.Context) error {
+		calls.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}
+	h.AddReadinessCheck("ingest", "source", slow)
+	h.AddReadinessCheck("ingest", "sink", slow)
+
+	// Test that liveness and unknown paths do not run the readiness checks
+	for path, expected := range map[string]int{"/live": http.StatusOK, "/unknown": http.StatusNotFound} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != expected {
+			t.Errorf("expected %d for %s, got: %d", expected, path, rec.Code)
+		}
+	}
+	if calls.Load() != 0 {
+		t.Errorf("expected no readiness checks, got: %d", calls.Load())
+	}
+
+	// Test that the readiness checks run concurrently
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if calls.Load() != 2 || time.Since(start) >= 100*time.Millisecond {
+		t.Errorf("expected both checks to run at once, got: %d in %s", calls.Load(), time.Since(start))
+	}
+}
@@ -0,0 +1,196 @@
+package pipelines
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LatencyTracker is a MetricsHandler that keeps a sliding window of successful execution times so percentiles can be
+// derived from them. Every call is forwarded to the next MetricsHandler if one is given. A LatencyTracker is meant to be
+// used for a single stage. Hedge records the time of every successful attempt in the tracker it is given, so that
+// tracker should not be passed to MetricWrapperWorker as well.
+type LatencyTracker struct {
+	next MetricsHandler
+
+	mu      sync.Mutex
+	samples []time.Duration
+	pos     int
+	full    bool
+}
+
+// NewLatencyTracker creates a LatencyTracker that remembers the last window execution times, next may be nil
+func NewLatencyTracker(window int, next MetricsHandler) *LatencyTracker {
+	if window < 1 {
+		window = 1
+	}
+	return &LatencyTracker{
+		next:    next,
+		samples: make([]time.Duration, window),
+	}
+}
+
+func (lt *LatencyTracker) RecordLastSuccessfulExecution(service string, stage string) {
+	if lt.next != nil {
+		lt.next.RecordLastSuccessfulExecution(service, stage)
+	}
+}
+
+func (lt *LatencyTracker) RecordExecutionTime(t time.Duration, service string, stage string, status string) {
+	if status == "success" {
+		lt.add(t)
+	}
+	if lt.next != nil {
+		lt.next.RecordExecutionTime(t, service, stage, status)
+	}
+}
+
+// add records a successful execution time without forwarding it
+func (lt *LatencyTracker) add(t time.Duration) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.samples[lt.pos] = t
+	lt.pos = (lt.pos + 1) % len(lt.samples)
+	if lt.pos == 0 {
+		lt.full = true
+	}
+}
+
+func (lt *LatencyTracker) IncrementRecordCount(service string, stage string) {
+	if lt.next != nil {
+		lt.next.IncrementRecordCount(service, stage)
+	}
+}
+
+func (lt *LatencyTracker) IncrementErrorCount(service string, stage string) {
+	if lt.next != nil {
+		lt.next.IncrementErrorCount(service, stage)
+	}
+}
+
+// Percentile returns the p-th percentile (0 < p <= 1) of the recorded execution times and false if there are no samples
+func (lt *LatencyTracker) Percentile(p float64) (time.Duration, bool) {
+	lt.mu.Lock()
+	n := lt.pos
+	if lt.full {
+		n = len(lt.samples)
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, lt.samples[:n])
+	lt.mu.Unlock()
+
+	if n == 0 {
+		return 0, false
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(math.Ceil(p*float64(n))) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= n {
+		i = n - 1
+	}
+	return sorted[i], true
+}
+
+// HedgeOptions configures Hedge
+type HedgeOptions struct {
+	// Delay is how long to wait on the first attempt before starting the hedged attempt. It is also used as the fallback
+	// when a LatencyTracker is set but has no samples yet.
+	Delay time.Duration
+	// LatencyTracker derives the delay from the execution times of the attempts when set. Hedge records the time of
+	// every successful attempt from its own start, so the delay is not skewed by the calls that were hedged.
+	LatencyTracker *LatencyTracker
+	// Percentile of the observed execution times used as the delay, defaults to 0.95
+	Percentile float64
+	// MaxHedgeRatio caps the hedged attempts to this fraction of all calls, for example 0.05 allows hedging 5% of
+	// traffic. A value <= 0 disables hedging.
+	MaxHedgeRatio float64
+}
+
+// Hedge wraps a worker function so that if a call has not finished after a delay a second attempt is started, and the
+// first attempt to succeed wins. The context passed to the attempts is cancelled once the call returns so the losing
+// attempt can stop. If both attempts fail the last error is returned. The returned function can be used with
+// WorkerPool.
+func Hedge[T1, T2 any](ctx context.Context, f func(context.Context, T1) (T2, error), opts HedgeOptions) func(T1) (T2, error) {
+	if opts.Percentile <= 0 || opts.Percentile > 1 {
+		opts.Percentile = 0.95
+	}
+	budget := &hedgeBudget{ratio: opts.MaxHedgeRatio}
+
+	type result struct {
+		res T2
+		err error
+	}
+
+	return func(v T1) (T2, error) {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		// Buffered for both attempts so the loser never blocks once the call has returned
+		resC := make(chan result, 2)
+		attempt := func() {
+			start := time.Now()
+			res, err := f(attemptCtx, v)
+			if err == nil && opts.LatencyTracker != nil {
+				opts.LatencyTracker.add(time.Since(start))
+			}
+			resC <- result{res: res, err: err}
+		}
+
+		budget.call()
+		go attempt()
+		pending := 1
+
+		delay := opts.Delay
+		if opts.LatencyTracker != nil {
+			if d, ok := opts.LatencyTracker.Percentile(opts.Percentile); ok {
+				delay = d
+			}
+		}
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		for {
+			select {
+			case r := <-resC:
+				pending--
+				if r.err == nil || pending == 0 {
+					return r.res, r.err
+				}
+			case <-timer.C:
+				if budget.hedge() {
+					go attempt()
+					pending++
+				}
+			}
+		}
+	}
+}
+
+// hedgeBudget counts calls and hedges so that hedges never exceed the ratio of calls
+type hedgeBudget struct {
+	ratio float64
+
+	mu     sync.Mutex
+	calls  int
+	hedges int
+}
+
+func (b *hedgeBudget) call() {
+	b.mu.Lock()
+	b.calls++
+	b.mu.Unlock()
+}
+
+func (b *hedgeBudget) hedge() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if float64(b.hedges+1) > b.ratio*float64(b.calls) {
+		return false
+	}
+	b.hedges++
+	return true
+}
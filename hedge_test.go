@@ -0,0 +1,149 @@
+package pipelines
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHedge(t *testing.T) {
+	ctx := context.Background()
+
+	// The first attempt hangs until cancelled and every later attempt is fast
+	var attempts, cancelled int32
+	f := func(ctx context.Context, n int) (int, error) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			<-ctx.Done()
+			atomic.AddInt32(&cancelled, 1)
+			return 0, ctx.Err()
+		}
+		return n * 2, nil
+	}
+
+	// Test that the hedged attempt wins and the loser is cancelled
+	hedged := Hedge(ctx, f, HedgeOptions{Delay: time.Millisecond, MaxHedgeRatio: 1})
+	res, err := hedged(2)
+	if err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if res != 4 {
+		t.Errorf("expected 4, got: %d", res)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt32(&cancelled) != 1 {
+		t.Error("expected the losing attempt to be cancelled")
+	}
+
+	// Test that no hedge is started without budget
+	atomic.StoreInt32(&attempts, 0)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	hedged = Hedge(timeoutCtx, f, HedgeOptions{Delay: time.Millisecond})
+	if _, err := hedged(2); err == nil {
+		t.Error("expected an error as the only attempt hangs")
+	}
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Errorf("expected 1 attempt, got: %d", n)
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	b := &hedgeBudget{ratio: 0.1}
+	hedges := 0
+	for i := 0; i < 100; i++ {
+		b.call()
+		if b.hedge() {
+			hedges++
+		}
+	}
+	if hedges != 10 {
+		t.Errorf("expected 10 hedges, got: %d", hedges)
+	}
+}
+
+func TestLatencyTracker(t *testing.T) {
+	mh := &mockMetricHandler{}
+	lt := NewLatencyTracker(10, mh)
+	if _, ok := lt.Percentile(0.95); ok {
+		t.Error("expected no percentile without samples")
+	}
+
+	for i := 1; i <= 20; i++ {
+		lt.RecordExecutionTime(time.Duration(i)*time.Millisecond, "service", "stage", "success")
+	}
+	lt.RecordExecutionTime(time.Hour, "service", "stage", "fail")
+
+	// Only the last 10 successful samples are kept
+	if d, _ := lt.Percentile(0.95); d != 20*time.Millisecond {
+		t.Errorf("expected 20ms, got: %s", d)
+	}
+	if d, _ := lt.Percentile(0.5); d != 15*time.Millisecond {
+		t.Errorf("expected 15ms, got: %s", d)
+	}
+	if mh.executionTime != time.Hour {
+		t.Errorf("expected calls to be forwarded, got: %s", mh.executionTime)
+	}
+
+	// The first attempt of a call takes as long as the test says and every hedged attempt records when it started
+	var firstDuration atomic.Int64
+	var hedgedAt atomic.Int64
+	var calls atomic.Int32
+	f := func(ctx context.Context, n int) (int, error) {
+		if calls.Add(1) > 1 {
+			hedgedAt.Store(time.Now().UnixNano())
+			return n, nil
+		}
+		select {
+		case <-time.After(time.Duration(firstDuration.Load())):
+			return n, nil
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+
+	// Test that Hedge records the time of its attempts in the tracker
+	lt = NewLatencyTracker(5, nil)
+	hedged := Hedge(context.Background(), f, HedgeOptions{Delay: time.Minute, LatencyTracker: lt, MaxHedgeRatio: 1})
+	firstDuration.Store(int64(20 * time.Millisecond))
+	for i := 0; i < 5; i++ {
+		calls.Store(0)
+		_, _ = hedged(i)
+	}
+	delay, ok := lt.Percentile(0.95)
+	if !ok || delay < 20*time.Millisecond {
+		t.Fatalf("expected a percentile of at least 20ms, got: %s", delay)
+	}
+
+	// Test that an attempt faster than the percentile is not hedged, even though it is slower than a short Delay
+	hedged = Hedge(context.Background(), f, HedgeOptions{Delay: time.Millisecond, LatencyTracker: lt, MaxHedgeRatio: 1})
+	calls.Store(0)
+	firstDuration.Store(int64(delay / 4))
+	if res, err := hedged(1); err != nil || res != 1 {
+		t.Errorf("expected 1, got: %d, %v", res, err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected no hedge before the percentile, got: %d attempts", n)
+	}
+	// The fast attempt was recorded as well, so the percentile is taken again
+	delay, _ = lt.Percentile(0.95)
+
+	// Test that an attempt slower than the percentile is hedged, but not before the percentile passed
+	calls.Store(0)
+	firstDuration.Store(int64(time.Minute))
+	start := time.Now()
+	if res, err := hedged(2); err != nil || res != 2 {
+		t.Errorf("expected 2, got: %d, %v", res, err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("expected a hedge after the percentile, got: %d attempts", n)
+	}
+	if after := time.Unix(0, hedgedAt.Load()).Sub(start); after < delay || after > delay+time.Second {
+		t.Errorf("expected the hedge to start after %s, started after: %s", delay, after)
+	}
+
+	// Test that the cancelled attempt is not recorded, only the hedged attempt that won
+	if d, _ := lt.Percentile(0.95); d > delay {
+		t.Errorf("expected the hedged call not to raise the percentile above %s, got: %s", delay, d)
+	}
+}
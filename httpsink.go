@@ -0,0 +1,383 @@
+package pipelines
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// HTTPSinkOptions configures an HTTPSink of items of type T
+type HTTPSinkOptions[T any] struct {
+	// Method defaults to POST
+	Method string
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+	// Header is added to every request
+	Header http.Header
+	// ContentType defaults to application/json, or application/x-ndjson when items are batched
+	ContentType string
+	// BatchSize is the number of items sent in a single request, the encoded items are separated by new lines. Items
+	// are only batched with items going to the same URL. Defaults to 1.
+	BatchSize int
+	// BatchTimeout sends a partial batch once its first item has waited this long. A value <= 0 means partial batches
+	// are only sent by Flush or once the queue is drained.
+	BatchTimeout time.Duration
+	// MaxRetries is the number of times a request is retried on a connection error, a 5xx or a 429. Defaults to 3, a
+	// negative value disables retrying.
+	MaxRetries int
+	// Backoff is the wait before the first retry, it doubles for every retry after that up to MaxBackoff. A Retry-After
+	// header in the response takes precedence but is capped at MaxBackoff as well. Defaults to 100 milliseconds.
+	Backoff time.Duration
+	// MaxBackoff defaults to 10 seconds
+	MaxBackoff time.Duration
+	// MaxConcurrency is the most requests in flight at once, shared by every worker writing to the sink. A value <= 0
+	// means no limit.
+	MaxConcurrency int
+	// IdempotencyKeyHeader is the header the idempotency keys are sent in, defaults to Idempotency-Key
+	IdempotencyKeyHeader string
+	// IdempotencyKey returns the key of an item, the keys of the items in a request are sent comma separated. If it is
+	// nil the key is derived from the encoded item, so the same item always has the same key across retries and
+	// restarts.
+	IdempotencyKey func(item T) string
+
+	// Service and Stage are passed to MetricsHandler
+	Service string
+	Stage   string
+	// MetricsHandler is called for every request, the status passed to RecordExecutionTime is the status code of the
+	// response or "fail" if there was no response
+	MetricsHandler MetricsHandler
+}
+
+// HTTPStatusError is returned by HTTPSink when a request does not succeed with a 2xx status
+type HTTPStatusError struct {
+	URL        string
+	StatusCode int
+	// Body is the start of the response body
+	Body string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("%s responded with %d %s: %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// HTTPSink sends items to an HTTP endpoint, Write can be used as a dequeue function and is safe for several workers.
+// The URL is a text/template executed with the item, for example https://example.com/users/{{.ID}}.
+//
+// Every item gets an idempotency key, derived from its encoding or returned by the IdempotencyKey option, so the same
+// item always has the same key across retries and restarts. The keys of the items in a request are sent comma
+// separated in IdempotencyKeyHeader.
+type HTTPSink[T any] struct {
+	ctx  context.Context
+	url  *template.Template
+	enc  Encoder[T]
+	opts HTTPSinkOptions[T]
+	sem  chan struct{}
+
+	mu      sync.Mutex
+	batches map[string]*httpSinkBatch
+}
+
+type httpSinkBatch struct {
+	url  string
+	body bytes.Buffer
+	// keys are the idempotency keys of the items in the batch
+	keys    []string
+	started time.Time
+}
+
+// NewHTTPSink creates an HTTPSink, requests and the waits between retries are cancelled once ctx is done
+func NewHTTPSink[T any](ctx context.Context, urlTemplate string, enc Encoder[T], opts HTTPSinkOptions[T]) (*HTTPSink[T], error) {
+	tmpl, err := template.New("url").Parse(urlTemplate)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Method == "" {
+		opts.Method = http.MethodPost
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.BatchSize < 1 {
+		opts.BatchSize = 1
+	}
+	if opts.ContentType == "" {
+		opts.ContentType = "application/json"
+		if opts.BatchSize > 1 {
+			opts.ContentType = "application/x-ndjson"
+		}
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = 3
+	}
+	if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = 100 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 10 * time.Second
+	}
+	if opts.IdempotencyKeyHeader == "" {
+		opts.IdempotencyKeyHeader = "Idempotency-Key"
+	}
+
+	s := &HTTPSink[T]{
+		ctx:     ctx,
+		url:     tmpl,
+		enc:     enc,
+		opts:    opts,
+		batches: make(map[string]*httpSinkBatch),
+	}
+	if opts.MaxConcurrency > 0 {
+		s.sem = make(chan struct{}, opts.MaxConcurrency)
+	}
+	return s, nil
+}
+
+// Write adds the item to the batch for its URL and sends the batch once it is full. Any partial batch that is older
+// than BatchTimeout is sent as well, the errors of every request that was sent are returned.
+func (s *HTTPSink[T]) Write(v T) error {
+	var url strings.Builder
+	if err := s.url.Execute(&url, v); err != nil {
+		return err
+	}
+	b, err := s.enc.Encode(v)
+	if err != nil {
+		return err
+	}
+	var key string
+	if s.opts.IdempotencyKey != nil {
+		key = s.opts.IdempotencyKey(v)
+	} else {
+		sum := sha256.Sum256(b)
+		key = hex.EncodeToString(sum[:16])
+	}
+
+	s.mu.Lock()
+	batch, ok := s.batches[url.String()]
+	if !ok {
+		batch = &httpSinkBatch{url: url.String(), started: time.Now()}
+		s.batches[batch.url] = batch
+	}
+	if len(batch.keys) > 0 {
+		batch.body.WriteByte('\n')
+	}
+	batch.body.Write(b)
+	batch.keys = append(batch.keys, key)
+
+	var ready []*httpSinkBatch
+	if len(batch.keys) >= s.opts.BatchSize {
+		delete(s.batches, batch.url)
+		ready = append(ready, batch)
+	}
+	ready = append(ready, s.takeBatches(false)...)
+	s.mu.Unlock()
+
+	return s.sendAll(ready)
+}
+
+// Flush sends every partial batch
+func (s *HTTPSink[T]) Flush() error {
+	s.mu.Lock()
+	ready := s.takeBatches(true)
+	s.mu.Unlock()
+	return s.sendAll(ready)
+}
+
+// flushStale sends the partial batches that are older than BatchTimeout
+func (s *HTTPSink[T]) flushStale() error {
+	s.mu.Lock()
+	ready := s.takeBatches(false)
+	s.mu.Unlock()
+	return s.sendAll(ready)
+}
+
+// takeBatches removes every batch if all is set, otherwise the ones older than BatchTimeout. Must be called while
+// holding mu.
+func (s *HTTPSink[T]) takeBatches(all bool) []*httpSinkBatch {
+	var taken []*httpSinkBatch
+	for url, batch := range s.batches {
+		if all || (s.opts.BatchTimeout > 0 && time.Since(batch.started) >= s.opts.BatchTimeout) {
+			delete(s.batches, url)
+			taken = append(taken, batch)
+		}
+	}
+	return taken
+}
+
+func (s *HTTPSink[T]) sendAll(batches []*httpSinkBatch) error {
+	var errs []error
+	for _, batch := range batches {
+		if err := s.send(batch); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// send makes the request for the batch, retrying it while the failure is retryable
+func (s *HTTPSink[T]) send(batch *httpSinkBatch) error {
+	backoff := s.opts.Backoff
+	for attempt := 0; ; attempt++ {
+		retryAfter, retry, err := s.do(batch)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= s.opts.MaxRetries {
+			return err
+		}
+
+		wait := retryAfter
+		if wait <= 0 {
+			wait = backoff
+			backoff *= 2
+			if backoff > s.opts.MaxBackoff {
+				backoff = s.opts.MaxBackoff
+			}
+		}
+		if wait > s.opts.MaxBackoff {
+			wait = s.opts.MaxBackoff
+		}
+		select {
+		case <-s.ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// do makes a single request, it returns the wait requested by a Retry-After header and if the request can be retried
+func (s *HTTPSink[T]) do(batch *httpSinkBatch) (time.Duration, bool, error) {
+	if s.sem != nil {
+		select {
+		case s.sem <- struct{}{}:
+		case <-s.ctx.Done():
+			return 0, false, s.ctx.Err()
+		}
+		defer func() { <-s.sem }()
+	}
+
+	req, err := http.NewRequestWithContext(s.ctx, s.opts.Method, batch.url, bytes.NewReader(batch.body.Bytes()))
+	if err != nil {
+		return 0, false, err
+	}
+	for k, vs := range s.opts.Header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	req.Header.Set("Content-Type", s.opts.ContentType)
+	req.Header.Set(s.opts.IdempotencyKeyHeader, strings.Join(batch.keys, ","))
+
+	now := time.Now()
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		s.record(time.Since(now), 0)
+		return 0, s.ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	s.record(time.Since(now), resp.StatusCode)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return 0, false, nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	_, _ = io.Copy(io.Discard, resp.Body)
+	err = &HTTPStatusError{URL: batch.url, StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()), retry, err
+}
+
+// record reports the outcome of a request, a status code of 0 means there was no response
+func (s *HTTPSink[T]) record(d time.Duration, statusCode int) {
+	mh := s.opts.MetricsHandler
+	if mh == nil {
+		return
+	}
+	mh.IncrementRecordCount(s.opts.Service, s.opts.Stage)
+	if statusCode == 0 {
+		mh.IncrementErrorCount(s.opts.Service, s.opts.Stage)
+		mh.RecordExecutionTime(d, s.opts.Service, s.opts.Stage, "fail")
+		return
+	}
+	if statusCode < 200 || statusCode >= 300 {
+		mh.IncrementErrorCount(s.opts.Service, s.opts.Stage)
+	} else {
+		mh.RecordLastSuccessfulExecution(s.opts.Service, s.opts.Stage)
+	}
+	mh.RecordExecutionTime(d, s.opts.Service, s.opts.Stage, strconv.Itoa(statusCode))
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date, returning 0 if it is missing or
+// invalid
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// Drain is the same as Dequeue with Write as the dequeue function, but sends the partial batches once they are older
+// than BatchTimeout and once the queue is drained. The errors of those requests are sent on the error channel as well.
+func (s *HTTPSink[T]) Drain(queue <-chan T, bufferSize int, workers int) <-chan error {
+	// Sanity check for bufSize as the channel is created here as well
+	if bufferSize < 0 {
+		bufferSize = 0
+	}
+	errc := make(chan error, bufferSize)
+	go func() {
+		defer close(errc)
+		// Stale batches are flushed on their own goroutine so a slow request does not hold up the errors of Write
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+		if s.opts.BatchTimeout > 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ticker := time.NewTicker(s.opts.BatchTimeout / 2)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-stop:
+						return
+					case <-ticker.C:
+						if err := s.flushStale(); err != nil {
+							errc <- err
+						}
+					}
+				}
+			}()
+		}
+
+		for err := range Dequeue(queue, s.Write, bufferSize, workers) {
+			errc <- err
+		}
+		close(stop)
+		wg.Wait()
+		if err := s.Flush(); err != nil {
+			errc <- err
+		}
+	}()
+	return errc
+}
@@ -0,0 +1,235 @@
+package pipelines
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type httpSinkItem struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type statusMetricHandler struct {
+	mu       sync.Mutex
+	statuses map[string]int
+	errors   int
+}
+
+func (smh *statusMetricHandler) RecordLastSuccessfulExecution(service string, stage string) {}
+func (smh *statusMetricHandler) RecordExecutionTime(d time.Duration, service string, stage string, status string) {
+	smh.mu.Lock()
+	defer smh.mu.Unlock()
+	smh.statuses[status]++
+}
+func (smh *statusMetricHandler) IncrementRecordCount(service string, stage string) {}
+func (smh *statusMetricHandler) IncrementErrorCount(service string, stage string) {
+	smh.mu.Lock()
+	defer smh.mu.Unlock()
+	smh.errors++
+}
+
+func TestHTTPSink(t *testing.T) {
+	var mu sync.Mutex
+	bodies := make(map[string][]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies[r.URL.Path] = append(bodies[r.URL.Path], string(b))
+		mu.Unlock()
+		if r.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("expected application/x-ndjson, got: %s", r.Header.Get("Content-Type"))
+		}
+		if keys := strings.Split(r.Header.Get("Idempotency-Key"), ","); len(keys) != strings.Count(string(b), "\n")+1 || keys[0] == "" {
+			t.Errorf("expected a key per item, got: %v", keys)
+		}
+	}))
+	defer server.Close()
+
+	// Test that items are batched per URL and partial batches are sent once the queue is drained
+	mh := &statusMetricHandler{statuses: make(map[string]int)}
+	s, err := NewHTTPSink[httpSinkItem](context.Background(), server.URL+"/{{.Name}}", JSONCodec[httpSinkItem]{},
+		HTTPSinkOptions[httpSinkItem]{BatchSize: 2, MetricsHandler: mh, IdempotencyKey: func(v httpSinkItem) string {
+			return strconv.Itoa(v.ID)
+		}})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	items := []httpSinkItem{{1, "a"}, {2, "b"}, {3, "a"}, {4, "a"}}
+	for err := range s.Drain(ConvertSliceToClosedChannel(items), 0, 1) {
+		t.Errorf("expected no errors, got: %v", err)
+	}
+	if len(bodies["/a"]) != 2 || bodies["/a"][0] != "{\"id\":1,\"name\":\"a\"}\n{\"id\":3,\"name\":\"a\"}" {
+		t.Errorf("expected two requests to /a, got: %v", bodies["/a"])
+	}
+	if len(bodies["/b"]) != 1 {
+		t.Errorf("expected one request to /b, got: %v", bodies["/b"])
+	}
+	if mh.statuses["200"] != 3 || mh.errors != 0 {
+		t.Errorf("expected 3 requests with 200, got: %v, %d errors", mh.statuses, mh.errors)
+	}
+
+	// Test that an invalid template is rejected
+	if _, err := NewHTTPSink[httpSinkItem](context.Background(), "{{", JSONCodec[httpSinkItem]{}, HTTPSinkOptions[httpSinkItem]{}); err == nil {
+		t.Errorf("expected an error for an invalid template")
+	}
+}
+
+func TestHTTPSinkRetries(t *testing.T) {
+	var calls atomic.Int32
+	var mu sync.Mutex
+	keys := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		keys[r.Header.Get("Idempotency-Key")]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/flaky":
+			if calls.Add(1)%3 != 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		case "/bad":
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid item"))
+		}
+	}))
+	defer server.Close()
+
+	// Test that 5xx responses are retried with the same idempotency key
+	mh := &statusMetricHandler{statuses: make(map[string]int)}
+	opts := HTTPSinkOptions[httpSinkItem]{Backoff: time.Millisecond, MetricsHandler: mh}
+	s, _ := NewHTTPSink[httpSinkItem](context.Background(), server.URL+"/{{.Name}}", JSONCodec[httpSinkItem]{}, opts)
+	if err := s.Write(httpSinkItem{1, "flaky"}); err != nil {
+		t.Errorf("expected the retries to succeed, got: %v", err)
+	}
+	if len(keys) != 1 {
+		t.Errorf("expected a single idempotency key, got: %v", keys)
+	}
+	if mh.statuses["503"] != 2 || mh.statuses["200"] != 1 || mh.errors != 2 {
+		t.Errorf("expected two 503 and one 200, got: %v, %d errors", mh.statuses, mh.errors)
+	}
+
+	// Test that an item has the same key when it is sent again, also by a new sink as after a restart
+	if err := s.Write(httpSinkItem{1, "ok"}); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	restarted, _ := NewHTTPSink[httpSinkItem](context.Background(), server.URL+"/{{.Name}}", JSONCodec[httpSinkItem]{}, opts)
+	if err := restarted.Write(httpSinkItem{1, "ok"}); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if err := restarted.Write(httpSinkItem{2, "ok"}); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if len(keys) != 3 {
+		t.Errorf("expected a key per distinct item, got: %v", keys)
+	}
+
+	// Test that 4xx responses are not retried
+	err := s.Write(httpSinkItem{2, "bad"})
+	var statusErr *HTTPStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadRequest || statusErr.Body != "invalid item" {
+		t.Errorf("expected a 400 status error, got: %v", err)
+	}
+	if mh.statuses["400"] != 1 {
+		t.Errorf("expected a single 400, got: %v", mh.statuses)
+	}
+
+	// Test that the retries give up
+	opts.MaxRetries = 1
+	s, _ = NewHTTPSink[httpSinkItem](context.Background(), server.URL+"/{{.Name}}", JSONCodec[httpSinkItem]{}, opts)
+	calls.Store(0)
+	if err := s.Write(httpSinkItem{3, "flaky"}); err == nil {
+		t.Errorf("expected an error after one retry")
+	}
+	if calls.Load() != 2 {
+		t.Errorf("expected 2 calls, got: %d", calls.Load())
+	}
+
+	// Test that the wait of a Retry-After header is capped at MaxBackoff
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer limited.Close()
+	s, _ = NewHTTPSink[httpSinkItem](context.Background(), limited.URL, JSONCodec[httpSinkItem]{},
+		HTTPSinkOptions[httpSinkItem]{MaxRetries: 2, MaxBackoff: 10 * time.Millisecond})
+	start := time.Now()
+	if err := s.Write(httpSinkItem{4, "limited"}); err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("expected the retries to give up quickly, got: %v after %s", err, time.Since(start))
+	}
+}
+
+func TestHTTPSinkConcurrency(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	// Test that the limit is shared by every worker
+	s, _ := NewHTTPSink[int](context.Background(), server.URL, JSONCodec[int]{}, HTTPSinkOptions[int]{MaxConcurrency: 2})
+	items := make([]int, 20)
+	for err := range s.Drain(ConvertSliceToClosedChannel(items), 0, 8) {
+		t.Errorf("expected no errors, got: %v", err)
+	}
+	if maxInFlight.Load() != 2 {
+		t.Errorf("expected at most 2 requests in flight, got: %d", maxInFlight.Load())
+	}
+}
+
+func TestHTTPSinkBatchTimeout(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer server.Close()
+
+	// Test that a partial batch is sent once it is older than the timeout, without waiting for the queue to drain
+	s, _ := NewHTTPSink[int](context.Background(), server.URL, JSONCodec[int]{},
+		HTTPSinkOptions[int]{BatchSize: 10, BatchTimeout: 20 * time.Millisecond})
+	queue := make(chan int)
+	errc := s.Drain(queue, 0, 1)
+	queue <- 1
+	time.Sleep(100 * time.Millisecond)
+	if calls.Load() != 1 {
+		t.Errorf("expected the partial batch to be sent, got: %d calls", calls.Load())
+	}
+	close(queue)
+	for err := range errc {
+		t.Errorf("expected no errors, got: %v", err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := map[string]time.Duration{
+		"":                              0,
+		"5":                             5 * time.Second,
+		"-1":                            0,
+		"soon":                          0,
+		"Mon, 01 Jan 2024 00:00:30 GMT": 30 * time.Second,
+		"Sun, 31 Dec 2023 00:00:00 GMT": 0,
+	}
+	for v, expected := range tests {
+		if d := parseRetryAfter(v, now); d != expected {
+			t.Errorf("%q: expected %v, got: %v", v, expected, d)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package pipelines
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HTTPSourceOptions configures an HTTPSource
+type HTTPSourceOptions struct {
+	// BufferSize is the buffer of the channel returned by Queue, requests are rejected with 429 once it is full. It is
+	// also the most items a single request can hold. Defaults to 100.
+	BufferSize int
+	// RetryAfter is sent in the Retry-After header of 429 responses, defaults to one second
+	RetryAfter time.Duration
+	// MaxBodySize is the largest request body in bytes that is accepted, defaults to 10MB
+	MaxBodySize int64
+	// Sync makes each request wait until all of its items are done, so the response reports the outcome of processing
+	Sync bool
+	// SyncTimeout is the longest a synchronous request waits before responding with 504, defaults to 30 seconds
+	SyncTimeout time.Duration
+}
+
+// HTTPSource is an http.Handler that accepts POSTed JSON items and feeds them into a pipeline. The body can hold a
+// single JSON value or several separated by new lines (NDJSON). Items are sent on the channel returned by Queue, the
+// stages are lifted with AckStage, AckFilterStage and AckDequeue like any other tracked source.
+//
+// The handler never blocks on the pipeline: if the buffer can not hold every item of the request it responds with 429
+// and a Retry-After header. Otherwise it responds with 202, or in Sync mode waits for the items and responds with 200
+// once they are all done or 500 with the first error.
+type HTTPSource[T any] struct {
+	opts  HTTPSourceOptions
+	queue chan Tracked[T]
+
+	mu     sync.Mutex
+	closed bool
+}
+
+type httpSourceResponse struct {
+	Accepted int    `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+// NewHTTPSource creates an HTTPSource, Close should be called once the server stops so the pipeline drains
+func NewHTTPSource[T any](opts HTTPSourceOptions) *HTTPSource[T] {
+	// The channel has to be buffered as the handler never blocks on it
+	if opts.BufferSize < 1 {
+		opts.BufferSize = 100
+	}
+	if opts.RetryAfter <= 0 {
+		opts.RetryAfter = time.Second
+	}
+	if opts.MaxBodySize <= 0 {
+		opts.MaxBodySize = 10 << 20
+	}
+	if opts.SyncTimeout <= 0 {
+		opts.SyncTimeout = 30 * time.Second
+	}
+	return &HTTPSource[T]{
+		opts:  opts,
+		queue: make(chan Tracked[T], opts.BufferSize),
+	}
+}
+
+// Queue returns the channel the items are sent on, it is closed by Close
+func (s *HTTPSource[T]) Queue() <-chan Tracked[T] {
+	return s.queue
+}
+
+// Close stops accepting requests, which are answered with 503, and closes the queue channel
+func (s *HTTPSource[T]) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.queue)
+}
+
+func writeHTTPSourceResponse(w http.ResponseWriter, status int, resp httpSourceResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (s *HTTPSource[T]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeHTTPSourceResponse(w, http.StatusMethodNotAllowed, httpSourceResponse{Error: "only POST is allowed"})
+		return
+	}
+
+	// Decode every item before anything is queued so a bad request is rejected as a whole
+	items := make([]T, 0, 1)
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.opts.MaxBodySize))
+	for {
+		var v T
+		err := dec.Decode(&v)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				writeHTTPSourceResponse(w, http.StatusRequestEntityTooLarge, httpSourceResponse{Error: err.Error()})
+				return
+			}
+			msg := fmt.Sprintf("item %d: %v", len(items)+1, err)
+			writeHTTPSourceResponse(w, http.StatusBadRequest, httpSourceResponse{Error: msg})
+			return
+		}
+		items = append(items, v)
+	}
+	if len(items) == 0 {
+		writeHTTPSourceResponse(w, http.StatusBadRequest, httpSourceResponse{Error: "no items in request body"})
+		return
+	}
+	if len(items) > s.opts.BufferSize {
+		msg := fmt.Sprintf("a request can hold at most %d items", s.opts.BufferSize)
+		writeHTTPSourceResponse(w, http.StatusRequestEntityTooLarge, httpSourceResponse{Error: msg})
+		return
+	}
+
+	// Every item shares one tracker so the request is done once all of them are
+	done := make(chan error, 1)
+	tracker := &ackTracker{
+		pending: len(items),
+		ack:     func() { done <- nil },
+		nack:    func(err error) { done <- err },
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		writeHTTPSourceResponse(w, http.StatusServiceUnavailable, httpSourceResponse{Error: "source is closed"})
+		return
+	}
+	// Only handlers send on the channel and they hold mu, so once there is room for the batch the sends never block
+	if cap(s.queue)-len(s.queue) < len(items) {
+		s.mu.Unlock()
+		retryAfter := int(s.opts.RetryAfter.Round(time.Second) / time.Second)
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeHTTPSourceResponse(w, http.StatusTooManyRequests, httpSourceResponse{Error: "pipeline is full"})
+		return
+	}
+	for _, v := range items {
+		s.queue <- Tracked[T]{Item: v, tracker: tracker}
+	}
+	s.mu.Unlock()
+
+	if !s.opts.Sync {
+		writeHTTPSourceResponse(w, http.StatusAccepted, httpSourceResponse{Accepted: len(items)})
+		return
+	}
+
+	timer := time.NewTimer(s.opts.SyncTimeout)
+	defer timer.Stop()
+	resp := httpSourceResponse{Accepted: len(items)}
+	select {
+	case err := <-done:
+		if err != nil {
+			resp.Error = err.Error()
+			writeHTTPSourceResponse(w, http.StatusInternalServerError, resp)
+			return
+		}
+		writeHTTPSourceResponse(w, http.StatusOK, resp)
+	case <-timer.C:
+		resp.Error = "timed out waiting on the pipeline"
+		writeHTTPSourceResponse(w, http.StatusGatewayTimeout, resp)
+	case <-r.Context().Done():
+	}
+}
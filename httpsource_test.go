@@ -0,0 +1,95 @@
+package pipelines
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPSource(t *testing.T) {
+	src := NewHTTPSource[readerRecord](HTTPSourceOptions{BufferSize: 2})
+	server := httptest.NewServer(src)
+	defer server.Close()
+
+	post := func(body string) *http.Response {
+		resp, err := http.Post(server.URL, "application/x-ndjson", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// Test that a single item and an NDJSON batch are accepted
+	if resp := post(`{"name":"a"}`); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("expected 202, got: %d", resp.StatusCode)
+	}
+	if resp := post("{\"name\":\"b\"}\n{\"name\":\"c\"}\n"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected 429 as only one slot is left, got: %d", resp.StatusCode)
+	} else if resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("expected Retry-After 1, got: %s", resp.Header.Get("Retry-After"))
+	}
+	if item := <-src.Queue(); item.Item.Name != "a" {
+		t.Errorf("expected a, got: %v", item.Item)
+	}
+	if resp := post("{\"name\":\"b\"}\n{\"name\":\"c\"}\n"); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("expected 202, got: %d", resp.StatusCode)
+	}
+
+	// Test that bad requests are rejected
+	if resp := post(`{"name":`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400, got: %d", resp.StatusCode)
+	}
+	if resp := post("{}\n{}\n{}\n"); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, got: %d", resp.StatusCode)
+	}
+	resp, err := http.Get(server.URL)
+	if err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got: %v, %v", resp.StatusCode, err)
+	}
+	resp.Body.Close()
+
+	src.Close()
+	count := 0
+	for range src.Queue() {
+		count++
+	}
+	if count != 2 {
+		t.Errorf("expected 2 remaining items, got: %d", count)
+	}
+	if resp := post(`{"name":"d"}`); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got: %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPSourceSync(t *testing.T) {
+	src := NewHTTPSource[readerRecord](HTTPSourceOptions{BufferSize: 10, Sync: true})
+	server := httptest.NewServer(src)
+	defer server.Close()
+
+	dequeueErrC := Dequeue(src.Queue(), AckDequeue(func(r readerRecord) error {
+		if r.Name == "bad" {
+			return fmt.Errorf("cannot store %s", r.Name)
+		}
+		return nil
+	}), 10, 2)
+	go func() {
+		for range dequeueErrC {
+		}
+	}()
+
+	// Test that the response waits on the outcome of the pipeline
+	resp, err := http.Post(server.URL, "application/json", strings.NewReader("{\"name\":\"a\"}\n{\"name\":\"b\"}"))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got: %v, %v", resp.StatusCode, err)
+	}
+	resp.Body.Close()
+	resp, err = http.Post(server.URL, "application/json", strings.NewReader("{\"name\":\"a\"}\n{\"name\":\"bad\"}"))
+	if err != nil || resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got: %v, %v", resp.StatusCode, err)
+	}
+	resp.Body.Close()
+	src.Close()
+}
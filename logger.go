@@ -0,0 +1,122 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Logger receives the lifecycle events of the stages, such as starting, a worker exiting or a channel being closed,
+// along with every error they pass on. The key values always contain the component, such as "WorkerPool", stages
+// started with a service or stage name, such as the Pipeline and Traced variants, add them to every event and errors
+// that are an ErrPipeline add their service and stage otherwise.
+type Logger interface {
+	Info(msg string, keyvals ...any)
+	Error(msg string, err error, keyvals ...any)
+}
+
+type loggerHolder struct {
+	l Logger
+}
+
+var logger atomic.Pointer[loggerHolder]
+
+// SetLogger sets the Logger used by the stages, logging is off until it is called. Passing nil turns it off again.
+func SetLogger(l Logger) {
+	if l == nil {
+		logger.Store(nil)
+		return
+	}
+	logger.Store(&loggerHolder{l: l})
+}
+
+func logInfo(component string, msg string, keyvals ...any) {
+	h := logger.Load()
+	if h == nil {
+		return
+	}
+	h.l.Info(msg, append([]any{"component", component}, keyvals...)...)
+}
+
+func logError(component string, msg string, err error, keyvals ...any) {
+	h := logger.Load()
+	if h == nil {
+		return
+	}
+	kv := []any{"component", component}
+	var pErr ErrPipeline
+	if errors.As(err, &pErr) && !hasKey(keyvals, "service") {
+		kv = append(kv, "service", pErr.Service(), "stage", pErr.Stage())
+	}
+	h.l.Error(msg, err, append(kv, keyvals...)...)
+}
+
+func hasKey(keyvals []any, key string) bool {
+	for i := 0; i < len(keyvals); i += 2 {
+		if keyvals[i] == key {
+			return true
+		}
+	}
+	return false
+}
+
+type stdLogger struct {
+	l *log.Logger
+}
+
+// NewStdLogger adapts a logger of the standard log package, each event is printed as a single line of the level, the
+// message and the key values as key=value. The standard logger is used if l is nil.
+func NewStdLogger(l *log.Logger) Logger {
+	if l == nil {
+		l = log.Default()
+	}
+	return stdLogger{l: l}
+}
+
+func (sl stdLogger) Info(msg string, keyvals ...any) {
+	sl.l.Print(formatLogLine("INFO", msg, keyvals))
+}
+
+func (sl stdLogger) Error(msg string, err error, keyvals ...any) {
+	sl.l.Print(formatLogLine("ERROR", msg, append(keyvals, "error", err)))
+}
+
+func formatLogLine(level string, msg string, keyvals []any) string {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		var v any = "(missing)"
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+		s := fmt.Sprint(v)
+		if strings.ContainsAny(s, " \"=") {
+			s = fmt.Sprintf("%q", s)
+		}
+		fmt.Fprintf(&b, " %v=%s", keyvals[i], s)
+	}
+	return b.String()
+}
+
+type keyValueLogger struct {
+	info  func(msg string, keyvals ...any)
+	error func(msg string, keyvals ...any)
+}
+
+// NewKeyValueLogger adapts a key value style logger from its info and error functions, such as the Info and Error
+// methods of a slog.Logger. The error is passed to errorFunc under the key "error".
+func NewKeyValueLogger(infoFunc func(msg string, keyvals ...any), errorFunc func(msg string, keyvals ...any)) Logger {
+	return keyValueLogger{info: infoFunc, error: errorFunc}
+}
+
+func (kl keyValueLogger) Info(msg string, keyvals ...any) {
+	kl.info(msg, keyvals...)
+}
+
+func (kl keyValueLogger) Error(msg string, err error, keyvals ...any) {
+	kl.error(msg, append(keyvals, "error", err)...)
+}
@@ -0,0 +1,215 @@
+package pipelines
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type logEntry struct {
+	level   string
+	msg     string
+	keyvals map[string]any
+}
+
+type recordingLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+func (rl *recordingLogger) add(level string, msg string, keyvals []any) {
+	kv := make(map[string]any)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		kv[fmt.Sprint(keyvals[i])] = keyvals[i+1]
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.entries = append(rl.entries, logEntry{level: level, msg: msg, keyvals: kv})
+}
+
+func (rl *recordingLogger) Info(msg string, keyvals ...any) {
+	rl.add("info", msg, keyvals)
+}
+
+func (rl *recordingLogger) Error(msg string, err error, keyvals ...any) {
+	rl.add("error", msg, append(keyvals, "error", err))
+}
+
+// count returns the amount of entries for the component and message
+func (rl *recordingLogger) count(component string, msg string) int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	n := 0
+	for _, e := range rl.entries {
+		if e.keyvals["component"] == component && e.msg == msg {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLogger(t *testing.T) {
+	rl := &recordingLogger{}
+	SetLogger(rl)
+	defer SetLogger(nil)
+
+	i := 0
+	queueFunc := func(ctx context.Context) (int, error) {
+		i++
+		if i > 3 {
+			return 0, ErrQueueEmpty
+		}
+		return i, nil
+	}
+	queue, qErrs := Queue(context.Background(), queueFunc, 0, 1)
+	workFunc := WorkerFunctionErrWrapper(func(n int) (int, error) {
+		if n == 2 {
+			return 0, fmt.Errorf("failed")
+		}
+		return n, nil
+	}, "service", "double")
+	results, wErrs := WorkerPool(queue, workFunc, 0, 2)
+	a, b := make(chan int, 3), make(chan int, 3)
+	go func() {
+		Broadcast(results, a, b)
+		close(a)
+		close(b)
+	}()
+	dErrs := Dequeue(a, func(n int) error { return nil }, 0, 1)
+	errs := Merge(qErrs, wErrs, dErrs)
+	for range b {
+	}
+	for range errs {
+	}
+
+	// Test that the lifecycle of every stage is logged
+	expected := []struct {
+		component string
+		msg       string
+		n         int
+	}{
+		{"Queue", "started", 1},
+		{"Queue", "worker exited", 1},
+		{"Queue", "channels closed", 1},
+		{"WorkerPool", "started", 1},
+		{"WorkerPool", "work function failed", 1},
+		{"WorkerPool", "worker exited", 2},
+		{"WorkerPool", "channels closed", 1},
+		{"Broadcast", "started", 1},
+		{"Broadcast", "input drained", 1},
+		{"Dequeue", "worker exited", 1},
+		{"Dequeue", "channel closed", 1},
+		{"Merge", "started", 1},
+		{"Merge", "channel closed", 1},
+	}
+	for _, e := range expected {
+		if n := rl.count(e.component, e.msg); n != e.n {
+			t.Errorf("expected %d %s %q entries, got: %d", e.n, e.component, e.msg, n)
+		}
+	}
+
+	// Test that errors carry the service and stage of the PipelineErr
+	rl.mu.Lock()
+	for _, e := range rl.entries {
+		if e.level == "error" && (e.keyvals["service"] != "service" || e.keyvals["stage"] != "double") {
+			t.Errorf("expected the service and stage, got: %v", e.keyvals)
+		}
+	}
+	rl.mu.Unlock()
+
+	// Test that a cancelled queue is logged
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	queue, _ = Queue(ctx, queueFunc, 0, 1)
+	for range queue {
+	}
+	if n := rl.count("Queue", "worker cancelled"); n != 1 {
+		t.Errorf("expected a cancelled worker, got: %d", n)
+	}
+
+	// Test that nothing is logged once the logger is removed
+	SetLogger(nil)
+	before := rl.count("Merge", "started")
+	for range Merge[int]() {
+	}
+	if rl.count("Merge", "started") != before {
+		t.Errorf("expected no entries after the logger is removed")
+	}
+}
+
+func TestLoggerStageNames(t *testing.T) {
+	rl := &recordingLogger{}
+	SetLogger(rl)
+	defer SetLogger(nil)
+
+	p := NewPipeline("service", PipelineOptions{})
+	tracer := NewTracer(TracerOptions{Service: "traced", Exporter: &MemorySpanExporter{}})
+	defer tracer.Close(context.Background())
+	i := 0
+	queue, qErrs := PipelineQueue(context.Background(), func(ctx context.Context) (int, error) {
+		i++
+		if i > 3 {
+			return 0, ErrQueueEmpty
+		}
+		return i, nil
+	}, 0, 1, p, "source")
+	envelopes, wErrs := WorkerPoolWithOptions(queue, func(n int) (Envelope[int], error) {
+		if n == 2 {
+			return Envelope[int]{}, fmt.Errorf("failed")
+		}
+		return NewEnvelope(n), nil
+	}, StageOptions{Stage: "wrap", Service: "service"})
+	dErrs := TracedDequeue(envelopes, func(e Envelope[int]) error { return nil }, 0, 1, tracer, "sink")
+	for range Merge(qErrs, wErrs, dErrs) {
+	}
+
+	// Test that every lifecycle line of a named stage carries its service and stage
+	expected := map[string]string{"source": "service", "wrap": "service", "sink": "traced"}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	lines := make(map[string]int)
+	for _, e := range rl.entries {
+		if e.keyvals["component"] == "Merge" {
+			continue
+		}
+		stage, _ := e.keyvals["stage"].(string)
+		if service, ok := expected[stage]; !ok || e.keyvals["service"] != service {
+			t.Errorf("expected the service and stage, got: %s %v", e.msg, e.keyvals)
+		}
+		lines[stage]++
+	}
+	// started, worker exited and channels closed, along with the failure of wrap
+	if lines["source"] != 3 || lines["wrap"] != 4 || lines["sink"] != 3 {
+		t.Errorf("expected every lifecycle line, got: %v", lines)
+	}
+}
+
+func TestLoggerAdapters(t *testing.T) {
+	// Test the standard log adapter
+	var buf bytes.Buffer
+	l := NewStdLogger(log.New(&buf, "", 0))
+	l.Info("started", "component", "Queue", "workers", 2)
+	l.Error("failed", fmt.Errorf("bad item"), "component", "Dequeue")
+	expected := "INFO started component=Queue workers=2\nERROR failed component=Dequeue error=\"bad item\"\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q, got: %q", expected, buf.String())
+	}
+
+	// Test the key value adapter
+	var lines []string
+	record := func(level string) func(string, ...any) {
+		return func(msg string, keyvals ...any) {
+			lines = append(lines, level+" "+msg+" "+fmt.Sprintln(keyvals...))
+		}
+	}
+	l = NewKeyValueLogger(record("info"), record("error"))
+	l.Info("started", "workers", 2)
+	l.Error("failed", fmt.Errorf("bad"), "worker", 1)
+	if strings.Join(lines, "|") != "info started workers 2\n|error failed worker 1 error bad\n" {
+		t.Errorf("unexpected lines: %v", lines)
+	}
+}
@@ -14,6 +14,18 @@ type MetricsHandler interface {
 	IncrementErrorCount(service string, stage string)
 }
 
+// DuplicateMetricsHandler is an optional extension of MetricsHandler, stages such as Dedup will check if the passed in
+// MetricsHandler implements it and report each dropped duplicate
+type DuplicateMetricsHandler interface {
+	IncrementDuplicateCount(service string, stage string)
+}
+
+// PauseMetricsHandler is an optional extension of MetricsHandler, a Pipeline will check if its MetricsHandler
+// implements it and report every stage whenever it is paused or resumed
+type PauseMetricsHandler interface {
+	RecordPaused(service string, stage string, paused bool)
+}
+
 // MetricWrapperQueue wraps a queue function and calls functions of a MetricsHandler
 func MetricWrapperQueue[T any](f func(ctx context.Context) (T, error), service string, stage string, mh MetricsHandler) func(ctx context.Context) (T, error) {
 	return func(ctx context.Context) (T, error) {
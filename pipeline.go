@@ -0,0 +1,638 @@
+package pipelines
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WorkerState is what a worker of a registered stage is doing
+type WorkerState int32
+
+const (
+	// WorkerIdle is waiting to receive an item
+	WorkerIdle WorkerState = iota
+	// WorkerBusy is running the stage function
+	WorkerBusy
+	// WorkerSending is waiting for the next stage to take its result
+	WorkerSending
+	// WorkerSendingError is waiting for its error to be taken from the error channel
+	WorkerSendingError
+	// WorkerPaused is waiting for the stage to be resumed
+	WorkerPaused
+	// WorkerExited has returned
+	WorkerExited
+)
+
+func (s WorkerState) String() string {
+	switch s {
+	case WorkerIdle:
+		return "idle"
+	case WorkerBusy:
+		return "busy"
+	case WorkerSending:
+		return "sending"
+	case WorkerSendingError:
+		return "sending_error"
+	case WorkerPaused:
+		return "paused"
+	case WorkerExited:
+		return "exited"
+	default:
+		return "unknown"
+	}
+}
+
+func (s WorkerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *WorkerState) UnmarshalText(b []byte) error {
+	for state := WorkerIdle; state <= WorkerExited; state++ {
+		if state.String() == string(b) {
+			*s = state
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown worker state %q", b)
+}
+
+// PipelineOptions configures a Pipeline
+type PipelineOptions struct {
+	// MetricsHandler is called for every item of every stage with the pipeline name as the service, it is optional
+	MetricsHandler MetricsHandler
+}
+
+// Pipeline is a handle on a running pipeline. Stages started with PipelineQueue, PipelineWorkerPool and
+// PipelineDequeue register with it so their state can be inspected with Snapshot, for example through an
+// AdminHandler, and the pipeline can be paused or drained as a whole.
+type Pipeline struct {
+	name string
+	opts PipelineOptions
+	gate *pauseGate
+
+	mu     sync.Mutex
+	stages []*stageState
+
+	drain     chan struct{}
+	drainOnce sync.Once
+}
+
+// NewPipeline creates a Pipeline, the name is used as the service of its metrics and logs
+func NewPipeline(name string, opts PipelineOptions) *Pipeline {
+	return &Pipeline{
+		name:  name,
+		opts:  opts,
+		gate:  newPauseGate(),
+		drain: make(chan struct{}),
+	}
+}
+
+// Name returns the name of the pipeline
+func (p *Pipeline) Name() string {
+	return p.name
+}
+
+// Pause stops the queues from producing and the workers from taking new items, items already being worked on finish
+func (p *Pipeline) Pause() {
+	if p.gate.pause() {
+		logInfo("Pipeline", "paused", "service", p.name)
+		p.reportPaused()
+	}
+}
+
+// Resume undoes Pause, stages that were paused on their own with PauseStage stay paused
+func (p *Pipeline) Resume() {
+	if p.gate.resume() {
+		logInfo("Pipeline", "resumed", "service", p.name)
+		p.reportPaused()
+	}
+}
+
+// Paused returns if the pipeline is paused
+func (p *Pipeline) Paused() bool {
+	return p.gate.isPaused()
+}
+
+// PauseStage pauses a single registered stage, see Pause
+func (p *Pipeline) PauseStage(stage string) error {
+	s, err := p.stage(stage)
+	if err != nil {
+		return err
+	}
+	if s.gate.pause() {
+		logInfo(s.kind, "paused", "service", p.name, "stage", s.name)
+		s.reportPaused()
+	}
+	return nil
+}
+
+// ResumeStage undoes PauseStage, the stage stays paused if the whole pipeline is
+func (p *Pipeline) ResumeStage(stage string) error {
+	s, err := p.stage(stage)
+	if err != nil {
+		return err
+	}
+	if s.gate.resume() {
+		logInfo(s.kind, "resumed", "service", p.name, "stage", s.name)
+		s.reportPaused()
+	}
+	return nil
+}
+
+// StagePaused returns if a registered stage is paused, either on its own or with the whole pipeline
+func (p *Pipeline) StagePaused(stage string) (bool, error) {
+	s, err := p.stage(stage)
+	if err != nil {
+		return false, err
+	}
+	return s.paused(), nil
+}
+
+func (p *Pipeline) stage(name string) (*stageState, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range p.stages {
+		if s.name == name {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("pipeline %s has no stage %s", p.name, name)
+}
+
+// reportPaused reports the paused state of every stage, as pausing the pipeline changes all of them
+func (p *Pipeline) reportPaused() {
+	p.mu.Lock()
+	stages := append([]*stageState(nil), p.stages...)
+	p.mu.Unlock()
+	for _, s := range stages {
+		s.reportPaused()
+	}
+}
+
+// Drain stops the queues of the pipeline so that the items already produced flow through and every channel is closed,
+// the pipeline and its stages are resumed if they were paused
+func (p *Pipeline) Drain() {
+	p.drainOnce.Do(func() {
+		close(p.drain)
+		logInfo("Pipeline", "draining", "service", p.name)
+	})
+	p.mu.Lock()
+	stages := append([]*stageState(nil), p.stages...)
+	p.mu.Unlock()
+	for _, s := range stages {
+		_ = p.ResumeStage(s.name)
+	}
+	p.Resume()
+}
+
+// Draining returns if Drain was called
+func (p *Pipeline) Draining() bool {
+	select {
+	case <-p.drain:
+		return true
+	default:
+		return false
+	}
+}
+
+// PipelineState is the overall state of a Pipeline
+type PipelineState int
+
+const (
+	// PipelineRunning has stages that are not done and is neither paused nor draining. Single stages may be paused.
+	PipelineRunning PipelineState = iota
+	// PipelinePaused is paused as a whole
+	PipelinePaused
+	// PipelineDraining was drained but not every stage is done yet
+	PipelineDraining
+	// PipelineDone has every registered stage done
+	PipelineDone
+)
+
+func (s PipelineState) String() string {
+	switch s {
+	case PipelineRunning:
+		return "running"
+	case PipelinePaused:
+		return "paused"
+	case PipelineDraining:
+		return "draining"
+	case PipelineDone:
+		return "done"
+	default:
+		return "unknown"
+	}
+}
+
+func (s PipelineState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *PipelineState) UnmarshalText(b []byte) error {
+	for state := PipelineRunning; state <= PipelineDone; state++ {
+		if state.String() == string(b) {
+			*s = state
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown pipeline state %q", b)
+}
+
+// Status returns the overall state of the pipeline
+func (p *Pipeline) Status() PipelineState {
+	switch {
+	case p.Done():
+		return PipelineDone
+	case p.Draining():
+		return PipelineDraining
+	case p.Paused():
+		return PipelinePaused
+	default:
+		return PipelineRunning
+	}
+}
+
+// Done returns if every registered stage has finished
+func (p *Pipeline) Done() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range p.stages {
+		if !s.done.Load() {
+			return false
+		}
+	}
+	return len(p.stages) > 0
+}
+
+// pauseGate blocks workers while it is paused
+type pauseGate struct {
+	mu     sync.Mutex
+	paused bool
+	// resumed is closed once the gate is resumed and pausedc once it is paused, each is replaced by the other change
+	resumed chan struct{}
+	pausedc chan struct{}
+}
+
+func newPauseGate() *pauseGate {
+	return &pauseGate{resumed: make(chan struct{}), pausedc: make(chan struct{})}
+}
+
+// pause returns false if the gate was already paused
+func (g *pauseGate) pause() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		return false
+	}
+	g.paused = true
+	g.resumed = make(chan struct{})
+	close(g.pausedc)
+	return true
+}
+
+// resume returns false if the gate was not paused
+func (g *pauseGate) resume() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paused {
+		return false
+	}
+	g.paused = false
+	close(g.resumed)
+	g.pausedc = make(chan struct{})
+	return true
+}
+
+// pausedChan returns a channel that is closed while the gate is paused
+func (g *pauseGate) pausedChan() <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.pausedc
+}
+
+func (g *pauseGate) isPaused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+// wait blocks while the gate is paused, it returns false if done is closed first
+func (g *pauseGate) wait(done <-chan struct{}) bool {
+	g.mu.Lock()
+	paused, resumed := g.paused, g.resumed
+	g.mu.Unlock()
+	if !paused {
+		return true
+	}
+	select {
+	case <-resumed:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// ChannelStats is the length and capacity of a channel
+type ChannelStats struct {
+	Len int `json:"len"`
+	Cap int `json:"cap"`
+}
+
+// channelProbe reads the stats of a channel and identifies it so stages can be linked by the channels they share
+type channelProbe struct {
+	id    uintptr
+	stats func() ChannelStats
+}
+
+func probeChannel[T any](c <-chan T) *channelProbe {
+	return &channelProbe{
+		id:    reflect.ValueOf(c).Pointer(),
+		stats: func() ChannelStats { return ChannelStats{Len: len(c), Cap: cap(c)} },
+	}
+}
+
+// rateCounter counts events in one second buckets to derive the rate over the last ten seconds
+type rateCounter struct {
+	mu      sync.Mutex
+	buckets [10]int64
+	last    int64
+}
+
+func (rc *rateCounter) advance(now int64) {
+	if now <= rc.last {
+		return
+	}
+	for i := rc.last + 1; i <= now && i <= rc.last+int64(len(rc.buckets)); i++ {
+		rc.buckets[i%int64(len(rc.buckets))] = 0
+	}
+	rc.last = now
+}
+
+func (rc *rateCounter) add(now time.Time) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.advance(now.Unix())
+	rc.buckets[rc.last%int64(len(rc.buckets))]++
+}
+
+// sum returns the amount of events over the last ten seconds
+func (rc *rateCounter) sum(now time.Time) int64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.advance(now.Unix())
+	var sum int64
+	for _, n := range rc.buckets {
+		sum += n
+	}
+	return sum
+}
+
+func (rc *rateCounter) rate(now time.Time) float64 {
+	return float64(rc.sum(now)) / float64(len(rc.buckets))
+}
+
+// stageState is the live state of a registered stage, it is updated by the workers without holding the pipeline lock
+type stageState struct {
+	p       *Pipeline
+	name    string
+	kind    string
+	gate    *pauseGate
+	input   *channelProbe
+	output  *channelProbe
+	errors  *channelProbe
+	workers []atomic.Int32
+
+	processed    atomic.Int64
+	errorCount   atomic.Int64
+	lastProgress atomic.Int64
+	done         atomic.Bool
+	throughput   rateCounter
+
+	mu          sync.Mutex
+	lastErr     string
+	lastErrTime time.Time
+}
+
+func (p *Pipeline) register(name string, kind string, workers int, input *channelProbe, output *channelProbe, errs *channelProbe) *stageState {
+	s := &stageState{
+		p:       p,
+		name:    name,
+		kind:    kind,
+		gate:    newPauseGate(),
+		input:   input,
+		output:  output,
+		errors:  errs,
+		workers: make([]atomic.Int32, workers),
+	}
+	s.lastProgress.Store(time.Now().UnixNano())
+	p.mu.Lock()
+	p.stages = append(p.stages, s)
+	p.mu.Unlock()
+	if p.Paused() {
+		s.reportPaused()
+	}
+	return s
+}
+
+func (s *stageState) setState(worker int, state WorkerState) {
+	s.workers[worker].Store(int32(state))
+}
+
+func (s *stageState) progress() {
+	s.lastProgress.Store(time.Now().UnixNano())
+}
+
+func (s *stageState) paused() bool {
+	return s.p.gate.isPaused() || s.gate.isPaused()
+}
+
+// pausedChans returns the channels that are closed while the pipeline or the stage is paused
+func (s *stageState) pausedChans() (<-chan struct{}, <-chan struct{}) {
+	return s.p.gate.pausedChan(), s.gate.pausedChan()
+}
+
+// reportPaused reports the paused state of the stage if the MetricsHandler implements PauseMetricsHandler
+func (s *stageState) reportPaused() {
+	if mh, ok := s.p.opts.MetricsHandler.(PauseMetricsHandler); ok {
+		mh.RecordPaused(s.p.name, s.name, s.paused())
+	}
+}
+
+// wait blocks the worker while the pipeline or the stage is paused, it returns false if done is closed first
+func (s *stageState) wait(worker int, done <-chan struct{}) bool {
+	for {
+		var g *pauseGate
+		switch {
+		case s.p.gate.isPaused():
+			g = s.p.gate
+		case s.gate.isPaused():
+			g = s.gate
+		default:
+			return true
+		}
+		s.setState(worker, WorkerPaused)
+		if !g.wait(done) {
+			return false
+		}
+	}
+}
+
+// record counts an item that was worked on and reports it to the MetricsHandler
+func (s *stageState) record(start time.Time, err error) {
+	now := time.Now()
+	s.processed.Add(1)
+	s.throughput.add(now)
+	s.progress()
+	if err != nil {
+		s.errorCount.Add(1)
+		s.mu.Lock()
+		s.lastErr = err.Error()
+		s.lastErrTime = now
+		s.mu.Unlock()
+	}
+
+	mh := s.p.opts.MetricsHandler
+	if mh == nil {
+		return
+	}
+	mh.IncrementRecordCount(s.p.name, s.name)
+	if err != nil {
+		mh.IncrementErrorCount(s.p.name, s.name)
+		mh.RecordExecutionTime(now.Sub(start), s.p.name, s.name, "fail")
+		return
+	}
+	mh.RecordLastSuccessfulExecution(s.p.name, s.name)
+	mh.RecordExecutionTime(now.Sub(start), s.p.name, s.name, "success")
+}
+
+func (s *stageState) exit(worker int) {
+	s.setState(worker, WorkerExited)
+}
+
+func (s *stageState) finish() {
+	s.done.Store(true)
+	s.progress()
+}
+
+// PipelineSnapshot is the state of a Pipeline at a point in time
+type PipelineSnapshot struct {
+	Name     string          `json:"name"`
+	Status   PipelineState   `json:"status"`
+	Paused   bool            `json:"paused"`
+	Draining bool            `json:"draining"`
+	Done     bool            `json:"done"`
+	Stages   []StageSnapshot `json:"stages"`
+}
+
+// StageSnapshot is the state of a registered stage at a point in time
+type StageSnapshot struct {
+	Name string `json:"name"`
+	// Kind is Queue, WorkerPool or Dequeue
+	Kind   string `json:"kind"`
+	Paused bool   `json:"paused"`
+	// Inputs are the names of the stages whose output channel this stage reads from
+	Inputs  []string      `json:"inputs"`
+	Workers []WorkerState `json:"workers"`
+	Busy    int           `json:"busy"`
+	Idle    int           `json:"idle"`
+	// Input, Output and Errors are nil for the channels the stage does not have
+	Input        *ChannelStats `json:"input,omitempty"`
+	Output       *ChannelStats `json:"output,omitempty"`
+	Errors       *ChannelStats `json:"errors,omitempty"`
+	Processed    int64         `json:"processed"`
+	ErrorCount   int64         `json:"errorCount"`
+	Throughput   float64       `json:"throughput"`
+	LastError    string        `json:"lastError,omitempty"`
+	LastErrorAt  time.Time     `json:"lastErrorAt"`
+	LastProgress time.Time     `json:"lastProgress"`
+	Done         bool          `json:"done"`
+}
+
+func (cp *channelProbe) snapshot() *ChannelStats {
+	if cp == nil {
+		return nil
+	}
+	stats := cp.stats()
+	return &stats
+}
+
+// Snapshot returns the current state of the pipeline and every registered stage, in the order they were registered
+func (p *Pipeline) Snapshot() PipelineSnapshot {
+	p.mu.Lock()
+	stages := append([]*stageState(nil), p.stages...)
+	p.mu.Unlock()
+
+	now := time.Now()
+	snap := PipelineSnapshot{
+		Name:     p.name,
+		Status:   p.Status(),
+		Paused:   p.Paused(),
+		Draining: p.Draining(),
+		Done:     len(stages) > 0,
+	}
+	producers := make(map[uintptr]string)
+	for _, s := range stages {
+		if s.output != nil {
+			producers[s.output.id] = s.name
+		}
+	}
+	for _, s := range stages {
+		ss := StageSnapshot{
+			Name:         s.name,
+			Kind:         s.kind,
+			Paused:       s.paused(),
+			Workers:      make([]WorkerState, len(s.workers)),
+			Input:        s.input.snapshot(),
+			Output:       s.output.snapshot(),
+			Errors:       s.errors.snapshot(),
+			Processed:    s.processed.Load(),
+			ErrorCount:   s.errorCount.Load(),
+			Throughput:   s.throughput.rate(now),
+			LastProgress: time.Unix(0, s.lastProgress.Load()),
+			Done:         s.done.Load(),
+		}
+		if s.input != nil {
+			if name, ok := producers[s.input.id]; ok {
+				ss.Inputs = append(ss.Inputs, name)
+			}
+		}
+		for i := range s.workers {
+			ss.Workers[i] = WorkerState(s.workers[i].Load())
+			switch ss.Workers[i] {
+			case WorkerIdle, WorkerPaused:
+				ss.Idle++
+			case WorkerExited:
+			default:
+				ss.Busy++
+			}
+		}
+		s.mu.Lock()
+		ss.LastError, ss.LastErrorAt = s.lastErr, s.lastErrTime
+		s.mu.Unlock()
+		snap.Done = snap.Done && ss.Done
+		snap.Stages = append(snap.Stages, ss)
+	}
+	return snap
+}
+
+// PipelineQueue is the same as Queue but registers the stage with the pipeline. The workers stop calling queueFunc
+// while the pipeline is paused and return once it is drained.
+func PipelineQueue[T any](ctx context.Context, queueFunc func(context.Context) (T, error), bufferSize int, workers int, p *Pipeline, stage string) (<-chan T, <-chan error) {
+	return QueueWithOptions(ctx, queueFunc, StageOptions{BufferSize: bufferSize, Workers: workers, Pipeline: p, Stage: stage})
+}
+
+// PipelineWorkerPool is the same as WorkerPool but registers the stage with the pipeline. The workers stop taking new
+// items while the pipeline is paused.
+func PipelineWorkerPool[T1, T2 any](queue <-chan T1, workFunc func(T1) (T2, error), bufferSize int, workers int, p *Pipeline, stage string) (<-chan T2, <-chan error) {
+	return WorkerPoolWithOptions(queue, workFunc, StageOptions{BufferSize: bufferSize, Workers: workers, Pipeline: p, Stage: stage})
+}
+
+// PipelineDequeue is the same as Dequeue but registers the stage with the pipeline. The workers stop taking new items
+// while the pipeline is paused.
+func PipelineDequeue[T any](queue <-chan T, dequeueFunc func(T) error, bufferSize int, workers int, p *Pipeline, stage string) <-chan error {
+	return DequeueWithOptions(queue, dequeueFunc, StageOptions{BufferSize: bufferSize, Workers: workers, Pipeline: p, Stage: stage})
+}
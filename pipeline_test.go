@@ -0,0 +1,258 @@
+package pipelines
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it is true or fails the test after a second
+func waitFor(t *testing.T, msg string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", msg)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	mh := &statusMetricHandler{statuses: make(map[string]int)}
+	p := NewPipeline("service", PipelineOptions{MetricsHandler: mh})
+	var n atomic.Int32
+	queueFunc := func(ctx context.Context) (int, error) {
+		if v := n.Add(1); v <= 5 {
+			return int(v), nil
+		}
+		return 0, ErrQueueEmpty
+	}
+	queue, qErrs := PipelineQueue(context.Background(), queueFunc, 5, 1, p, "source")
+	doubled, wErrs := PipelineWorkerPool(queue, func(v int) (int, error) {
+		if v == 3 {
+			return 0, fmt.Errorf("bad item %d", v)
+		}
+		return v * 2, nil
+	}, 5, 2, p, "double")
+	var sum atomic.Int32
+	dErrs := PipelineDequeue(doubled, func(v int) error {
+		sum.Add(int32(v))
+		return nil
+	}, 5, 1, p, "sum")
+	errs := 0
+	for range Merge(qErrs, wErrs, dErrs) {
+		errs++
+	}
+	waitFor(t, "the pipeline to be done", p.Done)
+
+	// Test that the snapshot has every stage, linked by their channels
+	snap := p.Snapshot()
+	if snap.Name != "service" || !snap.Done || len(snap.Stages) != 3 {
+		t.Fatalf("expected 3 done stages, got: %+v", snap)
+	}
+	source, double, sink := snap.Stages[0], snap.Stages[1], snap.Stages[2]
+	if len(double.Inputs) != 1 || double.Inputs[0] != "source" || sink.Inputs[0] != "double" || source.Input != nil {
+		t.Errorf("expected source -> double -> sum, got: %v, %v", double.Inputs, sink.Inputs)
+	}
+	if source.Processed != 5 || double.Processed != 5 || double.ErrorCount != 1 || sink.Processed != 4 {
+		t.Errorf("expected the item counts, got: %d, %d, %d, %d", source.Processed, double.Processed, double.ErrorCount, sink.Processed)
+	}
+	if double.LastError != "bad item 3" || double.Output.Cap != 5 || sink.Output != nil {
+		t.Errorf("expected the last error and channel stats, got: %+v", double)
+	}
+	if len(double.Workers) != 2 || double.Workers[0] != WorkerExited || double.Throughput == 0 {
+		t.Errorf("expected exited workers and a throughput, got: %+v", double)
+	}
+	if errs != 1 || sum.Load() != 24 {
+		t.Errorf("expected a single error and a sum of 24, got: %d, %d", errs, sum.Load())
+	}
+
+	// Test that every item was reported to the MetricsHandler
+	if mh.statuses["success"] != 13 || mh.statuses["fail"] != 1 || mh.errors != 1 {
+		t.Errorf("expected 13 successes and a failure, got: %v", mh.statuses)
+	}
+}
+
+func TestPipelinePauseAndDrain(t *testing.T) {
+	p := NewPipeline("service", PipelineOptions{})
+	var produced atomic.Int32
+	queue, _ := PipelineQueue(context.Background(), func(ctx context.Context) (int, error) {
+		return int(produced.Add(1)), nil
+	}, 0, 1, p, "source")
+	var consumed atomic.Int32
+	dErrs := PipelineDequeue(queue, func(v int) error {
+		consumed.Add(1)
+		return nil
+	}, 0, 2, p, "sink")
+
+	// Test that a paused pipeline stops producing and consuming
+	waitFor(t, "items to flow", func() bool { return consumed.Load() > 10 })
+	p.Pause()
+	waitFor(t, "the sink to pause", func() bool {
+		workers := p.Snapshot().Stages[1].Workers
+		return workers[0] == WorkerPaused && workers[1] == WorkerPaused
+	})
+	before, consumedBefore := produced.Load(), consumed.Load()
+	time.Sleep(20 * time.Millisecond)
+	if produced.Load() != before || consumed.Load() != consumedBefore || !p.Snapshot().Paused {
+		t.Errorf("expected no items while paused, got: %d then %d", before, produced.Load())
+	}
+
+	// Test that the pipeline continues once resumed
+	p.Resume()
+	waitFor(t, "items to flow again", func() bool { return produced.Load() > before+10 })
+
+	// Test that draining stops the queue and closes every channel
+	p.Drain()
+	for range dErrs {
+	}
+	waitFor(t, "the pipeline to be done", p.Done)
+	if !p.Draining() || produced.Load() != consumed.Load() {
+		t.Errorf("expected every produced item to be consumed, got: %d, %d", produced.Load(), consumed.Load())
+	}
+}
+
+func TestPipelinePauseIdleWorkers(t *testing.T) {
+	p := NewPipeline("service", PipelineOptions{})
+	in := make(chan int)
+	var processed atomic.Int32
+	var started sync.WaitGroup
+	started.Add(2)
+	out, wErrs := PipelineWorkerPool(in, func(v int) (int, error) {
+		if processed.Add(1) <= 2 {
+			started.Done()
+			started.Wait()
+		}
+		return v, nil
+	}, 0, 2, p, "work")
+	// Both workers take an item so they are known to be waiting on the input afterwards
+	in <- 1
+	in <- 2
+	<-out
+	<-out
+
+	// Test that workers waiting for an item when the pipeline is paused do not process the next one
+	waitFor(t, "the workers to wait for items", func() bool {
+		workers := p.Snapshot().Stages[0].Workers
+		return workers[0] == WorkerIdle && workers[1] == WorkerIdle
+	})
+	p.Pause()
+	sent := make(chan struct{})
+	go func() {
+		in <- 1
+		close(sent)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if processed.Load() != 2 {
+		t.Errorf("expected no item to be processed after Pause returned, got: %d", processed.Load()-2)
+	}
+
+	// Test that the item is processed once resumed
+	p.Resume()
+	if v := <-out; v != 1 || processed.Load() != 3 {
+		t.Errorf("expected the item once resumed, got: %d, %d", v, processed.Load())
+	}
+	<-sent
+	close(in)
+	for range wErrs {
+	}
+}
+
+type pauseMetricHandler struct {
+	statusMetricHandler
+	mu     sync.Mutex
+	paused map[string]bool
+}
+
+func (pmh *pauseMetricHandler) RecordPaused(service string, stage string, paused bool) {
+	pmh.mu.Lock()
+	defer pmh.mu.Unlock()
+	pmh.paused[service+"/"+stage] = paused
+}
+
+func (pmh *pauseMetricHandler) get(key string) (bool, bool) {
+	pmh.mu.Lock()
+	defer pmh.mu.Unlock()
+	paused, ok := pmh.paused[key]
+	return paused, ok
+}
+
+func TestPipelinePauseStage(t *testing.T) {
+	mh := &pauseMetricHandler{statusMetricHandler: statusMetricHandler{statuses: make(map[string]int)}, paused: make(map[string]bool)}
+	p := NewPipeline("service", PipelineOptions{MetricsHandler: mh})
+	var produced atomic.Int32
+	queue, _ := PipelineQueue(context.Background(), func(ctx context.Context) (int, error) {
+		return int(produced.Add(1)), nil
+	}, 0, 1, p, "source")
+	var consumed atomic.Int32
+	dErrs := PipelineDequeue(queue, func(v int) error {
+		consumed.Add(1)
+		return nil
+	}, 0, 1, p, "sink")
+
+	// Test that pausing the source stops it while the sink is still running
+	waitFor(t, "items to flow", func() bool { return consumed.Load() > 10 })
+	if err := p.PauseStage("source"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	waitFor(t, "the source to pause", func() bool { return p.Snapshot().Stages[0].Workers[0] == WorkerPaused })
+	before := consumed.Load()
+	time.Sleep(20 * time.Millisecond)
+	snap := p.Snapshot()
+	if consumed.Load() != before || !snap.Stages[0].Paused || snap.Stages[1].Paused || p.Status() != PipelineRunning {
+		t.Errorf("expected only the source to be paused, got: %+v", snap)
+	}
+	if paused, _ := p.StagePaused("source"); !paused {
+		t.Errorf("expected the source to report paused")
+	}
+	if paused, ok := mh.get("service/source"); !paused || !ok {
+		t.Errorf("expected the paused source to be reported, got: %v", mh.paused)
+	}
+	if _, ok := mh.get("service/sink"); ok {
+		t.Errorf("expected the sink not to be reported, got: %v", mh.paused)
+	}
+
+	// Test that pausing the pipeline reports every stage and resuming it keeps the source paused
+	p.Pause()
+	if paused, _ := mh.get("service/sink"); !paused || p.Status() != PipelinePaused {
+		t.Errorf("expected the sink to be reported paused, got: %v, %s", mh.paused, p.Status())
+	}
+	p.Resume()
+	if paused, _ := mh.get("service/sink"); paused {
+		t.Errorf("expected the sink to be reported resumed")
+	}
+	if paused, _ := mh.get("service/source"); !paused {
+		t.Errorf("expected the source to stay paused")
+	}
+
+	// Test that resuming the stage continues the pipeline
+	if err := p.ResumeStage("source"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	waitFor(t, "items to flow again", func() bool { return consumed.Load() > before+10 })
+	if paused, _ := mh.get("service/source"); paused {
+		t.Errorf("expected the source to be reported resumed")
+	}
+
+	// Test that unknown stages return an error
+	if err := p.PauseStage("unknown"); err == nil {
+		t.Errorf("expected an error for an unknown stage")
+	}
+	if _, err := p.StagePaused("unknown"); err == nil {
+		t.Errorf("expected an error for an unknown stage")
+	}
+
+	// Test that draining resumes a paused stage
+	_ = p.PauseStage("sink")
+	p.Drain()
+	for range dErrs {
+	}
+	waitFor(t, "the pipeline to be done", p.Done)
+	if p.Status() != PipelineDone || produced.Load() != consumed.Load() {
+		t.Errorf("expected every produced item to be consumed, got: %s, %d, %d", p.Status(), produced.Load(), consumed.Load())
+	}
+}
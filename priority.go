@@ -0,0 +1,221 @@
+package pipelines
+
+import (
+	"container/heap"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// mergeInputs receives from a set of channels in a chosen order, closed channels are skipped
+type mergeInputs[T any] struct {
+	cs    []<-chan T
+	cases []reflect.SelectCase
+	open  int
+}
+
+func newMergeInputs[T any](cs []<-chan T) *mergeInputs[T] {
+	m := &mergeInputs[T]{cs: cs, cases: make([]reflect.SelectCase, len(cs)), open: len(cs)}
+	for i, c := range cs {
+		m.cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(c)}
+	}
+	return m
+}
+
+func (m *mergeInputs[T]) closed(i int) bool {
+	return m.cs[i] == nil
+}
+
+func (m *mergeInputs[T]) close(i int) {
+	m.cs[i] = nil
+	m.cases[i].Chan = reflect.Value{}
+	m.open--
+}
+
+// receive takes the first ready item of the inputs in order, if none is ready it blocks until any input is. Along with
+// the item it returns how many inputs from the start of order had no item ready, all of them if it had to block. It
+// returns false once every input is closed.
+func (m *mergeInputs[T]) receive(order []int) (int, T, int, bool) {
+	for m.open > 0 {
+		for n, i := range order {
+			if m.closed(i) {
+				continue
+			}
+			select {
+			case v, ok := <-m.cs[i]:
+				if !ok {
+					m.close(i)
+					continue
+				}
+				return i, v, n, true
+			default:
+			}
+		}
+		if m.open == 0 {
+			break
+		}
+		i, v, ok := reflect.Select(m.cases)
+		if !ok {
+			m.close(i)
+			continue
+		}
+		return i, v.Interface().(T), len(order), true
+	}
+	var zero T
+	return -1, zero, 0, false
+}
+
+// PriorityMerge is the same as Merge but always takes from the first input that has an item, so the inputs are given
+// from the highest to the lowest priority. The returned channel is unbuffered so the priority is decided when the
+// next stage takes an item, lower priority inputs are starved as long as higher ones have items.
+func PriorityMerge[T any](cs ...<-chan T) chan T {
+	out := make(chan T)
+	order := make([]int, len(cs))
+	for i := range order {
+		order[i] = i
+	}
+
+	logInfo("PriorityMerge", "started", "inputs", len(cs))
+	go func() {
+		m := newMergeInputs(cs)
+		for {
+			_, v, _, ok := m.receive(order)
+			if !ok {
+				break
+			}
+			out <- v
+		}
+		close(out)
+		logInfo("PriorityMerge", "channel closed")
+	}()
+	return out
+}
+
+// WeightedMerge is the same as Merge but takes from the inputs in proportion to their weights while they have items,
+// an input with weight 3 gets three items through for every item of an input with weight 1. Inputs that have no item
+// ready are skipped so their share goes to the others. weights are matched to the inputs by index, a missing or non
+// positive weight is 1. The returned channel is unbuffered like the one of PriorityMerge.
+func WeightedMerge[T any](weights []int, cs ...<-chan T) chan T {
+	out := make(chan T)
+	w := make([]int, len(cs))
+	for i := range w {
+		w[i] = 1
+		if i < len(weights) && weights[i] > 0 {
+			w[i] = weights[i]
+		}
+	}
+
+	logInfo("WeightedMerge", "started", "inputs", len(cs))
+	go func() {
+		m := newMergeInputs(cs)
+		// Smooth weighted round robin, every ready input gains its weight in credit for each item and the input an item
+		// is taken from pays the total, inputs are tried from the most credit down. Inputs that turn out to have no item
+		// ready give their credit back so an idle input can not bank credit for a burst once it returns.
+		credit := make([]int, len(cs))
+		order := make([]int, 0, len(cs))
+		for {
+			order = order[:0]
+			total := 0
+			for i := range cs {
+				if !m.closed(i) {
+					credit[i] += w[i]
+					total += w[i]
+					order = append(order, i)
+				}
+			}
+			sort.SliceStable(order, func(a, b int) bool { return credit[order[a]] > credit[order[b]] })
+			i, v, idle, ok := m.receive(order)
+			if !ok {
+				break
+			}
+			for _, j := range order[:idle] {
+				if j != i {
+					credit[j] -= w[j]
+					total -= w[j]
+				}
+			}
+			credit[i] -= total
+			out <- v
+		}
+		close(out)
+		logInfo("WeightedMerge", "channel closed")
+	}()
+	return out
+}
+
+type priorityItem[T any] struct {
+	item T
+	// key is the priority with the aging credit already subtracted for the time the item was buffered at
+	key float64
+	seq uint64
+}
+
+type priorityHeap[T any] []priorityItem[T]
+
+func (h priorityHeap[T]) Len() int { return len(h) }
+func (h priorityHeap[T]) Less(i, j int) bool {
+	if h[i].key != h[j].key {
+		return h[i].key > h[j].key
+	}
+	return h[i].seq < h[j].seq
+}
+func (h priorityHeap[T]) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *priorityHeap[T]) Push(x any)   { *h = append(*h, x.(priorityItem[T])) }
+func (h *priorityHeap[T]) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// PriorityBuffer buffers up to capacity items from queue and sends them on the returned channel with the highest
+// priority first, items of the same priority keep their order. Once the buffer is full it stops taking items so the
+// previous stages block as usual. To keep low priority items from starving, an item gains one priority for every aging
+// it waited in the buffer; an aging of 0 or less turns that off. The returned channel is closed once queue is closed and
+// the buffer is drained.
+func PriorityBuffer[T any](queue <-chan T, priority func(T) int, capacity int, aging time.Duration) <-chan T {
+	if capacity < 1 {
+		capacity = 1
+	}
+	out := make(chan T)
+
+	logInfo("PriorityBuffer", "started", "capacity", capacity)
+	go func() {
+		start := time.Now()
+		h := make(priorityHeap[T], 0, capacity)
+		var seq uint64
+		in := queue
+		for in != nil || len(h) > 0 {
+			// Only take new items while there is room and only send while there is an item
+			recv, send := in, chan T(nil)
+			if len(h) >= capacity {
+				recv = nil
+			}
+			var next T
+			if len(h) > 0 {
+				send, next = out, h[0].item
+			}
+
+			select {
+			case v, ok := <-recv:
+				if !ok {
+					in = nil
+					continue
+				}
+				// Subtracting the time since start divided by the aging gives the same order as adding the time each
+				// item waited, so the heap never has to be rebuilt
+				key := float64(priority(v))
+				if aging > 0 {
+					key -= float64(time.Since(start)) / float64(aging)
+				}
+				seq++
+				heap.Push(&h, priorityItem[T]{item: v, key: key, seq: seq})
+			case send <- next:
+				heap.Pop(&h)
+			}
+		}
+		close(out)
+		logInfo("PriorityBuffer", "channel closed")
+	}()
+	return out
+}
@@ -0,0 +1,158 @@
+package pipelines
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPriorityMerge(t *testing.T) {
+	high, low := make(chan int, 3), make(chan int, 3)
+	for i := 1; i <= 3; i++ {
+		low <- i
+		high <- i * 10
+	}
+	close(high)
+	close(low)
+
+	// Test that the higher priority input is drained first
+	var result []int
+	for v := range PriorityMerge(high, low) {
+		result = append(result, v)
+	}
+	expected := []int{10, 20, 30, 1, 2, 3}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %v, got: %v", expected, result)
+	}
+
+	// Test with no inputs
+	for range PriorityMerge[int]() {
+		t.Errorf("expected no items")
+	}
+}
+
+func TestWeightedMerge(t *testing.T) {
+	a, b := make(chan string, 30), make(chan string, 30)
+	for i := 0; i < 30; i++ {
+		a <- "a"
+		b <- "b"
+	}
+	close(a)
+	close(b)
+
+	// Test that the inputs are taken in proportion to their weights while both have items
+	counts := make(map[string]int)
+	n := 0
+	for v := range WeightedMerge([]int{3, 1}, a, b) {
+		if n < 20 {
+			counts[v]++
+		}
+		n++
+	}
+	if counts["a"] != 15 || counts["b"] != 5 || n != 60 {
+		t.Errorf("expected 15 a and 5 b of the first 20 and 60 items, got: %v, %d", counts, n)
+	}
+
+	// Test that an empty input does not hold back the others
+	c, d := make(chan string), make(chan string, 2)
+	d <- "d"
+	d <- "d"
+	close(d)
+	merged := WeightedMerge([]int{10}, c, d)
+	if v := <-merged; v != "d" {
+		t.Errorf("expected d, got: %s", v)
+	}
+	<-merged
+	close(c)
+	if _, ok := <-merged; ok {
+		t.Errorf("expected the channel to be closed")
+	}
+
+	// Test that an input that was idle does not get a burst once it comes back
+	e, f := make(chan string, 100), make(chan string, 1100)
+	for i := 0; i < 1000; i++ {
+		f <- "f"
+	}
+	merged = WeightedMerge([]int{1, 1}, e, f)
+	for i := 0; i < 1000; i++ {
+		<-merged
+	}
+	for i := 0; i < 100; i++ {
+		e <- "e"
+		f <- "f"
+	}
+	counts = make(map[string]int)
+	run, longest, last := 0, 0, ""
+	for i := 0; i < 20; i++ {
+		v := <-merged
+		counts[v]++
+		if v == last {
+			run++
+		} else {
+			run, last = 1, v
+		}
+		if run > longest {
+			longest = run
+		}
+	}
+	if counts["e"] < 9 || counts["e"] > 11 || longest > 3 {
+		t.Errorf("expected the inputs to alternate, got: %v with a run of %d", counts, longest)
+	}
+	close(e)
+	close(f)
+}
+
+func TestPriorityBuffer(t *testing.T) {
+	type item struct {
+		name     string
+		priority int
+	}
+	queue := make(chan item)
+	var sent atomic.Int32
+	go func() {
+		for _, i := range []item{{"a", 1}, {"b", 3}, {"c", 2}, {"d", 3}, {"e", 0}} {
+			queue <- i
+			sent.Add(1)
+		}
+		close(queue)
+	}()
+
+	// Test that the buffer stops taking items once it is full
+	out := PriorityBuffer(queue, func(i item) int { return i.priority }, 3, 0)
+	time.Sleep(20 * time.Millisecond)
+	if sent.Load() != 3 {
+		t.Errorf("expected 3 items to be buffered, got: %d", sent.Load())
+	}
+
+	// Test that the buffered items are sent by priority, equal priorities in order
+	var result []string
+	time.Sleep(20 * time.Millisecond)
+	for i := range out {
+		result = append(result, i.name)
+		time.Sleep(5 * time.Millisecond)
+	}
+	expected := []string{"b", "d", "c", "a", "e"}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %v, got: %v", expected, result)
+	}
+}
+
+func TestPriorityBufferAging(t *testing.T) {
+	queue := make(chan int, 2)
+	out := PriorityBuffer(queue, func(v int) int { return v }, 10, 10*time.Millisecond)
+
+	// Test that a low priority item that waited long enough goes before a newer higher priority one
+	queue <- 0
+	time.Sleep(50 * time.Millisecond)
+	queue <- 2
+	close(queue)
+	time.Sleep(10 * time.Millisecond)
+	var result []int
+	for v := range out {
+		result = append(result, v)
+	}
+	if !reflect.DeepEqual(result, []int{0, 2}) {
+		t.Errorf("expected the aged item first, got: %v", result)
+	}
+}
@@ -0,0 +1,130 @@
+package pipelines
+
+import (
+	"context"
+	"sort"
+)
+
+// ProcessOptions configures ProcessSlice and ProcessMap
+type ProcessOptions struct {
+	// Workers is the amount of goroutines calling the work function, at least one is used
+	Workers int
+	// BufferSize is the buffer of the channels between the internal stages
+	BufferSize int
+	// KeepOrder returns the results and errors in the order of their input items instead of completion order
+	KeepOrder bool
+	// StopOnFirstError stops handing out new items once an error is returned and only that error is reported, by
+	// default every item is processed and all errors are collected
+	StopOnFirstError bool
+}
+
+// indexed keeps track of the position of an item in the input slice as it moves through the WorkerPool
+type indexed[T any] struct {
+	index int
+	value T
+}
+
+type indexedErr struct {
+	index int
+	err   error
+}
+
+func (e indexedErr) Error() string {
+	return e.err.Error()
+}
+
+// ProcessSlice runs fn over every item of the slice with a WorkerPool and blocks until all items are processed. Both the
+// result and error channels are drained internally so the caller only deals with the returned slices. If the context is
+// done before every item has been handed out the context error is returned after the errors of the processed items.
+func ProcessSlice[T1, T2 any](ctx context.Context, items []T1, fn func(T1) (T2, error), opts ProcessOptions) ([]T2, []error) {
+	results, errs := process(ctx, items, fn, opts)
+
+	out := make([]T2, 0, len(results))
+	for _, r := range results {
+		out = append(out, r.value)
+	}
+	return out, errs
+}
+
+// ProcessMap is the same as ProcessSlice but returns the results keyed by the index of their input item, which makes it
+// easy to tell which items failed without keeping the input order
+func ProcessMap[T1, T2 any](ctx context.Context, items []T1, fn func(T1) (T2, error), opts ProcessOptions) (map[int]T2, []error) {
+	results, errs := process(ctx, items, fn, opts)
+
+	out := make(map[int]T2, len(results))
+	for _, r := range results {
+		out[r.index] = r.value
+	}
+	return out, errs
+}
+
+func process[T1, T2 any](parent context.Context, items []T1, fn func(T1) (T2, error), opts ProcessOptions) ([]indexed[T2], []error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	// Feed the items until they run out or the context is done, the channel is always closed so the workers exit. The
+	// context is checked before every send as a select picks at random when a worker is also ready.
+	queue := make(chan indexed[T1])
+	go func() {
+		defer close(queue)
+		for i, v := range items {
+			if ctx.Err() != nil {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case queue <- indexed[T1]{index: i, value: v}:
+			}
+		}
+	}()
+
+	resC, errC := WorkerPool(queue, func(v indexed[T1]) (indexed[T2], error) {
+		res, err := fn(v.value)
+		if err != nil {
+			return indexed[T2]{}, indexedErr{index: v.index, err: err}
+		}
+		return indexed[T2]{index: v.index, value: res}, nil
+	}, opts.BufferSize, opts.Workers)
+
+	// Both channels have to be drained at the same time otherwise a full error buffer would block the workers
+	results := make([]indexed[T2], 0, len(items))
+	errs := make([]indexedErr, 0)
+	for resC != nil || errC != nil {
+		select {
+		case r, ok := <-resC:
+			if !ok {
+				resC = nil
+				continue
+			}
+			results = append(results, r)
+		case err, ok := <-errC:
+			if !ok {
+				errC = nil
+				continue
+			}
+			if opts.StopOnFirstError && len(errs) > 0 {
+				continue
+			}
+			errs = append(errs, err.(indexedErr))
+			if opts.StopOnFirstError {
+				cancel()
+			}
+		}
+	}
+
+	if opts.KeepOrder {
+		sort.Slice(results, func(i, j int) bool { return results[i].index < results[j].index })
+		sort.Slice(errs, func(i, j int) bool { return errs[i].index < errs[j].index })
+	}
+
+	out := make([]error, 0, len(errs)+1)
+	for _, e := range errs {
+		out = append(out, e.err)
+	}
+	// Only report the context error if it came from the caller and not from stopping on the first error
+	if len(results)+len(errs) < len(items) && parent.Err() != nil && !(opts.StopOnFirstError && len(errs) > 0) {
+		out = append(out, parent.Err())
+	}
+	return results, out
+}
@@ -0,0 +1,90 @@
+package pipelines
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestProcessSlice(t *testing.T) {
+	ctx := context.Background()
+	items := []int{1, 2, 3, 4, 5, 6, 7, 8}
+	double := func(n int) (int, error) {
+		return n * 2, nil
+	}
+
+	// Test that the results keep the input order
+	results, errs := ProcessSlice(ctx, items, double, ProcessOptions{Workers: 4, KeepOrder: true})
+	if len(errs) != 0 {
+		t.Errorf("expected no errors, got: %v", errs)
+	}
+	expected := []int{2, 4, 6, 8, 10, 12, 14, 16}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("expected %v, got: %v", expected, results)
+	}
+
+	// Test that all errors are collected by default, with a buffer smaller than the amount of errors
+	failOdd := func(n int) (int, error) {
+		if n%2 == 1 {
+			return 0, fmt.Errorf("odd number %d", n)
+		}
+		return n, nil
+	}
+	results, errs = ProcessSlice(ctx, items, failOdd, ProcessOptions{Workers: 2, KeepOrder: true})
+	if len(errs) != 4 {
+		t.Errorf("expected 4 errors, got: %v", errs)
+	}
+	if errs[0].Error() != "odd number 1" || errs[3].Error() != "odd number 7" {
+		t.Errorf("expected errors in input order, got: %v", errs)
+	}
+	if !reflect.DeepEqual(results, []int{2, 4, 6, 8}) {
+		t.Errorf("expected %v, got: %v", []int{2, 4, 6, 8}, results)
+	}
+
+	// Test that only the first error is reported when stopping on the first error
+	_, errs = ProcessSlice(ctx, items, failOdd, ProcessOptions{Workers: 1, StopOnFirstError: true})
+	if len(errs) != 1 {
+		t.Errorf("expected 1 error, got: %v", errs)
+	}
+
+	// Test that a done context is reported and no item is handed out
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	for i := 0; i < 256; i++ {
+		results, errs := ProcessSlice(cancelledCtx, items, double, ProcessOptions{})
+		if len(results) != 0 || len(errs) != 1 || !errors.Is(errs[0], context.Canceled) {
+			t.Fatalf("expected only context.Canceled, got: %v, %v", results, errs)
+		}
+	}
+
+	// Test that the context error is reported along with the errors of the items
+	cancellingCtx, cancel := context.WithCancel(ctx)
+	_, errs = ProcessSlice(cancellingCtx, items, func(v int) (int, error) {
+		cancel()
+		return 0, fmt.Errorf("failed %d", v)
+	}, ProcessOptions{Workers: 1})
+	if len(errs) < 2 || errs[0].Error() != "failed 1" || !errors.Is(errs[len(errs)-1], context.Canceled) {
+		t.Errorf("expected the item error and context.Canceled, got: %v", errs)
+	}
+}
+
+func TestProcessMap(t *testing.T) {
+	items := []string{"a", "", "c"}
+	repeat := func(s string) (string, error) {
+		if s == "" {
+			return "", fmt.Errorf("empty string")
+		}
+		return s + s, nil
+	}
+
+	results, errs := ProcessMap(context.Background(), items, repeat, ProcessOptions{Workers: 3})
+	if len(errs) != 1 {
+		t.Errorf("expected 1 error, got: %v", errs)
+	}
+	expected := map[int]string{0: "aa", 2: "cc"}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("expected %v, got: %v", expected, results)
+	}
+}
@@ -0,0 +1,269 @@
+package pipelines
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultMaxLineLength = 64 * 1024
+
+// ReaderOptions configures the reader sources
+type ReaderOptions struct {
+	// Delimiter separates the lines, defaults to '\n'. A trailing '\r' is removed when the delimiter is '\n'.
+	Delimiter byte
+	// MaxLineLength is the longest line in bytes that is decoded, longer lines are skipped and reported as an error.
+	// Defaults to 64KB.
+	MaxLineLength int
+	// SkipEmptyLines does not pass empty lines to the decoder
+	SkipEmptyLines bool
+	// Comma is the field separator used by FromCSV, defaults to ','
+	Comma rune
+	// Service and Stage are used for the PipelineErr returned when a line can not be decoded
+	Service string
+	Stage   string
+}
+
+// lineReader reads delimited lines and keeps track of their line numbers
+type lineReader struct {
+	r         *bufio.Reader
+	delim     byte
+	skipEmpty bool
+	line      int
+}
+
+func newLineReader(r io.Reader, opts ReaderOptions) *lineReader {
+	if opts.Delimiter == 0 {
+		opts.Delimiter = '\n'
+	}
+	if opts.MaxLineLength <= 0 {
+		opts.MaxLineLength = defaultMaxLineLength
+	}
+	// The buffer has to hold the line and its delimiter
+	return &lineReader{
+		r:         bufio.NewReaderSize(r, opts.MaxLineLength+1),
+		delim:     opts.Delimiter,
+		skipEmpty: opts.SkipEmptyLines,
+	}
+}
+
+// next returns the next line without its delimiter along with its line number. The returned slice is only valid until
+// the next call. Once there are no lines left io.EOF is returned.
+func (lr *lineReader) next() ([]byte, int, error) {
+	for {
+		b, err := lr.r.ReadSlice(lr.delim)
+		if errors.Is(err, bufio.ErrBufferFull) {
+			lr.line++
+			// Discard the rest of the line so reading can continue with the next one
+			for errors.Is(err, bufio.ErrBufferFull) {
+				_, err = lr.r.ReadSlice(lr.delim)
+			}
+			if err != nil && !errors.Is(err, io.EOF) {
+				return nil, lr.line, err
+			}
+			return nil, lr.line, fmt.Errorf("line exceeds the maximum line length")
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, lr.line, err
+		}
+		if errors.Is(err, io.EOF) && len(b) == 0 {
+			return nil, lr.line, io.EOF
+		}
+
+		lr.line++
+		b = bytes.TrimSuffix(b, []byte{lr.delim})
+		if lr.delim == '\n' {
+			b = bytes.TrimSuffix(b, []byte{'\r'})
+		}
+		if lr.skipEmpty && len(b) == 0 {
+			continue
+		}
+		return b, lr.line, nil
+	}
+}
+
+// errLine wraps an error with its line number as a PipelineErr
+func errLine(err error, line int, opts ReaderOptions) error {
+	return NewPipelineErr(fmt.Errorf("line %d: %w", line, err), opts.Service, opts.Stage)
+}
+
+// FromReader returns a queue function that reads the lines of r and decodes each with the decoder. JSONCodec decodes
+// JSON Lines and StringCodec returns the raw lines. Lines that can not be decoded are returned as a PipelineErr with the
+// line number, and ErrQueueEmpty is returned once r is exhausted. The queue function is safe to use with several
+// workers.
+func FromReader[T any](r io.Reader, dec Decoder[T], opts ReaderOptions) func(context.Context) (T, error) {
+	lr := newLineReader(r, opts)
+	var mu sync.Mutex
+
+	return func(ctx context.Context) (T, error) {
+		var zero T
+		mu.Lock()
+		b, line, err := lr.next()
+		if err != nil {
+			mu.Unlock()
+			if errors.Is(err, io.EOF) {
+				return zero, ErrQueueEmpty
+			}
+			return zero, errLine(err, line, opts)
+		}
+		// Copy the line as the decoder may run after the next line is read
+		b = append([]byte(nil), b...)
+		mu.Unlock()
+
+		v, err := dec.Decode(b)
+		if err != nil {
+			return zero, errLine(err, line, opts)
+		}
+		return v, nil
+	}
+}
+
+// FromCSV returns a queue function that reads CSV from r into structs of type T. The first line is the header and each
+// column is mapped to the struct field with a matching `csv` tag, or otherwise a field with the same name ignoring case.
+// Columns without a field and empty values are ignored. As the source is line oriented quoted fields can not span
+// multiple lines. If the header can not be read the error is returned once and ErrQueueEmpty afterwards, so the rows
+// are never read as a header.
+func FromCSV[T any](r io.Reader, opts ReaderOptions) func(context.Context) (T, error) {
+	if opts.Comma == 0 {
+		opts.Comma = ','
+	}
+	opts.SkipEmptyLines = true
+	lr := newLineReader(r, opts)
+	var mu sync.Mutex
+	var fields []int
+	// headerFailed is set once the header could not be read
+	var headerFailed bool
+
+	parse := func(b []byte) ([]string, error) {
+		cr := csv.NewReader(bytes.NewReader(b))
+		cr.Comma = opts.Comma
+		return cr.Read()
+	}
+
+	return func(ctx context.Context) (T, error) {
+		var zero T
+		mu.Lock()
+		if headerFailed {
+			mu.Unlock()
+			return zero, ErrQueueEmpty
+		}
+		if fields == nil {
+			b, line, err := lr.next()
+			if errors.Is(err, io.EOF) {
+				mu.Unlock()
+				return zero, ErrQueueEmpty
+			}
+			var header []string
+			if err == nil {
+				header, err = parse(b)
+			}
+			if err == nil {
+				fields, err = csvFieldIndexes(reflect.TypeOf(zero), header)
+			}
+			if err != nil {
+				headerFailed = true
+				mu.Unlock()
+				return zero, errLine(err, line, opts)
+			}
+		}
+		b, line, err := lr.next()
+		if err != nil {
+			mu.Unlock()
+			if errors.Is(err, io.EOF) {
+				return zero, ErrQueueEmpty
+			}
+			return zero, errLine(err, line, opts)
+		}
+		record, err := parse(b)
+		mu.Unlock()
+		if err != nil {
+			return zero, errLine(err, line, opts)
+		}
+
+		var v T
+		rv := reflect.ValueOf(&v).Elem()
+		for i, value := range record {
+			if i >= len(fields) || fields[i] < 0 || value == "" {
+				continue
+			}
+			if err := setCSVField(rv.Field(fields[i]), value); err != nil {
+				return zero, errLine(fmt.Errorf("column %d: %w", i+1, err), line, opts)
+			}
+		}
+		return v, nil
+	}
+}
+
+// csvFieldIndexes maps each header column to the index of its struct field, or -1 if there is no field for it
+func csvFieldIndexes(t reflect.Type, header []string) ([]int, error) {
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("csv items must be structs, got %v", t)
+	}
+	indexes := make([]int, len(header))
+	for i, column := range header {
+		indexes[i] = -1
+		column = strings.TrimSpace(column)
+		for j := 0; j < t.NumField(); j++ {
+			f := t.Field(j)
+			if !f.IsExported() {
+				continue
+			}
+			name, ok := f.Tag.Lookup("csv")
+			if name == "-" {
+				continue
+			}
+			if (ok && name == column) || (!ok && strings.EqualFold(f.Name, column)) {
+				indexes[i] = j
+				break
+			}
+		}
+	}
+	return indexes, nil
+}
+
+// setCSVField parses the value into the field based on its kind
+func setCSVField(f reflect.Value, value string) error {
+	if tu, ok := f.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return tu.UnmarshalText([]byte(value))
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(value, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported field type %s", f.Type())
+	}
+	return nil
+}
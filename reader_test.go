@@ -0,0 +1,113 @@
+package pipelines
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type readerRecord struct {
+	Name  string  `json:"name" csv:"name"`
+	Count int     `json:"count" csv:"count"`
+	Price float64 `json:"price"`
+}
+
+func TestFromReader(t *testing.T) {
+	ctx := context.Background()
+
+	// Test that JSON Lines are decoded and bad lines are reported with their line number
+	input := "{\"name\":\"a\",\"count\":1}\r\n\nnot json\n{\"name\":\"b\",\"count\":2}"
+	queueC, errC := Queue(ctx, FromReader[readerRecord](strings.NewReader(input), JSONCodec[readerRecord]{}, ReaderOptions{
+		SkipEmptyLines: true,
+		Service:        "service",
+		Stage:          "reader",
+	}), 1, 1)
+	result := make([]readerRecord, 0)
+	errs := make([]error, 0)
+	for queueC != nil || errC != nil {
+		select {
+		case v, ok := <-queueC:
+			if !ok {
+				queueC = nil
+				continue
+			}
+			result = append(result, v)
+		case err, ok := <-errC:
+			if !ok {
+				errC = nil
+				continue
+			}
+			errs = append(errs, err)
+		}
+	}
+	expected := []readerRecord{{Name: "a", Count: 1}, {Name: "b", Count: 2}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %v, got: %v", expected, result)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got: %v", errs)
+	}
+	var pe PipelineErr
+	if !errors.As(errs[0], &pe) || pe.Stage() != "reader" {
+		t.Errorf("expected a PipelineErr, got: %T", errs[0])
+	}
+	if !strings.HasPrefix(errs[0].Error(), "line 3:") {
+		t.Errorf("expected the error on line 3, got: %v", errs[0])
+	}
+
+	// Test raw lines with a custom delimiter and a maximum line length
+	next := FromReader[string](strings.NewReader("a;bbbbbbbbbbbbbbbbbbbbbbbbbb;c"), StringCodec{}, ReaderOptions{Delimiter: ';', MaxLineLength: 16})
+	if v, err := next(ctx); v != "a" || err != nil {
+		t.Errorf("expected a, got: %s, %v", v, err)
+	}
+	if _, err := next(ctx); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected a line length error on line 2, got: %v", err)
+	}
+	if v, err := next(ctx); v != "c" || err != nil {
+		t.Errorf("expected c, got: %s, %v", v, err)
+	}
+	if _, err := next(ctx); !errors.Is(err, ErrQueueEmpty) {
+		t.Errorf("expected ErrQueueEmpty, got: %v", err)
+	}
+}
+
+func TestFromCSV(t *testing.T) {
+	ctx := context.Background()
+	input := "name,count,PRICE,ignored\n\"a, b\",1,2.5,x\nc,,3,y\nd,nan,1,z\n"
+	next := FromCSV[readerRecord](strings.NewReader(input), ReaderOptions{})
+
+	v, err := next(ctx)
+	if err != nil || !reflect.DeepEqual(v, readerRecord{Name: "a, b", Count: 1, Price: 2.5}) {
+		t.Errorf("expected the first record, got: %v, %v", v, err)
+	}
+	v, err = next(ctx)
+	if err != nil || !reflect.DeepEqual(v, readerRecord{Name: "c", Price: 3}) {
+		t.Errorf("expected the second record, got: %v, %v", v, err)
+	}
+	if _, err = next(ctx); err == nil || !strings.HasPrefix(err.Error(), "line 4: column 2") {
+		t.Errorf("expected an error on line 4 column 2, got: %v", err)
+	}
+	if _, err = next(ctx); !errors.Is(err, ErrQueueEmpty) {
+		t.Errorf("expected ErrQueueEmpty, got: %v", err)
+	}
+
+	// Test that only structs are accepted, with a single error for the whole input
+	ints := FromCSV[int](strings.NewReader("a\n1\n2\n"), ReaderOptions{})
+	if _, err := ints(ctx); err == nil {
+		t.Error("expected an error for a non struct type")
+	}
+	if _, err := ints(ctx); !errors.Is(err, ErrQueueEmpty) {
+		t.Errorf("expected ErrQueueEmpty after the header failed, got: %v", err)
+	}
+
+	// Test that rows are not read as the header once a malformed header failed
+	next = FromCSV[readerRecord](strings.NewReader("name,\"count\n\"a\",1,2\nb,2,3\n"), ReaderOptions{})
+	if _, err := next(ctx); err == nil || !strings.HasPrefix(err.Error(), "line 1") {
+		t.Errorf("expected an error on line 1, got: %v", err)
+	}
+	if v, err := next(ctx); !errors.Is(err, ErrQueueEmpty) {
+		t.Errorf("expected ErrQueueEmpty after the header failed, got: %v, %v", v, err)
+	}
+}
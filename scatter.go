@@ -0,0 +1,115 @@
+package pipelines
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// PartialPolicy decides what ScatterGather does with an item when some of its branches fail
+type PartialPolicy int
+
+const (
+	// PartialFail cancels the remaining branches on the first failure and reports the item as an error
+	PartialFail PartialPolicy = iota
+	// PartialAllow waits for every branch and passes the successful and failed results to the combiner
+	PartialAllow
+)
+
+// BranchResult is the outcome of a single ScatterGather branch, Err is set if the branch failed or timed out
+type BranchResult[R any] struct {
+	Value R
+	Err   error
+}
+
+// ScatterGatherOptions configures ScatterGather
+type ScatterGatherOptions struct {
+	// BranchTimeout is how long each branch may take for an item, a value <= 0 means no timeout
+	BranchTimeout time.Duration
+	// PartialPolicy decides how failed branches are handled, PartialFail by default
+	PartialPolicy PartialPolicy
+	// MaxConcurrency caps the amount of branch calls running at once across all items in flight, a value <= 0 means
+	// workers * len(branches)
+	MaxConcurrency int
+}
+
+// ScatterGather takes in a channel of work and for each item runs every branch function concurrently, then joins their
+// results with the combine function. The results passed to combine are in the same order as the branches. The amount of
+// items worked on at once is equal to the amount of workers passed in, see WorkerPool.
+//
+// Branches are passed a context that is done once their timeout passes or the item failed under PartialFail, branches
+// that ignore it are no longer waited on but will keep their goroutine until they return.
+func ScatterGather[T, R, O any](ctx context.Context, queue <-chan T, branches []func(context.Context, T) (R, error), combine func(T, []BranchResult[R]) (O, error), bufferSize int, workers int, opts ScatterGatherOptions) (<-chan O, <-chan error) {
+	// Sanity check for workers so the default concurrency can be calculated
+	if workers < 1 {
+		workers = 1
+	}
+	if opts.MaxConcurrency <= 0 {
+		opts.MaxConcurrency = workers * len(branches)
+	}
+	sem := make(chan struct{}, opts.MaxConcurrency)
+
+	gather := func(v T) (O, error) {
+		itemCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		results := make([]BranchResult[R], len(branches))
+		var wg sync.WaitGroup
+		var failOnce sync.Once
+		var firstErr error
+
+		wg.Add(len(branches))
+		for i, branch := range branches {
+			go func(i int, branch func(context.Context, T) (R, error)) {
+				defer wg.Done()
+				results[i] = runBranch(itemCtx, sem, branch, v, opts.BranchTimeout)
+				if results[i].Err != nil && opts.PartialPolicy == PartialFail {
+					failOnce.Do(func() {
+						firstErr = results[i].Err
+						cancel()
+					})
+				}
+			}(i, branch)
+		}
+		wg.Wait()
+
+		if firstErr != nil {
+			var zero O
+			return zero, firstErr
+		}
+		return combine(v, results)
+	}
+
+	return WorkerPool(queue, gather, bufferSize, workers)
+}
+
+// runBranch calls the branch once a concurrency slot is free and stops waiting on it once ctx is done or the timeout
+// passes
+func runBranch[T, R any](ctx context.Context, sem chan struct{}, branch func(context.Context, T) (R, error), v T, timeout time.Duration) BranchResult[R] {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		return BranchResult[R]{Err: ctx.Err()}
+	}
+
+	// Buffered so the branch goroutine can always finish even if nothing is waiting on it anymore
+	resC := make(chan BranchResult[R], 1)
+	go func() {
+		defer func() { <-sem }()
+		res, err := branch(ctx, v)
+		resC <- BranchResult[R]{Value: res, Err: err}
+	}()
+
+	select {
+	case res := <-resC:
+		return res
+	case <-ctx.Done():
+		return BranchResult[R]{Err: ctx.Err()}
+	}
+}
@@ -0,0 +1,116 @@
+package pipelines
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScatterGather(t *testing.T) {
+	ctx := context.Background()
+	branches := []func(context.Context, int) (string, error){
+		func(ctx context.Context, n int) (string, error) { return fmt.Sprintf("a%d", n), nil },
+		func(ctx context.Context, n int) (string, error) { return fmt.Sprintf("b%d", n), nil },
+		func(ctx context.Context, n int) (string, error) {
+			if n == 3 {
+				return "", fmt.Errorf("branch c failed")
+			}
+			return fmt.Sprintf("c%d", n), nil
+		},
+	}
+	combine := func(n int, results []BranchResult[string]) (string, error) {
+		s := ""
+		for _, r := range results {
+			if r.Err != nil {
+				s += "-"
+				continue
+			}
+			s += r.Value
+		}
+		return s, nil
+	}
+
+	// Test that the combiner gets the results in branch order and failing items are reported
+	out, errc := ScatterGather(ctx, ConvertSliceToClosedChannel([]int{1, 2, 3}), branches, combine, 3, 2, ScatterGatherOptions{})
+	result := make([]string, 0)
+	for v := range out {
+		result = append(result, v)
+	}
+	sort.Strings(result)
+	if len(result) != 2 || result[0] != "a1b1c1" || result[1] != "a2b2c2" {
+		t.Errorf("expected [a1b1c1 a2b2c2], got: %v", result)
+	}
+	errorCount := 0
+	for range errc {
+		errorCount++
+	}
+	if errorCount != 1 {
+		t.Errorf("expected 1 error, got: %d", errorCount)
+	}
+
+	// Test that partial results are passed to the combiner
+	out, errc = ScatterGather(ctx, ConvertSliceToClosedChannel([]int{3}), branches, combine, 1, 1, ScatterGatherOptions{PartialPolicy: PartialAllow})
+	if v := <-out; v != "a3b3-" {
+		t.Errorf("expected a3b3-, got: %s", v)
+	}
+	for err := range errc {
+		t.Errorf("expected no errors, got: %v", err)
+	}
+}
+
+func TestScatterGatherTimeoutAndConcurrency(t *testing.T) {
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	track := func(ctx context.Context, n int) (int, error) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return n, nil
+	}
+	slow := func(ctx context.Context, n int) (int, error) {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+	sum := func(n int, results []BranchResult[int]) (int, error) {
+		total := 0
+		for _, r := range results {
+			total += r.Value
+		}
+		return total, nil
+	}
+
+	// Test that the concurrency cap holds across items
+	branches := []func(context.Context, int) (int, error){track, track, track}
+	out, errc := ScatterGather(ctx, ConvertSliceToClosedChannel([]int{1, 2, 3, 4, 5}), branches, sum, 5, 4, ScatterGatherOptions{MaxConcurrency: 2})
+	for range out {
+	}
+	for range errc {
+		t.Error("expected no errors")
+	}
+	if maxRunning > 2 {
+		t.Errorf("expected at most 2 branches running, got: %d", maxRunning)
+	}
+
+	// Test that a branch that is too slow times out
+	branches = []func(context.Context, int) (int, error){track, slow}
+	out, errc = ScatterGather(ctx, ConvertSliceToClosedChannel([]int{1}), branches, sum, 1, 1, ScatterGatherOptions{BranchTimeout: 5 * time.Millisecond})
+	for range out {
+		t.Error("expected no results")
+	}
+	if err := <-errc; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got: %v", err)
+	}
+}
@@ -0,0 +1,267 @@
+package pipelines
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schedule returns the first scheduled time strictly after the given time
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+// Every is a Schedule that fires on a fixed interval, aligned to the first time Next is called with. An interval <= 0
+// never fires.
+type Every time.Duration
+
+func (e Every) Next(after time.Time) time.Time {
+	if e <= 0 {
+		return time.Time{}
+	}
+	return after.Add(time.Duration(e))
+}
+
+// CronSchedule is a Schedule parsed from a standard 5 field cron expression, see ParseCron
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domStar and dowStar record if the day fields were unrestricted, which changes how they are combined
+	domStar, dowStar bool
+	loc              *time.Location
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonths = map[string]int{
+	"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6,
+	"JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12,
+}
+
+var cronDays = map[string]int{
+	"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6,
+}
+
+// ParseCron parses a standard cron expression with the fields minute, hour, day of month, month and day of week. Each
+// field supports *, lists (1,2), ranges (1-5), steps (*/15, 1-30/5) and month and day names (JAN, MON). Day of week 7
+// is also Sunday, and as in cron if both day fields are restricted a time matches if either of them does. The
+// descriptors @yearly, @monthly, @weekly, @daily and @hourly are supported as well. Times are matched in loc, which
+// defaults to time.Local when nil.
+func ParseCron(expr string, loc *time.Location) (*CronSchedule, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+	expr = strings.TrimSpace(expr)
+	if d, ok := cronDescriptors[strings.ToLower(expr)]; ok {
+		expr = d
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields, got %d", expr, len(fields))
+	}
+
+	s := &CronSchedule{loc: loc}
+	var err error
+	if s.minute, _, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if s.hour, _, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if s.dom, s.domStar, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if s.month, _, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	if s.dow, s.dowStar, err = parseCronField(fields[4], 0, 7, cronDays); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	// 7 is an alias for Sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+// parseCronField returns the bit set of the values matched by the field and if the field starts with *
+func parseCronField(field string, min int, max int, names map[string]int) (uint64, bool, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rangePart = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, false, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+
+		lo, hi := min, max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if lo, err = parseCronValue(bounds[0], names); err != nil {
+				return 0, false, err
+			}
+			if hi, err = parseCronValue(bounds[1], names); err != nil {
+				return 0, false, err
+			}
+		default:
+			v, err := parseCronValue(rangePart, names)
+			if err != nil {
+				return 0, false, err
+			}
+			lo = v
+			// A single value with a step runs until the max, as in 5/15
+			if !strings.Contains(part, "/") {
+				hi = v
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, false, fmt.Errorf("%q is out of the range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, strings.HasPrefix(field, "*"), nil
+}
+
+func parseCronValue(s string, names map[string]int) (int, error) {
+	if v, ok := names[strings.ToUpper(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return v, nil
+}
+
+func (s *CronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// Next returns the first time after the given time that matches the expression, or the zero time if nothing matches
+// within five years (for example 0 0 30 2 *)
+func (s *CronSchedule) Next(after time.Time) time.Time {
+	t := after.In(s.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	// Move forward by the largest field that does not match, resetting the smaller fields each time
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.loc)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.loc)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, s.loc)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Truncate(time.Minute).Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// MisfirePolicy decides what a scheduled source does with ticks that were missed because it was not called in time,
+// for example because the pipeline was backpressured
+type MisfirePolicy int
+
+const (
+	// MisfireSkip drops the missed ticks and only emits the most recent one that is due
+	MisfireSkip MisfirePolicy = iota
+	// MisfireCatchUp emits every missed tick in order, as fast as the pipeline takes them
+	MisfireCatchUp
+)
+
+// ScheduleOptions configures ScheduleSource
+type ScheduleOptions struct {
+	// Clock defaults to RealClock
+	Clock Clock
+	// Misfire decides how missed ticks are handled, MisfireSkip by default
+	Misfire MisfirePolicy
+}
+
+// ScheduleSource returns a queue function that blocks until the next tick of the schedule and returns the time it was
+// scheduled for. Ticks are counted from the first call. Once the schedule has no more ticks ErrQueueEmpty is returned.
+func ScheduleSource(s Schedule, opts ScheduleOptions) func(context.Context) (time.Time, error) {
+	if opts.Clock == nil {
+		opts.Clock = RealClock{}
+	}
+	var mu sync.Mutex
+	var next time.Time
+
+	return func(ctx context.Context) (time.Time, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if next.IsZero() {
+			next = s.Next(opts.Clock.Now())
+		}
+
+		for {
+			if next.IsZero() {
+				return time.Time{}, ErrQueueEmpty
+			}
+			now := opts.Clock.Now()
+			if !now.Before(next) {
+				tick := next
+				next = s.Next(tick)
+				if opts.Misfire == MisfireSkip {
+					// Skip ahead to the most recent tick that is due
+					for !next.IsZero() && !now.Before(next) {
+						tick = next
+						next = s.Next(tick)
+					}
+				}
+				return tick, nil
+			}
+
+			select {
+			case <-ctx.Done():
+				return time.Time{}, ctx.Err()
+			case <-opts.Clock.After(next.Sub(now)):
+			}
+		}
+	}
+}
+
+// TickerSource returns a queue function that emits on a fixed interval, see ScheduleSource
+func TickerSource(interval time.Duration, opts ScheduleOptions) func(context.Context) (time.Time, error) {
+	return ScheduleSource(Every(interval), opts)
+}
+
+// CronSource returns a queue function that emits on the times matched by the cron expression in loc, see ParseCron and
+// ScheduleSource
+func CronSource(expr string, loc *time.Location, opts ScheduleOptions) (func(context.Context) (time.Time, error), error) {
+	s, err := ParseCron(expr, loc)
+	if err != nil {
+		return nil, err
+	}
+	return ScheduleSource(s, opts), nil
+}
@@ -0,0 +1,169 @@
+package pipelines
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves forward when Advance is called
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), c: ch})
+	return ch
+}
+
+// waitForWaiters blocks until something is waiting on After
+func (c *fakeClock) waitForWaiters() {
+	for {
+		c.mu.Lock()
+		n := len(c.waiters)
+		c.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	remaining := c.waiters[:0]
+	for _, w := range c.waiters {
+		if !c.now.Before(w.at) {
+			w.c <- c.now
+			continue
+		}
+		remaining = append(remaining, w)
+	}
+	c.waiters = remaining
+}
+
+func TestParseCron(t *testing.T) {
+	loc := time.UTC
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, loc) // A Sunday
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"*/15 * * * *", time.Date(2023, 1, 1, 0, 15, 0, 0, loc)},
+		{"30 9 * * MON-FRI", time.Date(2023, 1, 2, 9, 30, 0, 0, loc)},
+		{"0 0 1 * *", time.Date(2023, 2, 1, 0, 0, 0, 0, loc)},
+		{"0 12 * FEB *", time.Date(2023, 2, 1, 12, 0, 0, 0, loc)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, loc)},
+		{"0 0 13 * 5", time.Date(2023, 1, 6, 0, 0, 0, 0, loc)},
+		{"5/20 3 * * 7", time.Date(2023, 1, 1, 3, 5, 0, 0, loc)},
+		{"@hourly", time.Date(2023, 1, 1, 1, 0, 0, 0, loc)},
+		{"0 0 1,15 6-8 *", time.Date(2023, 6, 1, 0, 0, 0, 0, loc)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := ParseCron(tt.expr, loc)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			if got := s.Next(start); !got.Equal(tt.want) {
+				t.Errorf("expected %s, got: %s", tt.want, got)
+			}
+		})
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "* * * 13 *", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		if _, err := ParseCron(expr, loc); err == nil {
+			t.Errorf("expected an error for %q", expr)
+		}
+	}
+
+	// Test that the expression is evaluated in the given timezone
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("timezone database not available")
+	}
+	s, _ := ParseCron("0 9 * * *", ny)
+	if got := s.Next(start); !got.Equal(time.Date(2023, 1, 1, 14, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected 09:00 in New York, got: %s", got.UTC())
+	}
+}
+
+func TestScheduleSource(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Test that the source blocks until the tick is due
+	clock := newFakeClock(start)
+	next := TickerSource(time.Minute, ScheduleOptions{Clock: clock})
+	tickC := make(chan time.Time)
+	go func() {
+		tick, _ := next(ctx)
+		tickC <- tick
+	}()
+	clock.waitForWaiters()
+	clock.Advance(time.Minute)
+	if tick := <-tickC; !tick.Equal(start.Add(time.Minute)) {
+		t.Errorf("expected the first tick, got: %s", tick)
+	}
+
+	// Test that missed ticks are skipped
+	clock.Advance(3*time.Minute + time.Second)
+	if tick, _ := next(ctx); !tick.Equal(start.Add(4 * time.Minute)) {
+		t.Errorf("expected the most recent tick, got: %s", tick)
+	}
+
+	// Test that missed ticks are caught up on in order
+	clock = newFakeClock(start)
+	cron, err := CronSource("*/10 * * * *", time.UTC, ScheduleOptions{Clock: clock, Misfire: MisfireCatchUp})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	go func() {
+		tick, _ := cron(ctx)
+		tickC <- tick
+	}()
+	clock.waitForWaiters()
+	clock.Advance(30 * time.Minute)
+	if tick := <-tickC; !tick.Equal(start.Add(10 * time.Minute)) {
+		t.Errorf("expected the first tick, got: %s", tick)
+	}
+	for _, want := range []time.Duration{20 * time.Minute, 30 * time.Minute} {
+		if tick, _ := cron(ctx); !tick.Equal(start.Add(want)) {
+			t.Errorf("expected %s, got: %s", start.Add(want), tick)
+		}
+	}
+
+	// Test that a cancelled context stops the wait
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := cron(cancelled); err == nil {
+		t.Error("expected a context error")
+	}
+}
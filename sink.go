@@ -0,0 +1,375 @@
+package pipelines
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecordWriter writes items to an underlying writer in some format, Flush writes out anything that is buffered
+type RecordWriter[T any] interface {
+	Write(v T) error
+	Flush() error
+}
+
+// NewRecordWriter creates a RecordWriter on top of w, a new one is created for each file a FileSink rotates to so
+// formats with a header start each file with it
+type NewRecordWriter[T any] func(w io.Writer) RecordWriter[T]
+
+type jsonlWriter[T any] struct {
+	enc *json.Encoder
+}
+
+// NewJSONLWriter writes each item as a line of JSON
+func NewJSONLWriter[T any](w io.Writer) RecordWriter[T] {
+	return jsonlWriter[T]{enc: json.NewEncoder(w)}
+}
+
+func (jw jsonlWriter[T]) Write(v T) error {
+	return jw.enc.Encode(v)
+}
+
+func (jw jsonlWriter[T]) Flush() error {
+	return nil
+}
+
+type gobWriter[T any] struct {
+	enc *gob.Encoder
+}
+
+// NewGobWriter writes the items as a gob stream, the type information is only written once per stream
+func NewGobWriter[T any](w io.Writer) RecordWriter[T] {
+	return gobWriter[T]{enc: gob.NewEncoder(w)}
+}
+
+func (gw gobWriter[T]) Write(v T) error {
+	return gw.enc.Encode(v)
+}
+
+func (gw gobWriter[T]) Flush() error {
+	return nil
+}
+
+type csvWriter[T any] struct {
+	w      *csv.Writer
+	fields []int
+	header []string
+	wrote  bool
+}
+
+// NewCSVWriter writes structs of type T as CSV with a header line. The columns are the exported fields in order, named
+// by their `csv` tag or otherwise their field name, which matches what FromCSV reads.
+func NewCSVWriter[T any](w io.Writer) RecordWriter[T] {
+	cw := &csvWriter[T]{w: csv.NewWriter(w)}
+	var zero T
+	t := reflect.TypeOf(zero)
+	if t == nil || t.Kind() != reflect.Struct {
+		return cw
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, ok := f.Tag.Lookup("csv")
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		if !ok {
+			name = f.Name
+		}
+		cw.fields = append(cw.fields, i)
+		cw.header = append(cw.header, name)
+	}
+	return cw
+}
+
+func (cw *csvWriter[T]) Write(v T) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Struct {
+		return fmt.Errorf("csv items must be structs, got %T", v)
+	}
+	if !cw.wrote {
+		if err := cw.w.Write(cw.header); err != nil {
+			return err
+		}
+		cw.wrote = true
+	}
+	record := make([]string, len(cw.fields))
+	for i, field := range cw.fields {
+		record[i] = formatCSVField(rv.Field(field))
+	}
+	return cw.w.Write(record)
+}
+
+func (cw *csvWriter[T]) Flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// formatCSVField is the inverse of setCSVField
+func formatCSVField(f reflect.Value) string {
+	if tm, ok := f.Interface().(encoding.TextMarshaler); ok {
+		if b, err := tm.MarshalText(); err == nil {
+			return string(b)
+		}
+	}
+	switch f.Kind() {
+	case reflect.String:
+		return f.String()
+	case reflect.Bool:
+		return strconv.FormatBool(f.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(f.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(f.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(f.Float(), 'g', -1, f.Type().Bits())
+	default:
+		return fmt.Sprint(f.Interface())
+	}
+}
+
+// WriterSink writes items to an io.Writer, Write can be used as a dequeue function and is safe for several workers
+type WriterSink[T any] struct {
+	mu sync.Mutex
+	bw *bufio.Writer
+	rw RecordWriter[T]
+}
+
+// NewWriterSink creates a WriterSink, writes are buffered until Flush is called or the pipeline is drained with Drain
+func NewWriterSink[T any](w io.Writer, newRecordWriter NewRecordWriter[T]) *WriterSink[T] {
+	bw := bufio.NewWriter(w)
+	return &WriterSink[T]{bw: bw, rw: newRecordWriter(bw)}
+}
+
+func (s *WriterSink[T]) Write(v T) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rw.Write(v)
+}
+
+// Flush writes out anything that is buffered
+func (s *WriterSink[T]) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.rw.Flush(); err != nil {
+		return err
+	}
+	return s.bw.Flush()
+}
+
+// Drain is the same as Dequeue with Write as the dequeue function, but flushes the sink once the queue is drained. The
+// flush error, if any, is sent on the error channel before it is closed.
+func (s *WriterSink[T]) Drain(queue <-chan T, bufferSize int, workers int) <-chan error {
+	return drainSink(queue, s.Write, s.Flush, bufferSize, workers)
+}
+
+// FileSinkOptions configures a FileSink
+type FileSinkOptions struct {
+	// MaxSize rotates the file once this many bytes, before compression, have been written to it. A value <= 0 means
+	// no size based rotation.
+	MaxSize int64
+	// MaxAge rotates the file on the first write after it has been open this long. A value <= 0 means no time based
+	// rotation.
+	MaxAge time.Duration
+	// Gzip compresses the files, ".gz" is added to the file names
+	Gzip bool
+
+	// now allows tests to control time, defaults to time.Now
+	now func() time.Time
+}
+
+// FileSink writes items to files. Items are written to a temporary file next to path which is renamed once it is
+// complete, so readers of the directory never see a partially written file. Without rotation the complete file is
+// renamed to path on Close, with rotation each complete file is named after path with its start time and a sequence
+// number inserted before the extension, for example events.20060102T150405Z.1.jsonl. Calling Rotate on a sink without
+// MaxSize or MaxAge switches it to the rotated names, so files never replace each other.
+type FileSink[T any] struct {
+	path            string
+	opts            FileSinkOptions
+	newRecordWriter NewRecordWriter[T]
+
+	mu       sync.Mutex
+	file     *os.File
+	bw       *bufio.Writer
+	gz       *gzip.Writer
+	counter  *countingWriter
+	rw       RecordWriter[T]
+	openedAt time.Time
+	seq      int
+	// rotated is set once Rotate was called
+	rotated bool
+	closed  bool
+}
+
+// NewFileSink creates a FileSink writing to path, the directory is created if it does not exist
+func NewFileSink[T any](path string, newRecordWriter NewRecordWriter[T], opts FileSinkOptions) (*FileSink[T], error) {
+	if opts.now == nil {
+		opts.now = time.Now
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	s := &FileSink[T]{path: path, opts: opts, newRecordWriter: newRecordWriter}
+	return s, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func (s *FileSink[T]) rotating() bool {
+	return s.opts.MaxSize > 0 || s.opts.MaxAge > 0 || s.rotated
+}
+
+// finalPath returns the name the current file is renamed to once it is complete
+func (s *FileSink[T]) finalPath() string {
+	path := s.path
+	if s.rotating() {
+		ext := filepath.Ext(path)
+		stamp := s.openedAt.UTC().Format("20060102T150405Z")
+		path = fmt.Sprintf("%s.%s.%d%s", strings.TrimSuffix(path, ext), stamp, s.seq, ext)
+	}
+	if s.opts.Gzip {
+		path += ".gz"
+	}
+	return path
+}
+
+// open starts a new temporary file, must be called while holding mu. Every file gets a unique temporary name so a file
+// that failed to complete is left as it is instead of being overwritten by the next one.
+func (s *FileSink[T]) open() error {
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+	s.file = f
+	s.bw = bufio.NewWriter(f)
+	var w io.Writer = s.bw
+	if s.opts.Gzip {
+		s.gz = gzip.NewWriter(s.bw)
+		w = s.gz
+	}
+	s.counter = &countingWriter{w: w}
+	s.rw = s.newRecordWriter(s.counter)
+	s.openedAt = s.opts.now()
+	s.seq++
+	return nil
+}
+
+// finish flushes, syncs and renames the current file, must be called while holding mu
+func (s *FileSink[T]) finish() error {
+	if s.file == nil {
+		return nil
+	}
+	f := s.file
+	s.file = nil
+
+	errs := []error{s.rw.Flush()}
+	if s.gz != nil {
+		errs = append(errs, s.gz.Close())
+		s.gz = nil
+	}
+	errs = append(errs, s.bw.Flush(), f.Sync(), f.Close())
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.finalPath())
+}
+
+// Write writes the item to the current file, rotating it first if it is due
+func (s *FileSink[T]) Write(v T) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fmt.Errorf("file sink %s is closed", s.path)
+	}
+
+	if s.file != nil {
+		// Record writers such as CSV buffer their output, so it is flushed for the size to be up to date
+		if s.opts.MaxSize > 0 {
+			if err := s.rw.Flush(); err != nil {
+				return err
+			}
+		}
+		full := s.opts.MaxSize > 0 && s.counter.n >= s.opts.MaxSize
+		old := s.opts.MaxAge > 0 && s.opts.now().Sub(s.openedAt) >= s.opts.MaxAge
+		if full || old {
+			if err := s.finish(); err != nil {
+				return err
+			}
+		}
+	}
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	return s.rw.Write(v)
+}
+
+// Rotate completes the current file, the next write starts a new one
+func (s *FileSink[T]) Rotate() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotated = true
+	return s.finish()
+}
+
+// Close completes the current file, no more items can be written afterwards
+func (s *FileSink[T]) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.finish()
+}
+
+// Drain is the same as Dequeue with Write as the dequeue function, but closes the sink once the queue is drained. The
+// close error, if any, is sent on the error channel before it is closed.
+func (s *FileSink[T]) Drain(queue <-chan T, bufferSize int, workers int) <-chan error {
+	return drainSink(queue, s.Write, s.Close, bufferSize, workers)
+}
+
+// drainSink runs Dequeue and calls done once every item has been written
+func drainSink[T any](queue <-chan T, write func(T) error, done func() error, bufferSize int, workers int) <-chan error {
+	// Sanity check for bufSize as the channel is created here as well
+	if bufferSize < 0 {
+		bufferSize = 0
+	}
+	errc := make(chan error, bufferSize)
+	go func() {
+		defer close(errc)
+		for err := range Dequeue(queue, write, bufferSize, workers) {
+			errc <- err
+		}
+		if err := done(); err != nil {
+			errc <- err
+		}
+	}()
+	return errc
+}
@@ -0,0 +1,220 @@
+package pipelines
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriterSink(t *testing.T) {
+	records := []readerRecord{{Name: "a", Count: 1, Price: 1.5}, {Name: "b, c", Count: 2}}
+
+	// Test that JSONL written by the sink can be read back by FromReader
+	var buf bytes.Buffer
+	s := NewWriterSink[readerRecord](&buf, NewJSONLWriter[readerRecord])
+	for err := range s.Drain(ConvertSliceToClosedChannel(records), 1, 1) {
+		t.Errorf("expected no errors, got: %v", err)
+	}
+	result, errs := drainQueue(FromReader[readerRecord](&buf, JSONCodec[readerRecord]{}, ReaderOptions{}))
+	if len(errs) != 0 || !reflect.DeepEqual(result, records) {
+		t.Errorf("expected %v, got: %v, %v", records, result, errs)
+	}
+
+	// Test that CSV written by the sink can be read back by FromCSV
+	buf.Reset()
+	s = NewWriterSink[readerRecord](&buf, NewCSVWriter[readerRecord])
+	for err := range s.Drain(ConvertSliceToClosedChannel(records), 1, 1) {
+		t.Errorf("expected no errors, got: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), "name,count,Price\n") {
+		t.Errorf("expected a csv header, got: %s", buf.String())
+	}
+	result, errs = drainQueue(FromCSV[readerRecord](&buf, ReaderOptions{}))
+	if len(errs) != 0 || !reflect.DeepEqual(result, records) {
+		t.Errorf("expected %v, got: %v, %v", records, result, errs)
+	}
+
+	// Test that a gob stream can be decoded
+	buf.Reset()
+	s = NewWriterSink[readerRecord](&buf, NewGobWriter[readerRecord])
+	for err := range s.Drain(ConvertSliceToClosedChannel(records), 1, 1) {
+		t.Errorf("expected no errors, got: %v", err)
+	}
+	dec := gob.NewDecoder(&buf)
+	for _, want := range records {
+		var got readerRecord
+		if err := dec.Decode(&got); err != nil || got != want {
+			t.Errorf("expected %v, got: %v, %v", want, got, err)
+		}
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out", "events.jsonl")
+
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	s, err := NewFileSink[int](path, NewJSONLWriter[int], FileSinkOptions{
+		MaxSize: 4,
+		MaxAge:  time.Minute,
+		Gzip:    true,
+		now:     func() time.Time { return now },
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// "10\n" and "20\n" fill the first file, a minute passing rotates the second
+	_ = s.Write(10)
+	_ = s.Write(20)
+	_ = s.Write(30)
+	now = now.Add(time.Minute)
+	_ = s.Write(40)
+
+	// The third file is still a temporary file until the sink is drained
+	files, _ := filepath.Glob(filepath.Join(dir, "out", "*.gz"))
+	if len(files) != 2 {
+		t.Errorf("expected 2 completed files before draining, got: %v", files)
+	}
+	for err := range s.Drain(ConvertSliceToClosedChannel([]int{50}), 1, 1) {
+		t.Errorf("expected no errors, got: %v", err)
+	}
+
+	files, _ = filepath.Glob(filepath.Join(dir, "out", "*"))
+	sort.Strings(files)
+	expected := []string{
+		filepath.Join(dir, "out", "events.20230102T030405Z.1.jsonl.gz"),
+		filepath.Join(dir, "out", "events.20230102T030405Z.2.jsonl.gz"),
+		filepath.Join(dir, "out", "events.20230102T030505Z.3.jsonl.gz"),
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("expected %v, got: %v", expected, files)
+	}
+	contents := []string{"10\n20\n", "30\n", "40\n50\n"}
+	for i, file := range files {
+		f, _ := os.Open(file)
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("expected a gzip file, got: %v", err)
+		}
+		b, _ := io.ReadAll(gz)
+		f.Close()
+		if string(b) != contents[i] {
+			t.Errorf("expected %q in %s, got: %q", contents[i], file, b)
+		}
+	}
+
+	if err := s.Write(60); err == nil {
+		t.Error("expected an error writing to a closed sink")
+	}
+}
+
+func TestFileSinkManualRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.jsonl")
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	s, err := NewFileSink[int](path, NewJSONLWriter[int], FileSinkOptions{now: func() time.Time { return now }})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// Test that rotating a sink without MaxSize or MaxAge does not let the next file replace the first
+	_ = s.Write(1)
+	if err := s.Rotate(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	_ = s.Write(2)
+	if err := s.Close(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	sort.Strings(files)
+	expected := []string{
+		filepath.Join(dir, "events.20230102T030405Z.1.jsonl"),
+		filepath.Join(dir, "events.20230102T030405Z.2.jsonl"),
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("expected %v, got: %v", expected, files)
+	}
+	for i, file := range files {
+		if b, _ := os.ReadFile(file); string(b) != fmt.Sprintf("%d\n", i+1) {
+			t.Errorf("expected %d in %s, got: %q", i+1, file, b)
+		}
+	}
+}
+
+func TestFileSinkCSVRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rows.csv")
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	s, err := NewFileSink[readerRecord](path, NewCSVWriter[readerRecord], FileSinkOptions{
+		MaxSize: 10,
+		now:     func() time.Time { return now },
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// Test that buffered CSV output counts towards the size, each file gets a header and a single row
+	_ = s.Write(readerRecord{Name: "a", Count: 1})
+	_ = s.Write(readerRecord{Name: "b", Count: 2})
+	files, _ := filepath.Glob(filepath.Join(dir, "*.csv"))
+	if len(files) != 1 {
+		t.Fatalf("expected the first file to be rotated, got: %v", files)
+	}
+	b, _ := os.ReadFile(files[0])
+	if rows := strings.Count(string(b), "\n"); rows != 2 {
+		t.Errorf("expected a header and a row, got: %q", b)
+	}
+
+	// Test that a file that failed to complete is not overwritten by the next one
+	blocked := filepath.Join(dir, "rows.20230102T030405Z.2.csv")
+	if err := os.MkdirAll(filepath.Join(blocked, "dir"), 0o755); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := s.Write(readerRecord{Name: "c", Count: 3}); err == nil {
+		t.Error("expected the rotation to fail")
+	}
+	_ = s.Write(readerRecord{Name: "d", Count: 4})
+	tmps, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	kept := false
+	for _, tmp := range tmps {
+		if b, _ := os.ReadFile(tmp); strings.Contains(string(b), "b,2") {
+			kept = true
+		}
+	}
+	if !kept {
+		t.Errorf("expected the failed file to be kept, got: %v", tmps)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+}
+
+// drainQueue reads a queue function until it returns ErrQueueEmpty
+func drainQueue[T any](next func(context.Context) (T, error)) ([]T, []error) {
+	result := make([]T, 0)
+	errs := make([]error, 0)
+	for {
+		v, err := next(context.Background())
+		if errors.Is(err, ErrQueueEmpty) {
+			return result, errs
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		result = append(result, v)
+	}
+}
@@ -0,0 +1,343 @@
+package pipelines
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// StageOptions configures a stage started with QueueWithOptions, WorkerPoolWithOptions or DequeueWithOptions. The
+// Pipeline and Traced variants of Queue, WorkerPool and Dequeue are shorthands for them, setting both the Pipeline and
+// the Tracer gives a stage that can be paused and drained and is traced.
+type StageOptions struct {
+	// BufferSize and Workers are the same as the arguments of Queue, WorkerPool and Dequeue
+	BufferSize int
+	Workers    int
+	// Stage names the stage in the logs, the Pipeline and the spans
+	Stage string
+	// Service is added to every log line of the stage along with the stage, it defaults to the name of the Pipeline or
+	// the service of the Tracer
+	Service string
+	// Pipeline registers the stage so it can be inspected, paused and drained, it is optional
+	Pipeline *Pipeline
+	// Tracer records a span for every item, it is optional and only used if the items are envelopes
+	Tracer *Tracer
+}
+
+// stageHooks are the optional callbacks of the loop shared by every Queue, WorkerPool and Dequeue variant. Every hook
+// is set, the ones the StageOptions do not need do nothing.
+type stageHooks[T1, T2 any] struct {
+	kind string
+	// kv is added to every log line of the stage
+	kv []any
+	// stop is closed when a queue has to stop producing besides its context being done, a nil channel never is
+	stop <-chan struct{}
+	// wait blocks a worker before it takes the next item while the stage is paused, it returns false if done is closed
+	// first. paused returns the channels that are closed once the pipeline or the stage is paused, so a worker blocked
+	// on its input goes back to wait.
+	wait   func(worker int, done <-chan struct{}) bool
+	paused func() (<-chan struct{}, <-chan struct{})
+	state  func(worker int, state WorkerState)
+	// before is called once a worker has an item to work on, with nil for a queue as it has no input. The function it
+	// returns is called with the result or error before it is sent and returns the function called once it was sent.
+	before func(v *T1, start time.Time) func(res *T2, err error) func()
+	// record is called once the stage function returned and sent once its result or error was taken
+	record func(start time.Time, err error)
+	sent   func()
+	exit   func(worker int)
+	finish func()
+}
+
+func noop() {}
+
+func newStageHooks[T1, T2 any](kind string, opts StageOptions, workers int, input *channelProbe, output *channelProbe, errs *channelProbe) *stageHooks[T1, T2] {
+	h := &stageHooks[T1, T2]{
+		kind:   kind,
+		wait:   func(int, <-chan struct{}) bool { return true },
+		paused: func() (<-chan struct{}, <-chan struct{}) { return nil, nil },
+		state:  func(int, WorkerState) {},
+		before: func(*T1, time.Time) func(*T2, error) func() {
+			return func(*T2, error) func() { return noop }
+		},
+		record: func(time.Time, error) {},
+		sent:   noop,
+		exit:   func(int) {},
+		finish: noop,
+	}
+
+	service := opts.Service
+	if p := opts.Pipeline; p != nil {
+		if service == "" {
+			service = p.name
+		}
+		s := p.register(opts.Stage, kind, workers, input, output, errs)
+		h.stop = p.drain
+		h.wait = s.wait
+		h.paused = s.pausedChans
+		h.state = s.setState
+		h.record = s.record
+		h.sent = s.progress
+		h.exit = s.exit
+		h.finish = s.finish
+	}
+	if t := opts.Tracer; t != nil {
+		if service == "" {
+			service = t.opts.Service
+		}
+		h.before = traceHook[T1, T2](t, opts.Stage)
+	}
+
+	if service != "" {
+		h.kv = append(h.kv, "service", service)
+	}
+	if opts.Stage != "" {
+		h.kv = append(h.kv, "stage", opts.Stage)
+	}
+	return h
+}
+
+func (h *stageHooks[T1, T2]) logInfo(msg string, keyvals ...any) {
+	logInfo(h.kind, msg, append(keyvals, h.kv...)...)
+}
+
+func (h *stageHooks[T1, T2]) logError(msg string, err error, keyvals ...any) {
+	logError(h.kind, msg, err, append(keyvals, h.kv...)...)
+}
+
+// receive takes the next item from the queue, it returns early if the stage is paused meanwhile so the worker can wait
+// without holding on to an item
+func (h *stageHooks[T1, T2]) receive(queue <-chan T1) (v T1, ok bool, paused bool) {
+	pipelinePaused, stagePaused := h.paused()
+	select {
+	case v, ok = <-queue:
+		return v, ok, false
+	case <-pipelinePaused:
+	case <-stagePaused:
+	}
+	return v, false, true
+}
+
+func stageSizes(opts StageOptions) (int, int) {
+	// Sanity check to make sure buffer size and workers are at minimum values
+	bufferSize, workers := opts.BufferSize, opts.Workers
+	if bufferSize < 0 {
+		bufferSize = 0
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return bufferSize, workers
+}
+
+// QueueWithOptions is the same as Queue but the stage is configured with StageOptions
+func QueueWithOptions[T any](ctx context.Context, queueFunc func(context.Context) (T, error), opts StageOptions) (<-chan T, <-chan error) {
+	bufferSize, workers := stageSizes(opts)
+
+	var wg sync.WaitGroup
+	queueChan := make(chan T, bufferSize)
+	errorChan := make(chan error, bufferSize)
+	h := newStageHooks[struct{}, T]("Queue", opts, workers, nil, probeChannel(queueChan), probeChannel(errorChan))
+
+	// done stops the workers once the context is done or the queue has to stop
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-h.stop:
+		case <-finished:
+			return
+		}
+		close(done)
+	}()
+
+	wg.Add(workers)
+	h.logInfo("started", "workers", workers)
+	// Start as many workers as requested
+	for i := 0; i < workers; i++ {
+		go func(worker int) {
+			defer wg.Done() // Remove one from wg as this exits
+			defer h.exit(worker)
+			for {
+				if h.wait(worker, done) {
+					select {
+					case <-ctx.Done():
+					case <-h.stop:
+					default:
+						if !h.produce(ctx, queueFunc, worker, queueChan, errorChan) {
+							return
+						}
+						continue
+					}
+				}
+				if ctx.Err() != nil {
+					h.logInfo("worker cancelled", "worker", worker, "reason", ctx.Err())
+				} else {
+					h.logInfo("worker exited", "worker", worker, "reason", "drained")
+				}
+				return
+			}
+		}(i)
+	}
+
+	// Create a go routine that is waiting for all workers, so it can shut down it's channels
+	go func() {
+		wg.Wait()
+		close(finished)
+		close(queueChan)
+		close(errorChan)
+		h.finish()
+		h.logInfo("channels closed")
+	}()
+
+	return queueChan, errorChan
+}
+
+// produce calls the queueFunc for the next result and publishes it to the queue or error channel, it returns false once
+// the queue is empty
+func (h *stageHooks[T1, T2]) produce(ctx context.Context, queueFunc func(context.Context) (T2, error), worker int, queueChan chan<- T2, errorChan chan<- error) bool {
+	h.state(worker, WorkerBusy)
+	start := time.Now()
+	res, err := queueFunc(ctx)
+	if errors.Is(err, ErrQueueEmpty) {
+		h.logInfo("worker exited", "worker", worker, "reason", "queue empty")
+		return false
+	}
+	after := h.before(nil, start)
+	h.record(start, err)
+	if err != nil {
+		h.logError("queue function failed", err, "worker", worker)
+		sent := after(nil, err)
+		h.state(worker, WorkerSendingError)
+		errorChan <- err
+		sent()
+		h.sent()
+		return true
+	}
+	sent := after(&res, nil)
+	h.state(worker, WorkerSending)
+	queueChan <- res
+	sent()
+	h.sent()
+	return true
+}
+
+// WorkerPoolWithOptions is the same as WorkerPool but the stage is configured with StageOptions
+func WorkerPoolWithOptions[T1, T2 any](queue <-chan T1, workFunc func(T1) (T2, error), opts StageOptions) (<-chan T2, <-chan error) {
+	bufferSize, workers := stageSizes(opts)
+
+	var wg sync.WaitGroup
+	out := make(chan T2, bufferSize)
+	errc := make(chan error, bufferSize)
+	h := newStageHooks[T1, T2]("WorkerPool", opts, workers, probeChannel(queue), probeChannel(out), probeChannel(errc))
+
+	wg.Add(workers)
+	h.logInfo("started", "workers", workers)
+	// Create workers that will call the workFunc
+	for i := 0; i < workers; i++ {
+		go func(worker int) {
+			defer wg.Done()
+			defer h.exit(worker)
+			for {
+				h.wait(worker, nil)
+				h.state(worker, WorkerIdle)
+				work, ok, paused := h.receive(queue)
+				if paused {
+					continue
+				}
+				if !ok {
+					break
+				}
+				// The stage may have been paused while the item was received, it is held until the stage is resumed
+				h.wait(worker, nil)
+
+				h.state(worker, WorkerBusy)
+				start := time.Now()
+				after := h.before(&work, start)
+				res, err := workFunc(work)
+				h.record(start, err)
+				sent := after(&res, err)
+				if err != nil {
+					h.logError("work function failed", err, "worker", worker)
+					h.state(worker, WorkerSendingError)
+					errc <- err
+				} else {
+					h.state(worker, WorkerSending)
+					out <- res
+				}
+				sent()
+				h.sent()
+			}
+			h.logInfo("worker exited", "worker", worker, "reason", "input drained")
+		}(i)
+	}
+
+	// Spin up another goroutine to wait until workers are done until closing the channels
+	go func() {
+		wg.Wait()
+		close(out)
+		close(errc)
+		h.finish()
+		h.logInfo("channels closed")
+	}()
+
+	return out, errc
+}
+
+// DequeueWithOptions is the same as Dequeue but the stage is configured with StageOptions
+func DequeueWithOptions[T any](queue <-chan T, dequeueFunc func(T) error, opts StageOptions) <-chan error {
+	bufferSize, workers := stageSizes(opts)
+
+	var wg sync.WaitGroup
+	errChan := make(chan error, bufferSize)
+	h := newStageHooks[T, struct{}]("Dequeue", opts, workers, probeChannel(queue), nil, probeChannel(errChan))
+
+	wg.Add(workers)
+	h.logInfo("started", "workers", workers)
+	for i := 0; i < workers; i++ {
+		// Spin up the workers
+		go func(worker int) {
+			defer wg.Done()
+			defer h.exit(worker)
+			for {
+				h.wait(worker, nil)
+				h.state(worker, WorkerIdle)
+				val, ok, paused := h.receive(queue)
+				if paused {
+					continue
+				}
+				if !ok {
+					break
+				}
+				// The stage may have been paused while the item was received, it is held until the stage is resumed
+				h.wait(worker, nil)
+
+				h.state(worker, WorkerBusy)
+				start := time.Now()
+				after := h.before(&val, start)
+				err := dequeueFunc(val)
+				h.record(start, err)
+				sent := after(nil, err)
+				if err != nil {
+					h.logError("dequeue function failed", err, "worker", worker)
+					h.state(worker, WorkerSendingError)
+					errChan <- err
+				}
+				sent()
+				h.sent()
+			}
+			h.logInfo("worker exited", "worker", worker, "reason", "input drained")
+		}(i)
+	}
+
+	// Wait till all workers are done before we close the errChan
+	go func() {
+		wg.Wait()
+		close(errChan)
+		h.finish()
+		h.logInfo("channel closed")
+	}()
+
+	return errChan
+}
@@ -0,0 +1,45 @@
+package pipelines
+
+import (
+	"context"
+	"testing"
+)
+
+func TestStageOptions(t *testing.T) {
+	exporter := &MemorySpanExporter{}
+	tracer := NewTracer(TracerOptions{Service: "service", Exporter: exporter})
+	p := NewPipeline("service", PipelineOptions{})
+	i := 0
+	queueFunc := func(ctx context.Context) (int, error) {
+		if i >= 3 {
+			return 0, ErrQueueEmpty
+		}
+		i++
+		return i, nil
+	}
+	queue, qErrs := QueueWithOptions(context.Background(), EnvelopeQueue(queueFunc), StageOptions{Stage: "source", Pipeline: p, Tracer: tracer})
+	doubled, wErrs := WorkerPoolWithOptions(queue, EnvelopeStage(func(n int) (int, error) {
+		return n * 2, nil
+	}), StageOptions{BufferSize: 1, Workers: 2, Stage: "double", Pipeline: p, Tracer: tracer})
+	var sum int
+	dErrs := DequeueWithOptions(doubled, func(e Envelope[int]) error {
+		sum += e.Item
+		return nil
+	}, StageOptions{Stage: "sum", Pipeline: p, Tracer: tracer})
+	for err := range Merge(qErrs, wErrs, dErrs) {
+		t.Errorf("expected no errors, got: %v", err)
+	}
+	if err := tracer.Close(context.Background()); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// Test that a stage can be registered with a pipeline and traced at the same time
+	waitFor(t, "the pipeline to be done", p.Done)
+	snap := p.Snapshot()
+	if sum != 12 || len(snap.Stages) != 3 || snap.Stages[1].Processed != 3 || len(snap.Stages[1].Workers) != 2 {
+		t.Errorf("expected every stage to be registered, got: %d, %+v", sum, snap)
+	}
+	if spans := exporter.Spans(); len(spans) != 9 {
+		t.Errorf("expected a span per item and stage, got: %d", len(spans))
+	}
+}
@@ -0,0 +1,245 @@
+package pipelines
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrSubmitterClosed = fmt.Errorf("submitter is closed and no longer accepts items")
+
+var ErrFutureTimeout = fmt.Errorf("future was not resolved before its timeout")
+
+var ErrSubmissionDropped = fmt.Errorf("submission was dropped by the pipeline")
+
+// Future is the pending result of an item passed to Submitter.Submit. It is resolved once, either when the item
+// reaches SubmitDequeue, when a SubmitStage returns an error for it, when it is dropped, or when its timeout passes.
+type Future[R any] struct {
+	state *futureState[R]
+}
+
+type futureState[R any] struct {
+	once sync.Once
+	done chan struct{}
+	res  R
+	err  error
+	// release gives back the in flight slot once the item left the pipeline, which can be after a timeout
+	releaseOnce sync.Once
+	release     func()
+
+	// mu guards timer as the timer can fire before it has been assigned
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+func newFuture[R any](timeout time.Duration, release func()) Future[R] {
+	f := Future[R]{state: &futureState[R]{done: make(chan struct{}), release: release}}
+	if timeout > 0 {
+		f.state.mu.Lock()
+		f.state.timer = time.AfterFunc(timeout, func() {
+			var zero R
+			f.resolve(zero, ErrFutureTimeout)
+		})
+		f.state.mu.Unlock()
+	}
+	return f
+}
+
+// failedFuture returns a future that is already resolved with err
+func failedFuture[R any](err error) Future[R] {
+	f := newFuture[R](0, nil)
+	var zero R
+	f.resolve(zero, err)
+	return f
+}
+
+// resolve sets the result of the future, only the first call has any effect
+func (f Future[R]) resolve(res R, err error) {
+	f.state.once.Do(func() {
+		f.state.mu.Lock()
+		if f.state.timer != nil {
+			f.state.timer.Stop()
+		}
+		f.state.mu.Unlock()
+		f.state.res = res
+		f.state.err = err
+		close(f.state.done)
+	})
+}
+
+// settle resolves the future and gives back its in flight slot, it is called once the item left the pipeline
+func (f Future[R]) settle(res R, err error) {
+	f.resolve(res, err)
+	f.state.releaseOnce.Do(func() {
+		if f.state.release != nil {
+			f.state.release()
+		}
+	})
+}
+
+// Done returns a channel that is closed once the future is resolved
+func (f Future[R]) Done() <-chan struct{} {
+	return f.state.done
+}
+
+// Wait blocks until the future is resolved or the context is done
+func (f Future[R]) Wait(ctx context.Context) (R, error) {
+	select {
+	case <-f.state.done:
+		return f.state.res, f.state.err
+	case <-ctx.Done():
+		var zero R
+		return zero, ctx.Err()
+	}
+}
+
+// Submission carries an item through a pipeline along with the future that should be resolved for it. Stage functions
+// are lifted with SubmitStage so they can stay unaware of the future.
+type Submission[T, R any] struct {
+	Item   T
+	future Future[R]
+}
+
+// Drop resolves the future of a submission that will not reach the end of the pipeline with ErrSubmissionDropped.
+// Stages that filter submissions have to call it, as the in flight slot of the item is only given back once its
+// future is resolved by the pipeline.
+func (s Submission[T, R]) Drop() {
+	var zero R
+	s.future.settle(zero, ErrSubmissionDropped)
+}
+
+// SubmitterOptions configures a Submitter
+type SubmitterOptions struct {
+	// BufferSize is the buffer of the channel returned by Submitter.Queue
+	BufferSize int
+	// MaxInFlight caps the amount of items in the pipeline, Submit blocks once it is reached. An item stays in flight
+	// until the pipeline resolves its future or it is dropped, even if the future timed out. A value <= 0 means no cap.
+	MaxInFlight int
+	// Timeout resolves a future with ErrFutureTimeout if the pipeline has not resolved it in time, so callers are not
+	// held up by slow items. A value <= 0 means futures never time out.
+	Timeout time.Duration
+}
+
+// Submitter is a push based entry point to a pipeline. Each call to Submit sends an item to the channel returned by
+// Queue and returns a Future that is resolved when that item completes or fails. The channel can be fed to WorkerPool
+// with functions wrapped by SubmitStage and terminated with Dequeue and SubmitDequeue, for example:
+//
+//	s := NewSubmitter[Request, Response](SubmitterOptions{MaxInFlight: 100, Timeout: time.Second})
+//	decodedC, decodeErrC := WorkerPool(s.Queue(), SubmitStage[Request, Decoded, Response](decode), 1, 2)
+//	handledC, handleErrC := WorkerPool(decodedC, SubmitStage[Decoded, Response, Response](handle), 1, 4)
+//	dequeueErrC := Dequeue(handledC, SubmitDequeue[Response](), 1, 1)
+type Submitter[T, R any] struct {
+	opts     SubmitterOptions
+	queue    chan Submission[T, R]
+	inFlight chan struct{}
+
+	// mu guards closed and adding to senders, closing is closed by Close to wake up blocked calls to Submit and the
+	// queue is only closed once every one of them returned
+	mu      sync.Mutex
+	closed  bool
+	closing chan struct{}
+	senders sync.WaitGroup
+}
+
+// NewSubmitter creates a Submitter, Close should be called once no more items will be submitted so the pipeline drains
+func NewSubmitter[T, R any](opts SubmitterOptions) *Submitter[T, R] {
+	// Sanity check for bufSize if it is too low we will set it as an unbuffered channel
+	if opts.BufferSize < 0 {
+		opts.BufferSize = 0
+	}
+
+	s := &Submitter[T, R]{
+		opts:    opts,
+		queue:   make(chan Submission[T, R], opts.BufferSize),
+		closing: make(chan struct{}),
+	}
+	if opts.MaxInFlight > 0 {
+		s.inFlight = make(chan struct{}, opts.MaxInFlight)
+	}
+	return s
+}
+
+// Queue returns the channel submitted items are sent on, it is closed by Close
+func (s *Submitter[T, R]) Queue() <-chan Submission[T, R] {
+	return s.queue
+}
+
+// Submit sends the item into the pipeline and returns the Future for its result. It blocks while the max in flight
+// limit is reached or the queue is full, and returns the context error if ctx is done first or ErrSubmitterClosed if
+// the Submitter is closed meanwhile. On an error the Future is already resolved with it.
+func (s *Submitter[T, R]) Submit(ctx context.Context, item T) (Future[R], error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return failedFuture[R](ErrSubmitterClosed), ErrSubmitterClosed
+	}
+	s.senders.Add(1)
+	s.mu.Unlock()
+	defer s.senders.Done()
+
+	// Reserve an in flight slot, it is given back once the item left the pipeline
+	var release func()
+	if s.inFlight != nil {
+		select {
+		case s.inFlight <- struct{}{}:
+			release = func() { <-s.inFlight }
+		case <-ctx.Done():
+			return failedFuture[R](ctx.Err()), ctx.Err()
+		case <-s.closing:
+			return failedFuture[R](ErrSubmitterClosed), ErrSubmitterClosed
+		}
+	}
+
+	f := newFuture[R](s.opts.Timeout, release)
+	var err error
+	select {
+	case s.queue <- Submission[T, R]{Item: item, future: f}:
+		return f, nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-s.closing:
+		err = ErrSubmitterClosed
+	}
+	var zero R
+	f.settle(zero, err)
+	return f, err
+}
+
+// Close stops accepting new items and closes the queue channel, items already submitted are still processed. Calls to
+// Submit that are blocked return ErrSubmitterClosed.
+func (s *Submitter[T, R]) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.closing)
+	s.mu.Unlock()
+
+	s.senders.Wait()
+	close(s.queue)
+}
+
+// SubmitStage lifts a worker function so that it can be used with WorkerPool on submissions. If the function returns
+// an error the future of the item is resolved with that error and the error is still returned for the error channel.
+func SubmitStage[T1, T2, R any](f func(T1) (T2, error)) func(Submission[T1, R]) (Submission[T2, R], error) {
+	return func(s Submission[T1, R]) (Submission[T2, R], error) {
+		res, err := f(s.Item)
+		if err != nil {
+			var zero R
+			s.future.settle(zero, err)
+			return Submission[T2, R]{}, err
+		}
+		return Submission[T2, R]{Item: res, future: s.future}, nil
+	}
+}
+
+// SubmitDequeue returns a dequeue function that resolves the future of each submission with its final item
+func SubmitDequeue[R any]() func(Submission[R, R]) error {
+	return func(s Submission[R, R]) error {
+		s.future.settle(s.Item, nil)
+		return nil
+	}
+}
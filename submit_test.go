@@ -0,0 +1,165 @@
+package pipelines
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSubmitter(t *testing.T) {
+	ctx := context.Background()
+	s := NewSubmitter[int, string](SubmitterOptions{BufferSize: 1, MaxInFlight: 4, Timeout: time.Second})
+
+	double := func(n int) (int, error) {
+		if n < 0 {
+			return 0, fmt.Errorf("negative number")
+		}
+		return n * 2, nil
+	}
+	format := func(n int) (string, error) {
+		return strconv.Itoa(n), nil
+	}
+	doubledC, doubleErrC := WorkerPool(s.Queue(), SubmitStage[int, int, string](double), 1, 2)
+	formattedC, formatErrC := WorkerPool(doubledC, SubmitStage[int, string, string](format), 1, 2)
+	dequeueErrC := Dequeue(formattedC, SubmitDequeue[string](), 1, 1)
+	errC := Merge(doubleErrC, formatErrC, dequeueErrC)
+
+	// Test that each future gets the result for its own item
+	futures := make([]Future[string], 0)
+	for i := 0; i < 10; i++ {
+		f, err := s.Submit(ctx, i)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		futures = append(futures, f)
+	}
+	for i, f := range futures {
+		res, err := f.Wait(ctx)
+		if err != nil {
+			t.Errorf("expected no error, got: %v", err)
+		}
+		if res != strconv.Itoa(i*2) {
+			t.Errorf("expected %d, got: %s", i*2, res)
+		}
+	}
+
+	// Test that a failing stage resolves the future with its error
+	f, err := s.Submit(ctx, -1)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := f.Wait(ctx); err == nil {
+		t.Error("expected an error from the future")
+	}
+	if err := <-errC; err == nil {
+		t.Error("expected the error on the error channel")
+	}
+
+	// Test that submitting after close is rejected and the pipeline drains
+	s.Close()
+	f, err = s.Submit(ctx, 1)
+	if !errors.Is(err, ErrSubmitterClosed) {
+		t.Errorf("expected ErrSubmitterClosed, got: %v", err)
+	}
+	// The future of a rejected item is resolved with the error
+	<-f.Done()
+	if _, err := f.Wait(ctx); !errors.Is(err, ErrSubmitterClosed) {
+		t.Errorf("expected the future to be resolved with ErrSubmitterClosed, got: %v", err)
+	}
+	for range errC {
+		t.Error("expected no additional errors")
+	}
+}
+
+func TestSubmitterBackpressureAndTimeout(t *testing.T) {
+	ctx := context.Background()
+	s := NewSubmitter[int, int](SubmitterOptions{BufferSize: 2, MaxInFlight: 1, Timeout: 20 * time.Millisecond})
+	defer s.Close()
+
+	// Nothing consumes the queue so the first future is abandoned and times out
+	f, err := s.Submit(ctx, 1)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// The in flight slot is taken so a second submit blocks until the context is done
+	shortCtx, cancel := context.WithTimeout(ctx, 5*time.Millisecond)
+	defer cancel()
+	rejected, err := s.Submit(shortCtx, 2)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got: %v", err)
+	}
+	if _, err := rejected.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the future to be resolved with context.DeadlineExceeded, got: %v", err)
+	}
+
+	if _, err := f.Wait(ctx); !errors.Is(err, ErrFutureTimeout) {
+		t.Errorf("expected ErrFutureTimeout, got: %v", err)
+	}
+
+	// The timed out item is still in the pipeline so its slot is held until the item leaves it
+	shortCtx, cancel = context.WithTimeout(ctx, 5*time.Millisecond)
+	defer cancel()
+	if _, err := s.Submit(shortCtx, 3); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got: %v", err)
+	}
+	sub := <-s.Queue()
+	if err := SubmitDequeue[int]()(Submission[int, int]{Item: sub.Item, future: sub.future}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if res, err := f.Wait(ctx); res != 0 || !errors.Is(err, ErrFutureTimeout) {
+		t.Errorf("expected the future to stay timed out, got: %d, %v", res, err)
+	}
+	f, err = s.Submit(ctx, 4)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// Test that dropping a submission resolves its future and releases its slot
+	(<-s.Queue()).Drop()
+	if _, err := f.Wait(ctx); !errors.Is(err, ErrSubmissionDropped) {
+		t.Errorf("expected ErrSubmissionDropped, got: %v", err)
+	}
+	if _, err := s.Submit(ctx, 5); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+}
+
+func TestSubmitterCloseWhileBlocked(t *testing.T) {
+	ctx := context.Background()
+	s := NewSubmitter[int, int](SubmitterOptions{BufferSize: 1, MaxInFlight: 1})
+	if _, err := s.Submit(ctx, 1); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// Test that Close does not wait for a blocked Submit and that it returns ErrSubmitterClosed
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s.Submit(ctx, 2)
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("expected Close not to wait for the in flight slot")
+	}
+	if err := <-errc; !errors.Is(err, ErrSubmitterClosed) {
+		t.Errorf("expected ErrSubmitterClosed, got: %v", err)
+	}
+	count := 0
+	for range s.Queue() {
+		count++
+	}
+	if count != 1 {
+		t.Errorf("expected the submitted item to stay in the queue, got: %d", count)
+	}
+}
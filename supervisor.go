@@ -0,0 +1,269 @@
+package pipelines
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// SupervisorStrategy decides which children of a Supervisor are restarted when one of them fails
+type SupervisorStrategy int
+
+const (
+	// OneForOne restarts only the child that failed
+	OneForOne SupervisorStrategy = iota
+	// OneForAll stops every other child and restarts all of them when one fails, for children that depend on each other
+	OneForAll
+)
+
+// RestartPolicy decides if a child of a Supervisor is restarted once it returns
+type RestartPolicy int
+
+const (
+	// RestartPermanent children are always restarted
+	RestartPermanent RestartPolicy = iota
+	// RestartTransient children are restarted when they return an error or panic but not when they return nil
+	RestartTransient
+	// RestartTemporary children are never restarted
+	RestartTemporary
+)
+
+// ChildSpec is a pipeline run by a Supervisor. Run should block until the pipeline is done or ctx is done, a pipeline
+// function such as TagPipeline in the examples fits it.
+type ChildSpec struct {
+	Name    string
+	Run     func(ctx context.Context) error
+	Restart RestartPolicy
+}
+
+// RestartMetricsHandler is an optional extension of MetricsHandler, a Supervisor will check if its MetricsHandler
+// implements it and report every restart of a child
+type RestartMetricsHandler interface {
+	IncrementRestartCount(service string, stage string)
+}
+
+// SupervisorOptions configures a Supervisor
+type SupervisorOptions struct {
+	Strategy SupervisorStrategy
+	// MaxRestarts is how many restarts are allowed within the Period before the supervisor gives up, it defaults to 3
+	MaxRestarts int
+	// Period is the window MaxRestarts is counted over, it defaults to 5 seconds
+	Period time.Duration
+	// Backoff is the delay before the first restart of a child, it doubles for every restart of the child within the
+	// Period and defaults to 100 milliseconds
+	Backoff time.Duration
+	// MaxBackoff caps the delay before a restart, it defaults to 10 seconds
+	MaxBackoff time.Duration
+	// MetricsHandler is called with the supervisor name as the service and the child name as the stage. Failures are
+	// reported with IncrementErrorCount and restarts if it implements RestartMetricsHandler. It is optional.
+	MetricsHandler MetricsHandler
+}
+
+// SupervisorError is returned by a Supervisor once the restart intensity is exceeded, it is an ErrFatal so a parent
+// supervisor or the caller can tell it apart from the failure of a single pipeline
+type SupervisorError struct {
+	Supervisor string
+	// Child is the child whose failure exceeded the restart intensity
+	Child    string
+	Restarts int
+	Err      error
+}
+
+func (e *SupervisorError) Error() string {
+	return fmt.Sprintf("supervisor %s: child %s failed after %d restarts: %v", e.Supervisor, e.Child, e.Restarts, e.Err)
+}
+
+func (e *SupervisorError) Fatal() string {
+	return e.Error()
+}
+
+func (e *SupervisorError) Unwrap() error {
+	return e.Err
+}
+
+// Supervisor runs named pipelines and restarts them when they fail, following Erlang style strategies. A pipeline
+// fails when it returns an error or panics. When more than MaxRestarts restarts happen within the Period the
+// supervisor stops every pipeline and Run returns a SupervisorError. As Run has the same signature as ChildSpec.Run
+// supervisors can be nested into a tree, a child supervisor that gives up is restarted by its parent.
+type Supervisor struct {
+	name     string
+	opts     SupervisorOptions
+	children []ChildSpec
+}
+
+// NewSupervisor creates a Supervisor for the children, they are started by Run in the given order
+func NewSupervisor(name string, opts SupervisorOptions, children ...ChildSpec) *Supervisor {
+	if opts.MaxRestarts <= 0 {
+		opts.MaxRestarts = 3
+	}
+	if opts.Period <= 0 {
+		opts.Period = 5 * time.Second
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = 100 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 10 * time.Second
+	}
+	return &Supervisor{name: name, opts: opts, children: children}
+}
+
+// Name returns the name of the supervisor
+func (s *Supervisor) Name() string {
+	return s.name
+}
+
+type childExit struct {
+	index int
+	err   error
+}
+
+// runChild runs a child and turns a panic into an error
+func runChild(ctx context.Context, spec ChildSpec) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return spec.Run(ctx)
+}
+
+// Run starts every child and supervises them until ctx is done, in which case it stops them and returns nil, or
+// until every child returned without being restarted. It returns a SupervisorError if the restart intensity is
+// exceeded.
+func (s *Supervisor) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	exits := make(chan childExit)
+	restartc := make(chan []int)
+	cancels := make([]context.CancelFunc, len(s.children))
+	// restarts are the times of the restarts within the Period, per child for the backoff and in total for the intensity
+	var restarts []time.Time
+	childRestarts := make([][]time.Time, len(s.children))
+	running, waiting := 0, 0
+
+	start := func(i int) {
+		childCtx, childCancel := context.WithCancel(ctx)
+		cancels[i] = childCancel
+		running++
+		go func() {
+			exits <- childExit{index: i, err: runChild(childCtx, s.children[i])}
+		}()
+	}
+	// stop cancels the running children and waits for them to return, their errors are ignored
+	stop := func() {
+		for i, c := range cancels {
+			if c != nil {
+				c()
+				cancels[i] = nil
+			}
+		}
+		for ; running > 0; running-- {
+			<-exits
+		}
+	}
+
+	logInfo("Supervisor", "started", "service", s.name, "children", len(s.children))
+	for i := range s.children {
+		start(i)
+	}
+
+	for running > 0 || waiting > 0 {
+		var exit childExit
+		select {
+		case <-ctx.Done():
+			stop()
+			logInfo("Supervisor", "stopped", "service", s.name)
+			return nil
+		case indexes := <-restartc:
+			waiting--
+			for _, i := range indexes {
+				start(i)
+				logInfo("Supervisor", "child restarted", "service", s.name, "stage", s.children[i].Name, "restarts", len(childRestarts[i]))
+				if mh, ok := s.opts.MetricsHandler.(RestartMetricsHandler); ok {
+					mh.IncrementRestartCount(s.name, s.children[i].Name)
+				}
+			}
+			continue
+		case exit = <-exits:
+		}
+
+		running--
+		cancels[exit.index]()
+		cancels[exit.index] = nil
+		spec := s.children[exit.index]
+		if exit.err != nil {
+			logError("Supervisor", "child failed", exit.err, "service", s.name, "stage", spec.Name)
+			if s.opts.MetricsHandler != nil {
+				s.opts.MetricsHandler.IncrementErrorCount(s.name, spec.Name)
+			}
+		} else {
+			logInfo("Supervisor", "child returned", "service", s.name, "stage", spec.Name)
+		}
+		if spec.Restart == RestartTemporary || (spec.Restart == RestartTransient && exit.err == nil) {
+			continue
+		}
+
+		// Check the restart intensity, the restarts that are older than the Period are forgotten
+		now := time.Now()
+		restarts = append(recentRestarts(restarts, now, s.opts.Period), now)
+		childRestarts[exit.index] = append(recentRestarts(childRestarts[exit.index], now, s.opts.Period), now)
+		if len(restarts) > s.opts.MaxRestarts {
+			stop()
+			err := &SupervisorError{Supervisor: s.name, Child: spec.Name, Restarts: len(restarts) - 1, Err: exit.err}
+			if err.Err == nil {
+				err.Err = fmt.Errorf("child returned")
+			}
+			logError("Supervisor", "restart intensity exceeded", err, "service", s.name, "stage", spec.Name)
+			return err
+		}
+
+		// One for all restarts the children that were still running along with the failed one
+		indexes := []int{exit.index}
+		if s.opts.Strategy == OneForAll {
+			for i, c := range cancels {
+				if c != nil && s.children[i].Restart != RestartTemporary {
+					indexes = append(indexes, i)
+				}
+			}
+			stop()
+		}
+		delay := s.backoff(len(childRestarts[exit.index]))
+		logInfo("Supervisor", "child restarting", "service", s.name, "stage", spec.Name, "backoff", delay)
+		waiting++
+		go func() {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case restartc <- indexes:
+			case <-ctx.Done():
+			}
+		}()
+	}
+	logInfo("Supervisor", "children returned", "service", s.name)
+	return nil
+}
+
+// backoff returns the delay before the n-th restart of a child within the Period
+func (s *Supervisor) backoff(n int) time.Duration {
+	d := s.opts.Backoff
+	for i := 1; i < n && d < s.opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > s.opts.MaxBackoff {
+		d = s.opts.MaxBackoff
+	}
+	return d
+}
+
+func recentRestarts(restarts []time.Time, now time.Time, period time.Duration) []time.Time {
+	i := 0
+	for i < len(restarts) && now.Sub(restarts[i]) > period {
+		i++
+	}
+	return restarts[i:]
+}
@@ -0,0 +1,148 @@
+package pipelines
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type restartMetricHandler struct {
+	statusMetricHandler
+	mu       sync.Mutex
+	restarts map[string]int
+}
+
+func (rmh *restartMetricHandler) IncrementRestartCount(service string, stage string) {
+	rmh.mu.Lock()
+	defer rmh.mu.Unlock()
+	rmh.restarts[service+"/"+stage]++
+}
+
+func TestSupervisorOneForOne(t *testing.T) {
+	mh := &restartMetricHandler{statusMetricHandler: statusMetricHandler{statuses: make(map[string]int)}, restarts: make(map[string]int)}
+	var flakyStarts, steadyStarts atomic.Int32
+	s := NewSupervisor("service", SupervisorOptions{Backoff: time.Millisecond, MetricsHandler: mh},
+		ChildSpec{Name: "flaky", Run: func(ctx context.Context) error {
+			if flakyStarts.Add(1) <= 2 {
+				return fmt.Errorf("connection lost")
+			}
+			<-ctx.Done()
+			return nil
+		}},
+		ChildSpec{Name: "steady", Run: func(ctx context.Context) error {
+			steadyStarts.Add(1)
+			<-ctx.Done()
+			return nil
+		}},
+	)
+
+	// Test that only the failed child is restarted
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() { result <- s.Run(ctx) }()
+	waitFor(t, "the flaky child to be restarted", func() bool { return flakyStarts.Load() == 3 })
+	cancel()
+	if err := <-result; err != nil {
+		t.Errorf("expected no error once cancelled, got: %v", err)
+	}
+	if steadyStarts.Load() != 1 {
+		t.Errorf("expected the steady child to run once, got: %d", steadyStarts.Load())
+	}
+
+	// Test that failures and restarts are reported
+	if mh.restarts["service/flaky"] != 2 || mh.errors != 2 {
+		t.Errorf("expected 2 restarts and errors, got: %v, %d", mh.restarts, mh.errors)
+	}
+}
+
+func TestSupervisorOneForAll(t *testing.T) {
+	var aStarts, bStarts, cStarts atomic.Int32
+	s := NewSupervisor("service", SupervisorOptions{Strategy: OneForAll, Backoff: time.Millisecond},
+		ChildSpec{Name: "a", Run: func(ctx context.Context) error {
+			if aStarts.Add(1) == 1 {
+				panic("bad state")
+			}
+			<-ctx.Done()
+			return nil
+		}},
+		ChildSpec{Name: "b", Run: func(ctx context.Context) error {
+			bStarts.Add(1)
+			<-ctx.Done()
+			return nil
+		}},
+		ChildSpec{Name: "c", Restart: RestartTemporary, Run: func(ctx context.Context) error {
+			cStarts.Add(1)
+			<-ctx.Done()
+			return nil
+		}},
+	)
+
+	// Test that a panic restarts every child but the temporary one
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() { result <- s.Run(ctx) }()
+	waitFor(t, "the children to be restarted", func() bool { return aStarts.Load() == 2 && bStarts.Load() == 2 })
+	cancel()
+	if err := <-result; err != nil {
+		t.Errorf("expected no error once cancelled, got: %v", err)
+	}
+	if cStarts.Load() != 1 {
+		t.Errorf("expected the temporary child to run once, got: %d", cStarts.Load())
+	}
+}
+
+func TestSupervisorEscalation(t *testing.T) {
+	errLost := fmt.Errorf("connection lost")
+	var starts atomic.Int32
+	inner := NewSupervisor("inner", SupervisorOptions{MaxRestarts: 2, Backoff: time.Millisecond},
+		ChildSpec{Name: "crashing", Run: func(ctx context.Context) error {
+			starts.Add(1)
+			return errLost
+		}},
+		ChildSpec{Name: "done", Restart: RestartTransient, Run: func(ctx context.Context) error {
+			return nil
+		}},
+	)
+
+	// Test that a child that keeps failing escalates
+	err := inner.Run(context.Background())
+	var supErr *SupervisorError
+	if !errors.As(err, &supErr) || supErr.Supervisor != "inner" || supErr.Child != "crashing" || supErr.Restarts != 2 {
+		t.Fatalf("expected a SupervisorError, got: %v", err)
+	}
+	if _, ok := err.(ErrFatal); !ok || !errors.Is(err, errLost) || starts.Load() != 3 {
+		t.Errorf("expected a fatal error wrapping the failure, got: %v, %d starts", err, starts.Load())
+	}
+
+	// Test that a parent restarts a child supervisor and escalates in turn
+	starts.Store(0)
+	outer := NewSupervisor("outer", SupervisorOptions{MaxRestarts: 1, Backoff: time.Millisecond},
+		ChildSpec{Name: "inner", Run: inner.Run},
+	)
+	err = outer.Run(context.Background())
+	if !errors.As(err, &supErr) || supErr.Supervisor != "outer" || !errors.Is(err, errLost) || starts.Load() != 6 {
+		t.Errorf("expected the outer supervisor to give up, got: %v, %d starts", err, starts.Load())
+	}
+
+	// Test that a supervisor returns once every child returned without being restarted
+	s := NewSupervisor("service", SupervisorOptions{}, ChildSpec{Name: "done", Restart: RestartTransient, Run: func(ctx context.Context) error {
+		return nil
+	}})
+	if err := s.Run(context.Background()); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+}
+
+func TestSupervisorBackoff(t *testing.T) {
+	s := NewSupervisor("service", SupervisorOptions{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond})
+	expected := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond}
+	for i, e := range expected {
+		if d := s.backoff(i + 1); d != e {
+			t.Errorf("expected a backoff of %s for restart %d, got: %s", e, i+1, d)
+		}
+	}
+}
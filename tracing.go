@@ -0,0 +1,492 @@
+package pipelines
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceParentHeader is the envelope header the trace context is propagated in, in the W3C traceparent format so it
+// can be passed on to and taken from HTTP requests as is
+const TraceParentHeader = "traceparent"
+
+// Span records the work done on a single item by a single stage
+type Span struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	// Name is the stage
+	Name       string
+	Service    string
+	EnvelopeID string
+	// Start is when the stage received the item and End when it finished sending the result
+	Start time.Time
+	End   time.Time
+	// QueueWait is the time from when the previous traced stage started sending the item until this stage received it
+	QueueWait time.Duration
+	// Processing is the time spent in the stage function
+	Processing time.Duration
+	// SendBlocked is the time spent waiting for the next stage to take the result
+	SendBlocked time.Duration
+	// Err is the error returned by the stage function, if any
+	Err string
+}
+
+// SpanExporter sends finished spans to a tracing backend
+type SpanExporter interface {
+	Export(ctx context.Context, spans []Span) error
+}
+
+// TracerOptions configures a Tracer
+type TracerOptions struct {
+	// Service is set on every span
+	Service string
+	// Exporter receives the finished spans
+	Exporter SpanExporter
+	// SampleRate is the fraction of traces that are recorded, values outside (0, 1] default to 1. The decision is made
+	// when a trace starts and propagated with it.
+	SampleRate float64
+	// BatchSize is the amount of spans that triggers an export, defaults to 512
+	BatchSize int
+	// FlushInterval is the longest spans are buffered before they are exported, defaults to five seconds
+	FlushInterval time.Duration
+	// MaxBufferedSpans caps the spans waiting to be exported, new spans are dropped and counted once it is reached so a
+	// slow exporter does not grow the buffer without bound. Defaults to four times the BatchSize.
+	MaxBufferedSpans int
+	// ExportTimeout is how long an export made in the background may take, defaults to ten seconds
+	ExportTimeout time.Duration
+	// OnError is called with the errors of exports made in the background, they are dropped if it is nil
+	OnError func(error)
+}
+
+// Tracer records spans for the items passing through TracedQueue, TracedWorkerPool and TracedDequeue and exports them
+// in batches in the background. Close has to be called once the pipeline is done to export the remaining spans.
+type Tracer struct {
+	opts TracerOptions
+
+	mu      sync.Mutex
+	spans   []Span
+	dropped atomic.Int64
+
+	flushc    chan struct{}
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewTracer creates a Tracer and starts its export loop
+func NewTracer(opts TracerOptions) *Tracer {
+	if opts.SampleRate <= 0 || opts.SampleRate > 1 {
+		opts.SampleRate = 1
+	}
+	if opts.BatchSize < 1 {
+		opts.BatchSize = 512
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 5 * time.Second
+	}
+	if opts.MaxBufferedSpans < opts.BatchSize {
+		opts.MaxBufferedSpans = 4 * opts.BatchSize
+	}
+	if opts.ExportTimeout <= 0 {
+		opts.ExportTimeout = 10 * time.Second
+	}
+	t := &Tracer{
+		opts:    opts,
+		flushc:  make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go t.loop()
+	return t
+}
+
+func (t *Tracer) loop() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(t.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		case <-t.flushc:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), t.opts.ExportTimeout)
+		err := t.Flush(ctx)
+		cancel()
+		if err != nil && t.opts.OnError != nil {
+			t.opts.OnError(err)
+		}
+	}
+}
+
+// Flush exports the buffered spans
+func (t *Tracer) Flush(ctx context.Context) error {
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	return t.opts.Exporter.Export(ctx, spans)
+}
+
+// Close stops the export loop and exports the remaining spans, it returns the context error if ctx is done before an
+// export running in the background finished
+func (t *Tracer) Close(ctx context.Context) error {
+	t.closeOnce.Do(func() {
+		close(t.stop)
+	})
+	select {
+	case <-t.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return t.Flush(ctx)
+}
+
+// Dropped returns the amount of spans that were dropped because the buffer was full
+func (t *Tracer) Dropped() int64 {
+	return t.dropped.Load()
+}
+
+func (t *Tracer) record(s Span) {
+	t.mu.Lock()
+	if len(t.spans) >= t.opts.MaxBufferedSpans {
+		t.mu.Unlock()
+		t.dropped.Add(1)
+		return
+	}
+	t.spans = append(t.spans, s)
+	full := len(t.spans) >= t.opts.BatchSize
+	t.mu.Unlock()
+	if full {
+		select {
+		case t.flushc <- struct{}{}:
+		default:
+		}
+	}
+}
+
+type spanContext struct {
+	traceID string
+	spanID  string
+	sampled bool
+}
+
+func (sc spanContext) traceParent() string {
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.traceID, sc.spanID, flags)
+}
+
+func parseTraceParent(v string) (spanContext, bool) {
+	parts := strings.Split(v, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return spanContext{}, false
+	}
+	for _, p := range parts[1:] {
+		if _, err := hex.DecodeString(p); err != nil {
+			return spanContext{}, false
+		}
+	}
+	flags, _ := strconv.ParseUint(parts[3], 16, 8)
+	return spanContext{traceID: parts[1], spanID: parts[2], sampled: flags&1 == 1}, true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// tracedItem is the span of an item that is being worked on by a stage
+type tracedItem struct {
+	span    Span
+	sampled bool
+}
+
+// beginSpan starts the span for an envelope received by a stage. It continues the trace in the headers or starts a new
+// one, and points the traceparent header at the new span so that it becomes the parent of the next stage. The headers
+// are copied as the envelope may share them with copies sent to other stages.
+func beginSpan(t *Tracer, e traced, stage string, received time.Time) *tracedItem {
+	id, headers, sentAt := e.traceFields()
+	ti := &tracedItem{span: Span{
+		SpanID:     randomHex(8),
+		Name:       stage,
+		Service:    t.opts.Service,
+		EnvelopeID: id,
+		Start:      received,
+	}}
+	if parent, ok := parseTraceParent((*headers)[TraceParentHeader]); ok {
+		ti.span.TraceID = parent.traceID
+		ti.span.ParentSpanID = parent.spanID
+		ti.sampled = parent.sampled
+	} else {
+		ti.span.TraceID = randomHex(16)
+		ti.sampled = mrand.Float64() < t.opts.SampleRate
+	}
+	if !sentAt.IsZero() {
+		ti.span.QueueWait = received.Sub(*sentAt)
+	}
+	*headers = copyHeaders(*headers)
+	(*headers)[TraceParentHeader] = ti.traceParent()
+	return ti
+}
+
+func (ti *tracedItem) traceParent() string {
+	return spanContext{traceID: ti.span.TraceID, spanID: ti.span.SpanID, sampled: ti.sampled}.traceParent()
+}
+
+// prepareSend sets the trace context on a result before it is sent
+func prepareSend(ti *tracedItem, e traced) {
+	_, headers, sentAt := e.traceFields()
+	if *headers == nil {
+		*headers = make(map[string]string)
+	}
+	(*headers)[TraceParentHeader] = ti.traceParent()
+	*sentAt = time.Now()
+}
+
+func (ti *tracedItem) finish(t *Tracer, err error) {
+	ti.span.End = time.Now()
+	if err != nil {
+		ti.span.Err = err.Error()
+	}
+	if ti.sampled {
+		t.record(ti.span)
+	}
+}
+
+// asTraced returns the item as traced if it is an envelope
+func asTraced[T any](v *T) (traced, bool) {
+	if v == nil {
+		return nil, false
+	}
+	e, ok := any(v).(traced)
+	return e, ok
+}
+
+// traceHook is the before hook of a traced stage. The span of an item starts when a worker receives it, or for a queue
+// when the queue function was called, and ends once the result was sent. Items that are not envelopes are not traced.
+func traceHook[T1, T2 any](t *Tracer, stage string) func(*T1, time.Time) func(*T2, error) func() {
+	return func(v *T1, start time.Time) func(*T2, error) func() {
+		var ti *tracedItem
+		if e, ok := asTraced(v); ok {
+			ti = beginSpan(t, e, stage, start)
+		}
+		return func(res *T2, err error) func() {
+			out, isTraced := asTraced(res)
+			if ti == nil {
+				// A queue has no input so its span starts with the item it produced, errors are not traced
+				if !isTraced || err != nil {
+					return noop
+				}
+				ti = beginSpan(t, out, stage, start)
+			}
+			ti.span.Processing = time.Since(start)
+			if err != nil || !isTraced {
+				ti.finish(t, err)
+				return noop
+			}
+			prepareSend(ti, out)
+			sending := time.Now()
+			return func() {
+				ti.span.SendBlocked = time.Since(sending)
+				ti.finish(t, nil)
+			}
+		}
+	}
+}
+
+// TracedQueue is the same as Queue for a queue function producing envelopes, such as one lifted with EnvelopeQueue, but
+// records a span for every item. A trace is started for every item unless it already carries one in its headers.
+func TracedQueue[T any](ctx context.Context, queueFunc func(context.Context) (Envelope[T], error), bufferSize int, workers int, tracer *Tracer, stage string) (<-chan Envelope[T], <-chan error) {
+	return QueueWithOptions(ctx, queueFunc, StageOptions{BufferSize: bufferSize, Workers: workers, Tracer: tracer, Stage: stage})
+}
+
+// TracedWorkerPool is the same as WorkerPool on envelopes but records a span for every item. The envelope passed to the
+// work function carries the trace context of the new span in its headers, so results derived from it with WithItem or
+// ChildEnvelope continue the trace.
+func TracedWorkerPool[T1, T2 any](queue <-chan Envelope[T1], workFunc func(Envelope[T1]) (Envelope[T2], error), bufferSize int, workers int, tracer *Tracer, stage string) (<-chan Envelope[T2], <-chan error) {
+	return WorkerPoolWithOptions(queue, workFunc, StageOptions{BufferSize: bufferSize, Workers: workers, Tracer: tracer, Stage: stage})
+}
+
+// TracedDequeue is the same as Dequeue on envelopes but records a span for every item
+func TracedDequeue[T any](queue <-chan Envelope[T], dequeueFunc func(Envelope[T]) error, bufferSize int, workers int, tracer *Tracer, stage string) <-chan error {
+	return DequeueWithOptions(queue, dequeueFunc, StageOptions{BufferSize: bufferSize, Workers: workers, Tracer: tracer, Stage: stage})
+}
+
+// MemorySpanExporter keeps the exported spans in memory, it is meant for tests
+type MemorySpanExporter struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+func (m *MemorySpanExporter) Export(ctx context.Context, spans []Span) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.spans = append(m.spans, spans...)
+	return nil
+}
+
+// Spans returns a copy of the exported spans
+func (m *MemorySpanExporter) Spans() []Span {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Span(nil), m.spans...)
+}
+
+// OTLPExporter sends spans to an OpenTelemetry collector with OTLP/JSON over HTTP
+type OTLPExporter struct {
+	// Endpoint is the full URL of the traces endpoint, for example http://localhost:4318/v1/traces
+	Endpoint string
+	// Client defaults to a client with a ten second timeout
+	Client *http.Client
+	// Header is added to every request, for example for authentication
+	Header http.Header
+}
+
+var otlpClient = &http.Client{Timeout: 10 * time.Second}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue,omitempty"`
+	IntValue    string `json:"intValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpString(key string, v string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: v}}
+}
+
+func otlpDuration(key string, d time.Duration) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: strconv.FormatInt(d.Microseconds(), 10)}}
+}
+
+// otlpRequestFor groups the spans by service, which is a resource attribute in OTLP
+func otlpRequestFor(spans []Span) otlpRequest {
+	var req otlpRequest
+	byService := make(map[string]int)
+	for _, s := range spans {
+		i, ok := byService[s.Service]
+		if !ok {
+			var rs otlpResourceSpans
+			rs.Resource.Attributes = []otlpAttribute{otlpString("service.name", s.Service)}
+			var ss otlpScopeSpans
+			ss.Scope.Name = "github.com/cmargol/pipelines"
+			rs.ScopeSpans = []otlpScopeSpans{ss}
+			req.ResourceSpans = append(req.ResourceSpans, rs)
+			i = len(req.ResourceSpans) - 1
+			byService[s.Service] = i
+		}
+
+		span := otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentSpanID,
+			Name:              s.Name,
+			Kind:              1, // internal
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes: []otlpAttribute{
+				otlpString("pipelines.envelope_id", s.EnvelopeID),
+				otlpDuration("pipelines.queue_wait_us", s.QueueWait),
+				otlpDuration("pipelines.processing_us", s.Processing),
+				otlpDuration("pipelines.send_blocked_us", s.SendBlocked),
+			},
+		}
+		if s.Err != "" {
+			span.Status = otlpStatus{Code: 2, Message: s.Err}
+		}
+		scope := &req.ResourceSpans[i].ScopeSpans[0]
+		scope.Spans = append(scope.Spans, span)
+	}
+	return req
+}
+
+func (e OTLPExporter) Export(ctx context.Context, spans []Span) error {
+	body, err := json.Marshal(otlpRequestFor(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, vs := range e.Header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := e.Client
+	if client == nil {
+		client = otlpClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &HTTPStatusError{URL: e.Endpoint, StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
@@ -0,0 +1,296 @@
+package pipelines
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func tracedPipeline(tracer *Tracer, items []int, delay time.Duration) []error {
+	i := 0
+	queueFunc := func(ctx context.Context) (int, error) {
+		if i >= len(items) {
+			return 0, ErrQueueEmpty
+		}
+		i++
+		return items[i-1], nil
+	}
+	queue, qErrs := TracedQueue(context.Background(), EnvelopeQueue(queueFunc), 0, 1, tracer, "queue")
+	doubled, wErrs := TracedWorkerPool(queue, EnvelopeStage(func(n int) (int, error) {
+		if n < 0 {
+			return 0, fmt.Errorf("negative")
+		}
+		time.Sleep(delay)
+		return n * 2, nil
+	}), 0, 1, tracer, "double")
+	dErrs := TracedDequeue(doubled, func(e Envelope[int]) error {
+		time.Sleep(2 * delay)
+		return nil
+	}, 0, 1, tracer, "store")
+
+	var errs []error
+	for err := range Merge(qErrs, wErrs, dErrs) {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func TestTracer(t *testing.T) {
+	exporter := &MemorySpanExporter{}
+	tracer := NewTracer(TracerOptions{Service: "service", Exporter: exporter})
+	errs := tracedPipeline(tracer, []int{1, 2, -1}, 10*time.Millisecond)
+	if len(errs) != 1 {
+		t.Errorf("expected a single error, got: %v", errs)
+	}
+	if err := tracer.Close(context.Background()); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// Test that every item has a span per stage, all in one trace with each stage the child of the previous one
+	spans := exporter.Spans()
+	if len(spans) != 8 {
+		t.Fatalf("expected 8 spans, got: %d", len(spans))
+	}
+	traces := make(map[string]map[string]Span)
+	for _, s := range spans {
+		if traces[s.TraceID] == nil {
+			traces[s.TraceID] = make(map[string]Span)
+		}
+		traces[s.TraceID][s.Name] = s
+	}
+	if len(traces) != 3 {
+		t.Fatalf("expected 3 traces, got: %d", len(traces))
+	}
+	failed := 0
+	for _, trace := range traces {
+		q, d := trace["queue"], trace["double"]
+		if q.ParentSpanID != "" || d.ParentSpanID != q.SpanID || d.EnvelopeID != q.EnvelopeID {
+			t.Errorf("expected double to be the child of queue, got: %+v, %+v", q, d)
+		}
+		if d.Err != "" {
+			failed++
+			continue
+		}
+		s := trace["store"]
+		if s.ParentSpanID != d.SpanID || d.Service != "service" {
+			t.Errorf("expected store to be the child of double, got: %+v, %+v", d, s)
+		}
+		// The stages sleep for the delay and twice the delay
+		if d.Processing < 10*time.Millisecond || s.Processing < 20*time.Millisecond {
+			t.Errorf("expected the processing times to be recorded, got: %v, %v", d.Processing, s.Processing)
+		}
+		if d.End.Before(d.Start) || s.QueueWait < 0 {
+			t.Errorf("expected valid times, got: %+v, %+v", d, s)
+		}
+	}
+	if failed != 1 {
+		t.Errorf("expected a single failed span, got: %d", failed)
+	}
+
+	// Test that some send blocked time was recorded as store is the slowest stage
+	var blocked time.Duration
+	for _, s := range spans {
+		if s.Name == "double" {
+			blocked += s.SendBlocked
+		}
+	}
+	if blocked == 0 {
+		t.Errorf("expected double to be blocked on store")
+	}
+}
+
+func TestTracerPropagation(t *testing.T) {
+	exporter := &MemorySpanExporter{}
+	tracer := NewTracer(TracerOptions{Exporter: exporter})
+
+	// Test that an incoming trace context is continued, including its sampling decision
+	incoming := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	e := NewEnvelope(1)
+	e.Headers[TraceParentHeader] = incoming
+	out, _ := TracedWorkerPool(ConvertSliceToClosedChannel([]Envelope[int]{e}), func(e Envelope[int]) (Envelope[int], error) {
+		return ChildEnvelope(2, e), nil
+	}, 1, 1, tracer, "stage")
+	res := <-out
+	if e.Headers[TraceParentHeader] != incoming {
+		t.Errorf("expected the input headers to be left alone, got: %s", e.Headers[TraceParentHeader])
+	}
+	_ = tracer.Close(context.Background())
+	spans := exporter.Spans()
+	if len(spans) != 1 || spans[0].TraceID != "0af7651916cd43dd8448eb211c80319c" || spans[0].ParentSpanID != "b7ad6b7169203331" {
+		t.Fatalf("expected the trace to be continued, got: %+v", spans)
+	}
+	expected := "00-0af7651916cd43dd8448eb211c80319c-" + spans[0].SpanID + "-01"
+	if res.Headers[TraceParentHeader] != expected {
+		t.Errorf("expected %s, got: %s", expected, res.Headers[TraceParentHeader])
+	}
+
+	// Test that unsampled traces are propagated but not recorded
+	exporter = &MemorySpanExporter{}
+	tracer = NewTracer(TracerOptions{Exporter: exporter})
+	e = NewEnvelope(1)
+	e.Headers[TraceParentHeader] = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00"
+	out, _ = TracedWorkerPool(ConvertSliceToClosedChannel([]Envelope[int]{e}), EnvelopeStage(func(n int) (int, error) {
+		return n, nil
+	}), 1, 1, tracer, "stage")
+	res = <-out
+	_ = tracer.Close(context.Background())
+	if len(exporter.Spans()) != 0 || !strings.HasSuffix(res.Headers[TraceParentHeader], "-00") {
+		t.Errorf("expected no spans and an unsampled trace, got: %v, %s", exporter.Spans(), res.Headers[TraceParentHeader])
+	}
+}
+
+func TestTracerSampling(t *testing.T) {
+	exporter := &MemorySpanExporter{}
+	tracer := NewTracer(TracerOptions{Exporter: exporter, SampleRate: 0.5})
+	items := make([]int, 1000)
+	tracedPipeline(tracer, items, 0)
+	_ = tracer.Close(context.Background())
+
+	// Test that about half of the traces are recorded, and always with all of their spans
+	traces := make(map[string]int)
+	for _, s := range exporter.Spans() {
+		traces[s.TraceID]++
+	}
+	if len(traces) < 350 || len(traces) > 650 {
+		t.Errorf("expected about 500 traces, got: %d", len(traces))
+	}
+	for id, n := range traces {
+		if n != 3 {
+			t.Errorf("expected 3 spans for trace %s, got: %d", id, n)
+		}
+	}
+}
+
+// blockingSpanExporter blocks every export until its context is done or it is released
+type blockingSpanExporter struct {
+	exports chan int
+	release chan struct{}
+}
+
+func (b blockingSpanExporter) Export(ctx context.Context, spans []Span) error {
+	b.exports <- len(spans)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-b.release:
+		return nil
+	}
+}
+
+func TestTracerLimits(t *testing.T) {
+	exporter := blockingSpanExporter{exports: make(chan int, 10), release: make(chan struct{})}
+	defer close(exporter.release)
+	errc := make(chan error, 10)
+	tracer := NewTracer(TracerOptions{
+		Exporter:         exporter,
+		BatchSize:        2,
+		MaxBufferedSpans: 4,
+		ExportTimeout:    20 * time.Millisecond,
+		OnError:          func(err error) { errc <- err },
+	})
+
+	// Test that a background export is cancelled after the export timeout
+	tracer.record(Span{})
+	tracer.record(Span{})
+	if n := <-exporter.exports; n != 2 {
+		t.Errorf("expected a batch of 2 spans, got: %d", n)
+	}
+	if err := <-errc; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got: %v", err)
+	}
+
+	// Test that spans are dropped and counted once the buffer is full
+	for i := 0; i < 20; i++ {
+		tracer.record(Span{})
+	}
+	tracer.mu.Lock()
+	buffered := len(tracer.spans)
+	tracer.mu.Unlock()
+	// The export loop takes at most one batch meanwhile as the export blocks
+	if buffered > 4 || tracer.Dropped() < 12 {
+		t.Errorf("expected at most 4 buffered spans, got: %d, %d dropped", buffered, tracer.Dropped())
+	}
+
+	// Test that Close does not hang on an export that does not return
+	tracer = NewTracer(TracerOptions{Exporter: exporter, BatchSize: 1, ExportTimeout: time.Minute})
+	tracer.record(Span{})
+	<-exporter.exports
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := tracer.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected Close to return once the context is done, took: %v", elapsed)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var mu sync.Mutex
+	var requests []otlpRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request: %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("expected valid json, got: %v", err)
+		}
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	// Test that spans are batched and sent to the collector
+	tracer := NewTracer(TracerOptions{
+		Service:  "service",
+		Exporter: OTLPExporter{Endpoint: collector.URL + "/v1/traces"},
+		OnError:  func(err error) { t.Errorf("expected no export errors, got: %v", err) },
+	})
+	tracedPipeline(tracer, []int{1, -1}, 0)
+	if err := tracer.Close(context.Background()); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(requests) != 1 || len(requests[0].ResourceSpans) != 1 {
+		t.Fatalf("expected a single request for a single service, got: %+v", requests)
+	}
+	rs := requests[0].ResourceSpans[0]
+	if rs.Resource.Attributes[0].Value.StringValue != "service" {
+		t.Errorf("expected the service name, got: %+v", rs.Resource.Attributes)
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 5 {
+		t.Fatalf("expected 5 spans, got: %d", len(spans))
+	}
+	errored := 0
+	for _, s := range spans {
+		if len(s.TraceID) != 32 || len(s.SpanID) != 16 || s.StartTimeUnixNano == "" {
+			t.Errorf("expected ids and times, got: %+v", s)
+		}
+		if s.Status.Code == 2 {
+			errored++
+		}
+	}
+	if errored != 1 {
+		t.Errorf("expected a single errored span, got: %d", errored)
+	}
+
+	// Test that a failing collector is reported
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	err := OTLPExporter{Endpoint: failing.URL}.Export(context.Background(), []Span{{Name: "stage"}})
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("expected a 503 error, got: %v", err)
+	}
+}
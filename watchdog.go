@@ -0,0 +1,268 @@
+package pipelines
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// BlockedDirection is what the blocked stage of a stalled pipeline is waiting on
+type BlockedDirection int
+
+const (
+	// BlockedSend is waiting for the next stage to take a result from its output channel
+	BlockedSend BlockedDirection = iota
+	// BlockedSendError is waiting for an error to be taken from its error channel
+	BlockedSendError
+	// BlockedReceive is waiting for an item on its input channel
+	BlockedReceive
+	// BlockedFunction has not returned from the stage function
+	BlockedFunction
+)
+
+func (d BlockedDirection) String() string {
+	switch d {
+	case BlockedSend:
+		return "send to out"
+	case BlockedSendError:
+		return "send to errc"
+	case BlockedReceive:
+		return "receive"
+	case BlockedFunction:
+		return "stage function"
+	default:
+		return "unknown"
+	}
+}
+
+func (d BlockedDirection) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// StallError is reported by Watchdog when no stage of a pipeline made progress while items are pending. It is an
+// ErrFatal and Fatal returns the goroutine stacks.
+type StallError struct {
+	Pipeline string
+	// Stage is the blocked stage, the stages before it are usually blocked sending to it
+	Stage     string
+	Kind      string
+	Direction BlockedDirection
+	// Channel is the channel the stage is blocked on, it is nil when blocked in the stage function
+	Channel *ChannelStats
+	// Since is the last time any stage made progress
+	Since    time.Time
+	Snapshot PipelineSnapshot
+	// Stacks are the goroutines that are running code of this package
+	Stacks string
+}
+
+func (e *StallError) Error() string {
+	msg := fmt.Sprintf("pipeline %s stalled since %s: stage %s is blocked on %s", e.Pipeline, e.Since.Format(time.RFC3339), e.Stage, e.Direction)
+	if e.Channel != nil {
+		msg += fmt.Sprintf(" (%d/%d)", e.Channel.Len, e.Channel.Cap)
+	}
+	return msg
+}
+
+func (e *StallError) Fatal() string {
+	return e.Stacks
+}
+
+// WatchdogOptions configures Watchdog
+type WatchdogOptions struct {
+	// Timeout is how long no stage may make progress while items are pending before the pipeline is reported as
+	// stalled, it defaults to 30 seconds
+	Timeout time.Duration
+	// Interval is how often the pipeline is checked, it defaults to a quarter of the Timeout
+	Interval time.Duration
+	// OnStall is called with every stall, when it is nil stalls are sent on the channel returned by Watchdog
+	OnStall func(*StallError)
+}
+
+// Watchdog checks a Pipeline for stalls, for example an error channel that nobody drains whose buffer filled up. A
+// pipeline is stalled when none of its stages made progress for the Timeout while items are pending, that is a worker
+// is sending or an item waits in a channel or in a stage function. A source waiting in its queue function does not
+// count as pending, and paused pipelines and stages are not checked. Every stall is reported once as a StallError
+// until the pipeline makes progress again. The returned channel is closed once the context is done or every stage of
+// the pipeline is done.
+func Watchdog(ctx context.Context, p *Pipeline, opts WatchdogOptions) <-chan error {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = opts.Timeout / 4
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		var reported time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if p.Done() {
+				return
+			}
+			stall := findStall(p, opts.Timeout, time.Now())
+			if stall == nil || stall.Since.Equal(reported) {
+				continue
+			}
+			reported = stall.Since
+			stall.Snapshot = p.Snapshot()
+			stall.Stacks = goroutineStacks()
+			logError("Watchdog", "pipeline stalled", stall, "service", p.name, "stage", stall.Stage, "direction", stall.Direction.String())
+			if opts.OnStall != nil {
+				opts.OnStall(stall)
+				continue
+			}
+			select {
+			case errc <- stall:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return errc
+}
+
+// blocked returns the direction the workers of the stage are blocked sending in, errors take precedence as a full
+// error channel that is not drained is the most common stall
+func (s *stageState) blocked() (BlockedDirection, bool) {
+	sending := false
+	for i := range s.workers {
+		switch WorkerState(s.workers[i].Load()) {
+		case WorkerSendingError:
+			return BlockedSendError, true
+		case WorkerSending:
+			sending = true
+		}
+	}
+	return BlockedSend, sending
+}
+
+func (s *stageState) hasWorker(state WorkerState) bool {
+	for i := range s.workers {
+		if WorkerState(s.workers[i].Load()) == state {
+			return true
+		}
+	}
+	return false
+}
+
+// pending returns if the stage has items it did not pass on yet, a source waiting in its queue function has none
+func (s *stageState) pending() bool {
+	if _, ok := s.blocked(); ok || (s.kind != "Queue" && s.hasWorker(WorkerBusy)) {
+		return true
+	}
+	return s.input != nil && s.input.stats().Len > 0
+}
+
+// findStall returns the blocked stage if no stage made progress for the timeout while items are pending
+func findStall(p *Pipeline, timeout time.Duration, now time.Time) *StallError {
+	if p.Paused() {
+		return nil
+	}
+	p.mu.Lock()
+	all := append([]*stageState(nil), p.stages...)
+	p.mu.Unlock()
+
+	var stages []*stageState
+	var last int64
+	pending := false
+	for _, s := range all {
+		if s.done.Load() {
+			continue
+		}
+		if s.paused() {
+			return nil
+		}
+		stages = append(stages, s)
+		if progress := s.lastProgress.Load(); progress > last {
+			last = progress
+		}
+		pending = pending || s.pending()
+	}
+	since := time.Unix(0, last)
+	if len(stages) == 0 || !pending || now.Sub(since) < timeout {
+		return nil
+	}
+
+	stall := func(s *stageState, d BlockedDirection, c *channelProbe) *StallError {
+		return &StallError{Pipeline: p.name, Stage: s.name, Kind: s.kind, Direction: d, Channel: c.snapshot(), Since: since}
+	}
+	consumers := make(map[uintptr]*stageState)
+	for _, s := range stages {
+		if s.input != nil {
+			consumers[s.input.id] = s
+		}
+	}
+
+	// Follow the stages that are blocked sending downstream to the first one whose channel is not taken by a stage
+	for _, s := range stages {
+		d, ok := s.blocked()
+		if !ok {
+			continue
+		}
+		visited := make(map[*stageState]bool)
+		for {
+			visited[s] = true
+			c := s.output
+			if d == BlockedSendError {
+				c = s.errors
+			}
+			next := consumers[c.id]
+			if next == nil || visited[next] {
+				return stall(s, d, c)
+			}
+			if nd, ok := next.blocked(); ok {
+				s, d = next, nd
+				continue
+			}
+			if next.hasWorker(WorkerBusy) {
+				return stall(next, BlockedFunction, nil)
+			}
+			return stall(s, d, c)
+		}
+	}
+	for _, s := range stages {
+		if s.kind != "Queue" && s.hasWorker(WorkerBusy) {
+			return stall(s, BlockedFunction, nil)
+		}
+	}
+	for _, s := range stages {
+		if s.hasWorker(WorkerIdle) {
+			return stall(s, BlockedReceive, s.input)
+		}
+	}
+	return stall(stages[0], BlockedFunction, nil)
+}
+
+var watchdogPackage = reflect.TypeOf((*Pipeline)(nil)).Elem().PkgPath()
+
+// goroutineStacks returns the stacks of the goroutines that are running code of this package
+func goroutineStacks() string {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	var relevant []string
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, watchdogPackage+".") && !strings.Contains(g, watchdogPackage+".goroutineStacks") {
+			relevant = append(relevant, g)
+		}
+	}
+	return strings.Join(relevant, "\n\n")
+}
@@ -0,0 +1,121 @@
+package pipelines
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+	p := NewPipeline("service", PipelineOptions{})
+	queue, qErrs := PipelineQueue(context.Background(), func(ctx context.Context) (int, error) {
+		return 1, nil
+	}, 1, 1, p, "source")
+	out, wErrs := PipelineWorkerPool(queue, func(v int) (int, error) {
+		return 0, fmt.Errorf("failed")
+	}, 1, 2, p, "work")
+	dErrs := PipelineDequeue(out, func(v int) error { return nil }, 0, 1, p, "sink")
+	go func() {
+		for range Merge(qErrs, dErrs) {
+		}
+	}()
+
+	// Test that an error channel that is not drained is reported as a stall of the stage sending to it
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stalls := Watchdog(ctx, p, WatchdogOptions{Timeout: 50 * time.Millisecond, Interval: 10 * time.Millisecond})
+	var err error
+	select {
+	case err = <-stalls:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a stall to be reported")
+	}
+	stall, ok := err.(*StallError)
+	if !ok {
+		t.Fatalf("expected a StallError, got: %v", err)
+	}
+	if _, ok := err.(ErrFatal); !ok {
+		t.Errorf("expected the stall to be fatal")
+	}
+	if stall.Pipeline != "service" || stall.Stage != "work" || stall.Direction != BlockedSendError || stall.Channel.Len != 1 {
+		t.Errorf("expected work to be blocked sending to errc, got: %v", stall)
+	}
+	if !strings.Contains(stall.Error(), "stage work is blocked on send to errc (1/1)") || len(stall.Snapshot.Stages) != 3 {
+		t.Errorf("unexpected stall: %v, %+v", stall, stall.Snapshot)
+	}
+	if !strings.Contains(stall.Fatal(), "WorkerPoolWithOptions") || strings.Contains(stall.Fatal(), "goroutineStacks") {
+		t.Errorf("expected the stacks of the blocked workers, got: %s", stall.Fatal())
+	}
+
+	// Test that the stall is reported once and the channel is closed once the pipeline is done
+	p.Drain()
+	for range wErrs {
+	}
+	waitFor(t, "the pipeline to be done", p.Done)
+	select {
+	case err, ok := <-stalls:
+		if ok {
+			t.Errorf("expected a single stall, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected the channel to be closed")
+	}
+}
+
+func TestWatchdogStageFunction(t *testing.T) {
+	p := NewPipeline("service", PipelineOptions{})
+	// The first source waits for items that never come which is not a stall
+	idleCtx, stopIdle := context.WithCancel(context.Background())
+	idle, idleErrs := PipelineQueue(idleCtx, func(ctx context.Context) (int, error) {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}, 0, 1, p, "idle")
+	idleErrs2 := PipelineDequeue(idle, func(v int) error { return nil }, 0, 1, p, "idle-sink")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stalls := make(chan *StallError, 10)
+	errs := Watchdog(ctx, p, WatchdogOptions{Timeout: 30 * time.Millisecond, Interval: 5 * time.Millisecond, OnStall: func(s *StallError) {
+		stalls <- s
+	}})
+	time.Sleep(100 * time.Millisecond)
+	if len(stalls) != 0 {
+		t.Fatalf("expected an idle source not to be a stall, got: %v", <-stalls)
+	}
+
+	// Test that a stage function that does not return is reported through the callback
+	release := make(chan struct{})
+	n := 0
+	queue, qErrs := PipelineQueue(context.Background(), func(ctx context.Context) (int, error) {
+		n++
+		if n > 3 {
+			return 0, ErrQueueEmpty
+		}
+		return n, nil
+	}, 0, 1, p, "source")
+	dErrs := PipelineDequeue(queue, func(v int) error {
+		<-release
+		return nil
+	}, 0, 1, p, "stuck")
+	var stall *StallError
+	select {
+	case stall = <-stalls:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a stall to be reported")
+	}
+	if stall.Stage != "stuck" || stall.Direction != BlockedFunction || stall.Channel != nil {
+		t.Errorf("expected the stuck stage function, got: %v", stall)
+	}
+
+	close(release)
+	for range Merge(qErrs, dErrs) {
+	}
+	cancel()
+	for range errs {
+	}
+	stopIdle()
+	for range Merge(idleErrs, idleErrs2) {
+	}
+}